@@ -0,0 +1,80 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"crave-and-glaze/internal/daraja/darajasim"
+)
+
+// A local stand-in for Safaricom so checkout can be tested end to end.
+//
+// Run it, then start the server with:
+//
+//	MPESA_BASE_URL=http://localhost:8090
+//	MPESA_CALLBACK_URL=http://localhost:8080/api/callback/mpesa
+//	MPESA_KEY=sim MPESA_SECRET=sim
+//	MPESA_C2B_URL=http://localhost:8080/api/c2b MPESA_C2B_REGISTER=true
+//	MPESA_C2B_TOKEN=<32+ random letters or digits> MPESA_CALLBACK_ALLOWED_IPS=127.0.0.1
+//	MPESA_INITIATOR_NAME=sim MPESA_SECURITY_CREDENTIAL=sim (to confirm C2B payments)
+func main() {
+	addr := flag.String("addr", ":8090", "address to listen on")
+	outcome := flag.String("outcome", "success", "success, cancel, timeout, insufficient_funds or no_callback")
+	delay := flag.Duration("delay", 5*time.Second, "how long the customer takes to answer the prompt")
+	callbackURL := flag.String("callback-url", "", "send callbacks here instead of the CallBackURL in each push")
+	flag.Parse()
+
+	o, err := darajasim.ParseOutcome(*outcome)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	sim := darajasim.New(darajasim.Config{
+		Outcome:     o,
+		Delay:       *delay,
+		CallbackURL: *callbackURL,
+	})
+
+	// Switch outcomes without restarting: POST /sim/outcome?value=cancel
+	mux := http.NewServeMux()
+	mux.Handle("/", logRequests(sim))
+	mux.HandleFunc("POST /sim/outcome", func(w http.ResponseWriter, r *http.Request) {
+		o, err := darajasim.ParseOutcome(r.URL.Query().Get("value"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		sim.SetOutcome(o)
+		fmt.Fprintf(w, "outcome set to %s\n", o)
+	})
+
+	// Pay the Paybill by hand: POST /sim/c2b?ref=CG-7K3M9Q&amount=4000&phone=254712345678
+	mux.HandleFunc("POST /sim/c2b", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		amount, err := strconv.ParseFloat(q.Get("amount"), 64)
+		if err != nil || amount < 1 {
+			http.Error(w, "amount is required", http.StatusBadRequest)
+			return
+		}
+		receipt, err := sim.PayBill(q.Get("ref"), amount, q.Get("phone"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		fmt.Fprintf(w, "paid %s with receipt %s\n", q.Get("ref"), receipt)
+	})
+
+	fmt.Printf("Daraja simulator on %s (outcome=%s, delay=%s)\n", *addr, o, *delay)
+	log.Fatal(http.ListenAndServe(*addr, mux))
+}
+
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("%s %s", r.Method, r.URL.Path)
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"crave-and-glaze/internal/models"
+	"crave-and-glaze/internal/repository"
+)
+
+// billRefPattern finds an order number in what an admin typed: "Order-123",
+// "ORDER 123", "#123" or just "123"
+var billRefPattern = regexp.MustCompile(`(?i)^\s*(?:order)?[\s\-#:_.]*0*(\d{1,9})\s*$`)
+
+// orderIDFromBillRef returns the order number in a reference, or 0. Order
+// numbers are easy to guess, so only admins assigning payments may use them.
+func orderIDFromBillRef(billRef string) int {
+	m := billRefPattern.FindStringSubmatch(billRef)
+	if m == nil {
+		return 0
+	}
+	id, _ := strconv.Atoi(m[1])
+	return id
+}
+
+// billRefOrder returns the order a C2B account number names, or 0. Only the
+// order's code (e.g. "CG-7K3M9Q") matches; payments quoting anything else,
+// plain order numbers included, are parked for an admin.
+func (app *Application) billRefOrder(billRef string) int {
+	if _, ok := models.ParsePublicCode(billRef); !ok {
+		return 0
+	}
+	order, err := app.Orders.GetByCode(billRef)
+	if err != nil {
+		return 0
+	}
+	return order.ID
+}
+
+// c2bTokenOK reports whether a C2B call came to the URLs we registered, which
+// carry a secret only Safaricom knows
+func (app *Application) c2bTokenOK(r *http.Request) bool {
+	token := app.Mpesa.Config.C2BToken
+	return token != "" && subtle.ConstantTimeCompare([]byte(r.PathValue("token")), []byte(token)) == 1
+}
+
+// c2bValidationHandler is asked by Safaricom whether to accept a Paybill/Till
+// payment before it goes through (only if external validation is enabled on the
+// shortcode). We accept anything with a valid amount; payments we can't match
+// are parked for an admin rather than bounced back to the customer.
+func (app *Application) c2bValidationHandler(w http.ResponseWriter, r *http.Request) {
+	if !app.c2bTokenOK(r) {
+		noteCallback(r, "", "REJECTED", "C2B URL token does not match")
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	var req models.C2BRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		noteCallback(r, "", "REJECTED", "invalid JSON: "+err.Error())
+		writeC2BAck(w, "C2B00016", "Rejected")
+		return
+	}
+
+	amount, err := strconv.ParseFloat(req.TransAmount, 64)
+	if err != nil || amount <= 0 {
+		noteCallback(r, req.TransID, "REJECTED", "invalid amount "+req.TransAmount)
+		writeC2BAck(w, "C2B00013", "Rejected")
+		return
+	}
+
+	note := fmt.Sprintf("%q does not name an order, will be parked", req.BillRefNumber)
+	if orderID := app.billRefOrder(req.BillRefNumber); orderID != 0 {
+		note = fmt.Sprintf("for order #%d", orderID)
+	}
+	noteCallback(r, req.TransID, "ACCEPTED", note)
+	writeC2BAck(w, "0", "Accepted")
+}
+
+// c2bConfirmationHandler receives a completed Paybill/Till payment. The money has
+// already moved, so we always acknowledge it. A payment naming an order is only
+// applied once a Transaction Status query confirms it (see applyC2BStatus);
+// anything else stays UNALLOCATED for /admin/payments/unallocated.
+func (app *Application) c2bConfirmationHandler(w http.ResponseWriter, r *http.Request) {
+	if !app.c2bTokenOK(r) {
+		noteCallback(r, "", "REJECTED", "C2B URL token does not match")
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	var req models.C2BRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		rejectCallback(w, r, "", "invalid JSON: "+err.Error())
+		return
+	}
+	ref := req.TransID
+
+	// 1. Keep every payment, matched or not
+	amount, _ := strconv.ParseFloat(req.TransAmount, 64)
+	paymentID, err := app.C2B.Record(&models.C2BPayment{
+		TransID:   req.TransID,
+		TransTime: req.TransTime,
+		Amount:    amount,
+		BillRef:   strings.TrimSpace(req.BillRefNumber),
+		MSISDN:    req.MSISDN,
+		PayerName: strings.Join(strings.Fields(req.FirstName+" "+req.MiddleName+" "+req.LastName), " "),
+	})
+	if errors.Is(err, repository.ErrDuplicateC2B) {
+		noteCallback(r, ref, "ACCEPTED", "duplicate confirmation, ignored")
+		writeC2BAck(w, "0", "Accepted")
+		return
+	}
+	if err != nil {
+		log.Println("Error recording C2B payment:", err)
+		http.Error(w, "Server Error", 500)
+		return
+	}
+
+	// 2. Try to match it to an order by the account number
+	orderID := app.billRefOrder(req.BillRefNumber)
+	if orderID == 0 {
+		app.parkC2B(w, r, paymentID, ref, fmt.Sprintf("account %q does not name an order", req.BillRefNumber))
+		return
+	}
+
+	// 3. Ask Safaricom whether the payment is real before it counts towards the order
+	if !app.Mpesa.StatusEnabled() {
+		app.parkC2B(w, r, paymentID, ref, fmt.Sprintf("for order #%d, but it can't be confirmed with M-Pesa (no initiator configured); check the statement before assigning it", orderID))
+		return
+	}
+	token, err := app.C2B.StartVerify(paymentID, orderID)
+	if err != nil {
+		log.Println("Error starting C2B verification:", err)
+		app.parkC2B(w, r, paymentID, ref, fmt.Sprintf("for order #%d, but verification could not start: %v", orderID, err))
+		return
+	}
+	resp, err := app.Mpesa.TransactionStatus(req.TransID, token)
+	if err != nil {
+		log.Println("Transaction Status Error:", err)
+		app.parkC2B(w, r, paymentID, ref, fmt.Sprintf("for order #%d, but M-Pesa could not be asked to confirm it: %v", orderID, err))
+		return
+	}
+
+	noteCallback(r, ref, "ACCEPTED", fmt.Sprintf("for order #%d, waiting for M-Pesa to confirm (%s)", orderID, resp.ConversationID))
+	writeC2BAck(w, "0", "Accepted")
+}
+
+// parkC2B leaves a payment in the unallocated queue with the reason why
+func (app *Application) parkC2B(w http.ResponseWriter, r *http.Request, paymentID int, ref, note string) {
+	app.noteC2B(paymentID, ref, note)
+	noteCallback(r, ref, "ACCEPTED", "unallocated: "+note)
+	writeC2BAck(w, "0", "Accepted")
+}
+
+// noteC2B records why a payment is still unallocated
+func (app *Application) noteC2B(paymentID int, ref, note string) {
+	log.Printf("C2B payment %s parked: %s", ref, note)
+	if err := app.C2B.SetNote(paymentID, note); err != nil {
+		log.Println("Error saving C2B note:", err)
+	}
+}
+
+// c2bStatusResultHandler receives Safaricom's answer to a Transaction Status query
+func (app *Application) c2bStatusResultHandler(w http.ResponseWriter, r *http.Request) {
+	var callback models.MpesaResultResponse
+	if err := json.NewDecoder(r.Body).Decode(&callback); err != nil {
+		rejectCallback(w, r, "", "invalid JSON: "+err.Error())
+		return
+	}
+
+	app.applyC2BStatus(w, r, callback.Result)
+}
+
+// c2bStatusTimeoutHandler is called when Safaricom gives up on a queued Transaction Status query
+func (app *Application) c2bStatusTimeoutHandler(w http.ResponseWriter, r *http.Request) {
+	var callback models.MpesaResultResponse
+	if err := json.NewDecoder(r.Body).Decode(&callback); err != nil {
+		rejectCallback(w, r, "", "invalid JSON: "+err.Error())
+		return
+	}
+
+	// A queue timeout carries no ResultCode of its own, so force a failure
+	result := callback.Result
+	if result.ResultCode == 0 {
+		result.ResultCode = -1
+	}
+	if result.ResultDesc == "" {
+		result.ResultDesc = "Request timed out in the M-Pesa queue"
+	}
+
+	app.applyC2BStatus(w, r, result)
+}
+
+// applyC2BStatus allocates a C2B payment to the order it named once Safaricom
+// confirms a completed transaction with the same receipt and amount. Otherwise
+// the payment is parked for an admin.
+func (app *Application) applyC2BStatus(w http.ResponseWriter, r *http.Request, result models.MpesaResult) {
+	ref := result.ConversationID
+	// The token is the secret we sent with the query, and names the payment
+	payment, err := app.C2B.ByVerifyToken(r.PathValue("token"))
+	if errors.Is(err, repository.ErrUnknownC2B) {
+		rejectCallback(w, r, ref, "no C2B payment is waiting for this token")
+		return
+	}
+	if err != nil {
+		log.Println("Error loading C2B payment:", err)
+		http.Error(w, "Server Error", 500)
+		return
+	}
+
+	orderID := payment.MatchOrderID
+	amount, _ := strconv.ParseFloat(result.Param("Amount"), 64)
+	var problem string
+	switch {
+	case result.ResultCode != 0:
+		problem = fmt.Sprintf("M-Pesa could not confirm it: %s", result.ResultDesc)
+	case result.Param("TransactionStatus") != "Completed":
+		problem = fmt.Sprintf("M-Pesa reports it as %q", result.Param("TransactionStatus"))
+	case result.Param("ReceiptNo") != payment.TransID:
+		problem = fmt.Sprintf("M-Pesa confirmed receipt %q instead", result.Param("ReceiptNo"))
+	case amount != payment.Amount:
+		problem = fmt.Sprintf("M-Pesa confirmed KES %.2f, not KES %.2f", amount, payment.Amount)
+	}
+	if problem != "" {
+		note := fmt.Sprintf("for order #%d, but %s", orderID, problem)
+		app.noteC2B(payment.ID, payment.TransID, note)
+		acceptCallback(w, r, ref, "unallocated: "+note)
+		return
+	}
+
+	receipt, err := app.C2B.Allocate(payment.ID, orderID, "confirmed by M-Pesa")
+	var note string
+	switch {
+	case errors.Is(err, repository.ErrC2BAllocated):
+		acceptCallback(w, r, ref, "already allocated, ignored")
+		return
+	case errors.Is(err, repository.ErrOrderNotPayable):
+		note = fmt.Sprintf("order #%d does not exist or is not awaiting payment", orderID)
+	case errors.Is(err, repository.ErrC2BTooSmall):
+		note = fmt.Sprintf("KES %.2f is less than what is due on order #%d", payment.Amount, orderID)
+	case errors.Is(err, repository.ErrDuplicateReceipt):
+		note = fmt.Sprintf("receipt %s already paid an M-Pesa prompt, not counted again", payment.TransID)
+	case err != nil:
+		log.Println("Error allocating C2B payment:", err)
+		note = "allocation error: " + err.Error()
+	}
+	if note != "" {
+		app.noteC2B(payment.ID, payment.TransID, note)
+		acceptCallback(w, r, ref, "unallocated: "+note)
+		return
+	}
+
+	// Same emails as an STK payment
+	log.Printf("C2B Payment Confirmed for order #%d: %s", orderID, receipt)
+	app.sendPaymentEmails(orderID, "", receipt)
+
+	acceptCallback(w, r, ref, fmt.Sprintf("order #%d paid: %s", orderID, receipt))
+}
+
+// writeC2BAck answers a C2B call. Unlike STK callbacks the codes are strings,
+// and a validation rejection must use one of Safaricom's C2B000xx codes.
+func writeC2BAck(w http.ResponseWriter, code, desc string) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"ResultCode": code,
+		"ResultDesc": desc,
+	})
+}
+
+// adminUnallocatedPaymentsHandler lists C2B payments we couldn't match to an order
+func (app *Application) adminUnallocatedPaymentsHandler(w http.ResponseWriter, r *http.Request) {
+	payments, err := app.C2B.Unallocated()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Server Error", 500)
+		return
+	}
+
+	data := &models.TemplateData{
+		Title:       "Unallocated Payments",
+		C2BPayments: payments,
+		Flash:       r.URL.Query().Get("msg"),
+		IsAdmin:     true,
+	}
+
+	app.render(w, r, "admin/unallocated_payments.page.html", data)
+}
+
+// adminAssignPaymentHandler assigns an unallocated payment to an order by hand
+func (app *Application) adminAssignPaymentHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Bad Request", 400)
+		return
+	}
+
+	paymentID, _ := strconv.Atoi(r.FormValue("payment_id"))
+	orderID := app.billRefOrder(r.FormValue("order_id"))
+	if orderID == 0 {
+		orderID = orderIDFromBillRef(r.FormValue("order_id"))
+	}
+
+	back := func(msg string) {
+		http.Redirect(w, r, "/admin/payments/unallocated?msg="+url.QueryEscape(msg), http.StatusSeeOther)
+	}
+
+	if orderID == 0 {
+		back("Please enter an order number.")
+		return
+	}
+
+	receipt, err := app.C2B.Allocate(paymentID, orderID, "assigned by admin")
+	switch {
+	case errors.Is(err, repository.ErrUnknownC2B), errors.Is(err, repository.ErrC2BAllocated):
+		back("That payment has already been assigned.")
+		return
+	case errors.Is(err, repository.ErrOrderNotPayable):
+		back(fmt.Sprintf("Order #%d does not exist or is not awaiting payment.", orderID))
+		return
+	case errors.Is(err, repository.ErrC2BTooSmall):
+		back(fmt.Sprintf("That payment doesn't cover what is due on order #%d.", orderID))
+		return
+	case errors.Is(err, repository.ErrDuplicateReceipt):
+		back("That receipt already paid an M-Pesa prompt, so it has been counted once already.")
+		return
+	case err != nil:
+		log.Println("Error assigning C2B payment:", err)
+		http.Error(w, "Server Error", 500)
+		return
+	}
+
+	app.sendPaymentEmails(orderID, "", receipt)
+	back(fmt.Sprintf("Payment %s assigned to order #%d.", receipt, orderID))
+}
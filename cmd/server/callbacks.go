@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// callbackAudit is filled in by a callback handler and saved by auditCallback
+type callbackAudit struct {
+	Reference string // CheckoutRequestID or ConversationID
+	Outcome   string // ACCEPTED, REJECTED
+	Note      string
+}
+
+type callbackAuditKey struct{}
+
+// mpesaCallback guards every endpoint Safaricom posts to. It stores the raw
+// payload for audit, enforces the optional source IP allowlist, and records
+// what the handler decided once it returns.
+func (app *Application) mpesaCallback(kind string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		raw, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+		r.Body.Close()
+		if err != nil {
+			http.Error(w, "Bad Request", 400)
+			return
+		}
+
+		ip := app.clientIP(r)
+		logID, err := app.Payments.LogCallback(kind, ip, string(raw))
+		if err != nil {
+			log.Println("Error logging M-Pesa callback:", err)
+		}
+
+		audit := &callbackAudit{}
+		defer func() {
+			if logID == 0 {
+				return
+			}
+			if audit.Outcome == "" {
+				audit.Outcome = "ERROR"
+			}
+			if err := app.Payments.SetCallbackOutcome(logID, audit.Reference, audit.Outcome, audit.Note); err != nil {
+				log.Println("Error saving M-Pesa callback outcome:", err)
+			}
+		}()
+
+		if !app.callbackSourceAllowed(ip) {
+			log.Printf("%s callback rejected: source %s is not in MPESA_CALLBACK_ALLOWED_IPS", kind, ip)
+			audit.Outcome, audit.Note = "REJECTED", "source IP not allowed"
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		r.Body = io.NopCloser(bytes.NewReader(raw))
+		next(w, r.WithContext(context.WithValue(r.Context(), callbackAuditKey{}, audit)))
+	}
+}
+
+// acceptCallback acknowledges a callback we acted on
+func acceptCallback(w http.ResponseWriter, r *http.Request, reference, note string) {
+	noteCallback(r, reference, "ACCEPTED", note)
+	writeCallbackAck(w, 0, "Accepted")
+}
+
+// rejectCallback refuses a callback we don't trust or can't match
+func rejectCallback(w http.ResponseWriter, r *http.Request, reference, note string) {
+	log.Printf("Callback rejected (%s): %s", reference, note)
+	noteCallback(r, reference, "REJECTED", note)
+	writeCallbackAck(w, 1, "Rejected")
+}
+
+func noteCallback(r *http.Request, reference, outcome, note string) {
+	if audit, ok := r.Context().Value(callbackAuditKey{}).(*callbackAudit); ok {
+		audit.Reference, audit.Outcome, audit.Note = reference, outcome, note
+	}
+}
+
+// clientIP is the caller's address. Behind Render's proxy the real address is
+// in X-Forwarded-For, which we only trust when told to. Clients can send the
+// header themselves, so only the entries our own proxies appended count: the
+// ProxyHops right-most ones, the left-most of those being the client.
+func (app *Application) clientIP(r *http.Request) string {
+	if app.ProxyHops > 0 {
+		var hops []string
+		for _, value := range r.Header.Values("X-Forwarded-For") {
+			hops = append(hops, strings.Split(value, ",")...)
+		}
+		if len(hops) >= app.ProxyHops {
+			if ip := strings.TrimSpace(hops[len(hops)-app.ProxyHops]); ip != "" {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// callbackSourceAllowed is true when no allowlist is configured or ip is on it
+func (app *Application) callbackSourceAllowed(ip string) bool {
+	if len(app.CallbackIPs) == 0 {
+		return true
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, network := range app.CallbackIPs {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyHopsFromEnv is how many proxies in front of us append to
+// X-Forwarded-For: TRUSTED_PROXY_HOPS (1 if unset) with TRUST_PROXY_HEADERS=true,
+// otherwise none and the header is ignored
+func proxyHopsFromEnv() (int, error) {
+	if os.Getenv("TRUST_PROXY_HEADERS") != "true" {
+		return 0, nil
+	}
+	value := os.Getenv("TRUSTED_PROXY_HOPS")
+	if value == "" {
+		return 1, nil
+	}
+	hops, err := strconv.Atoi(value)
+	if err != nil || hops < 1 {
+		return 0, fmt.Errorf("TRUSTED_PROXY_HOPS: want a number of proxies, got %q", value)
+	}
+	return hops, nil
+}
+
+// callbackAllowlistFromEnv parses MPESA_CALLBACK_ALLOWED_IPS, a comma separated
+// list of IPs or CIDRs (e.g. Safaricom's published 196.201.214.0/24).
+// An empty list turns the check off.
+func callbackAllowlistFromEnv() ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, entry := range strings.Split(os.Getenv("MPESA_CALLBACK_ALLOWED_IPS"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			if strings.Contains(entry, ":") {
+				entry += "/128"
+			} else {
+				entry += "/32"
+			}
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("MPESA_CALLBACK_ALLOWED_IPS: %w", err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"time"
+
+	"crave-and-glaze/internal/models"
+	"crave-and-glaze/internal/repository"
+)
+
+// cancelPolicy: a full refund up to three days before the slot, less a 25%
+// fee after that, and nothing in the last day once the cake is being made
+var cancelPolicy = models.CancelPolicy{
+	FullRefundBefore: 72 * time.Hour,
+	NoRefundWithin:   24 * time.Hour,
+	LateFeePercent:   25,
+}
+
+// Messages shown on the cancel page, keyed by ?msg=
+var cancelMessages = map[string]string{
+	"done":   "Your order has been cancelled. We've emailed you a confirmation.",
+	"closed": "This order can no longer be cancelled online. Please call us and we'll help.",
+	"paying": "A payment prompt for this order is still open. Please answer or dismiss it on your phone, then try again in a few minutes.",
+}
+
+// cancelQuote works out what the customer would get back if they cancelled now
+func cancelQuote(order *models.Order) *models.CancelQuote {
+	start, ok := slotStart(mustDate(order.FulfilmentDate), order.TimeSlot)
+	if !ok {
+		// No slot recorded: measure from the start of the day
+		start = mustDate(order.FulfilmentDate)
+	}
+	percent := cancelPolicy.RefundPercent(start, time.Now())
+	return &models.CancelQuote{
+		Policy:  cancelPolicy,
+		Percent: percent,
+		Refund:  math.Floor(order.AmountPaid * float64(percent) / 100),
+	}
+}
+
+// cancelOrderPageHandler shows the cancellation policy and what the customer
+// would get back, with a button to go ahead
+func (app *Application) cancelOrderPageHandler(w http.ResponseWriter, r *http.Request) {
+	order, err := app.orderFromRef(r)
+	if err != nil {
+		http.Error(w, "Order not found", 404)
+		return
+	}
+
+	data := &models.TemplateData{
+		Title: "Cancel Order",
+		Order: order,
+		Flash: cancelMessages[r.URL.Query().Get("msg")],
+	}
+	if order.CustomerCanCancel() {
+		data.Cancel = cancelQuote(order)
+	}
+
+	app.render(w, r, "cancel_order.page.html", data)
+}
+
+// cancelOrderHandler cancels the order and records any refund due for an
+// admin to send from the order page
+func (app *Application) cancelOrderHandler(w http.ResponseWriter, r *http.Request) {
+	order, err := app.orderFromRef(r)
+	if err != nil {
+		http.Error(w, "Order not found", 404)
+		return
+	}
+
+	back := func(msg string) {
+		http.Redirect(w, r, "/order/cancel?ref="+order.PublicToken+"&msg="+msg, http.StatusSeeOther)
+	}
+
+	if !order.CustomerCanCancel() {
+		back("closed")
+		return
+	}
+
+	quote := cancelQuote(order)
+	refund, err := app.Orders.CancelByCustomer(order.ID, quote.Percent)
+	if errors.Is(err, repository.ErrBadTransition) || errors.Is(err, repository.ErrUnknownOrder) {
+		back("closed")
+		return
+	}
+	if errors.Is(err, repository.ErrAttemptInFlight) {
+		back("paying")
+		return
+	}
+	if err != nil {
+		log.Println("Error cancelling order:", err)
+		http.Error(w, "Server Error", 500)
+		return
+	}
+
+	log.Printf("Order #%d cancelled by the customer, KES %.2f to refund", order.ID, refund)
+	quote.Refund = refund
+	app.sendCancelEmails(order, quote)
+
+	back("done")
+}
+
+// sendCancelEmails confirms a cancellation to the customer and tells the
+// admin there may be a refund to send
+func (app *Application) sendCancelEmails(order *models.Order, quote *models.CancelQuote) {
+	emailData := struct {
+		ID           int
+		Code         string
+		CustomerName string
+		Fulfilment   string
+		AmountPaid   float64
+		Percent      int
+		Refund       float64
+	}{
+		ID:           order.ID,
+		Code:         order.PublicCode,
+		CustomerName: order.FirstName + " " + order.LastName,
+		Fulfilment:   order.Fulfilment(),
+		AmountPaid:   order.AmountPaid,
+		Percent:      quote.Percent,
+		Refund:       quote.Refund,
+	}
+
+	if order.Email != "" {
+		go app.Mailer.Send(order.Email, "Order Cancelled - Order "+order.PublicCode, "order_cancelled.html", emailData)
+	}
+
+	adminEmail := os.Getenv("ADMIN_EMAIL")
+	if adminEmail != "" {
+		go app.Mailer.Send(adminEmail, "Order "+order.PublicCode+" cancelled by customer", "admin_cancelled.html", emailData)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"crave-and-glaze/internal/cart"
+	"crave-and-glaze/internal/models"
+)
+
+// cartLoad is how much cake the cart would add to a day's bookings
+func (app *Application) cartLoad(items []cart.Item) (models.DayLoad, error) {
+	labels, err := app.Products.WeightLabels(variantIDs(items))
+	if err != nil {
+		return models.DayLoad{}, err
+	}
+
+	var load models.DayLoad
+	for _, item := range items {
+		load = load.Add(models.DayLoad{Kg: models.ParseKg(labels[item.VariantID]) * float64(item.Quantity), Cakes: item.Quantity})
+	}
+	return load, nil
+}
+
+// capacityBetween works out each date's capacity (its override, or its
+// weekday's default) and what is already booked, keyed by YYYY-MM-DD
+func (app *Application) capacityBetween(from, to time.Time) (map[string]models.CapacityDay, error) {
+	weekdays, err := app.Calendar.WeekdayCapacity()
+	if err != nil {
+		return nil, err
+	}
+	overrides, err := app.Calendar.CapacityOverrides(from, to)
+	if err != nil {
+		return nil, err
+	}
+	// Unpaid orders hold their place for a while so two customers can't
+	// both take the last spot while one of them is entering their PIN
+	booked, err := app.Calendar.Booked(from, to, time.Now().Add(-app.CapacityHold))
+	if err != nil {
+		return nil, err
+	}
+
+	days := make(map[string]models.CapacityDay)
+	for day := from; !day.After(to); day = day.AddDate(0, 0, 1) {
+		d := models.CapacityDay{
+			Date:     day.Format(models.DateLayout),
+			Label:    day.Format("Mon 2 Jan"),
+			Capacity: weekdays[day.Weekday()],
+		}
+		if c, ok := overrides[d.Date]; ok {
+			d.Capacity = c
+			d.Override = true
+		}
+		d.Booked = booked[d.Date]
+		days[d.Date] = d
+	}
+	return days, nil
+}
+
+// parseCapacity reads a capacity from a form, treating blanks and junk as no limit
+func parseCapacity(r *http.Request, suffix string) models.Capacity {
+	kg, err := strconv.ParseFloat(r.FormValue("max_kg"+suffix), 64)
+	if err != nil || kg < 0 {
+		kg = 0
+	}
+	cakes, err := strconv.Atoi(r.FormValue("max_cakes" + suffix))
+	if err != nil || cakes < 0 {
+		cakes = 0
+	}
+	return models.Capacity{MaxKg: kg, MaxCakes: cakes}
+}
+
+// adminCapacityHandler shows the weekday defaults and, for every date
+// customers can book, what is booked against its capacity
+func (app *Application) adminCapacityHandler(w http.ResponseWriter, r *http.Request) {
+	first := today()
+	last := first.AddDate(0, 0, bookingDays-1)
+	byDate, err := app.capacityBetween(first, last)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Server Error", 500)
+		return
+	}
+	defaults, err := app.Calendar.WeekdayCapacity()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Server Error", 500)
+		return
+	}
+
+	weekdays := make([]models.CapacityDay, 7)
+	for i, c := range defaults {
+		weekdays[i] = models.CapacityDay{Label: time.Weekday(i).String(), Capacity: c}
+	}
+
+	calendar := make([]models.CapacityDay, 0, bookingDays)
+	for day := first; !day.After(last); day = day.AddDate(0, 0, 1) {
+		calendar = append(calendar, byDate[day.Format(models.DateLayout)])
+	}
+
+	data := &models.TemplateData{
+		Title:    "Baking Capacity",
+		Weekdays: weekdays,
+		Calendar: calendar,
+		Flash:    r.URL.Query().Get("msg"),
+		IsAdmin:  true,
+	}
+
+	app.render(w, r, "admin/capacity.page.html", data)
+}
+
+// adminWeekdayCapacityHandler saves the default capacity for every weekday at once
+func (app *Application) adminWeekdayCapacityHandler(w http.ResponseWriter, r *http.Request) {
+	for day := time.Sunday; day <= time.Saturday; day++ {
+		c := parseCapacity(r, fmt.Sprintf("_%d", day))
+		if err := app.Calendar.SetWeekdayCapacity(day, c); err != nil {
+			log.Println("Error saving weekday capacity:", err)
+			http.Error(w, "Server Error", 500)
+			return
+		}
+	}
+	http.Redirect(w, r, "/admin/capacity?msg="+url.QueryEscape("Weekday capacity saved."), http.StatusSeeOther)
+}
+
+// adminCapacityOverrideHandler sets the capacity for a single date
+func (app *Application) adminCapacityOverrideHandler(w http.ResponseWriter, r *http.Request) {
+	date := r.FormValue("date")
+	if _, err := time.Parse(models.DateLayout, date); err != nil {
+		http.Redirect(w, r, "/admin/capacity?msg="+url.QueryEscape("Please pick a date."), http.StatusSeeOther)
+		return
+	}
+
+	if err := app.Calendar.SetCapacityOverride(date, parseCapacity(r, "")); err != nil {
+		log.Println("Error saving capacity override:", err)
+		http.Error(w, "Server Error", 500)
+		return
+	}
+	http.Redirect(w, r, "/admin/capacity?msg="+url.QueryEscape("Capacity for "+date+" saved."), http.StatusSeeOther)
+}
+
+// adminDeleteCapacityOverrideHandler puts a date back on its weekday's capacity
+func (app *Application) adminDeleteCapacityOverrideHandler(w http.ResponseWriter, r *http.Request) {
+	if err := app.Calendar.DeleteCapacityOverride(r.FormValue("date")); err != nil {
+		log.Println("Error removing capacity override:", err)
+	}
+	http.Redirect(w, r, "/admin/capacity", http.StatusSeeOther)
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"crave-and-glaze/internal/cart"
+	"crave-and-glaze/internal/daraja"
+	"crave-and-glaze/internal/daraja/darajasim"
+	"crave-and-glaze/internal/database"
+	"crave-and-glaze/internal/mailer"
+	"crave-and-glaze/internal/models"
+	"crave-and-glaze/internal/repository"
+)
+
+// These tests place real orders, so they need a Postgres they can write to:
+//
+//	TEST_DATABASE_URL=postgres://... go test ./cmd/server
+//
+// Without it they are skipped.
+func TestMain(m *testing.M) {
+	if dbURL := os.Getenv("TEST_DATABASE_URL"); dbURL != "" {
+		// Templates and schema.sql are found from the repository root
+		if err := os.Chdir("../.."); err != nil {
+			log.Fatal(err)
+		}
+		os.Setenv("DATABASE_URL", dbURL)
+		database.InitDB()
+		cart.SetStore(&cart.PostgresStore{DB: database.DB})
+	}
+	os.Exit(m.Run())
+}
+
+// checkoutTest is the shop wired to a Daraja simulator, with a customer
+// whose cookies (and so cart) persist between requests
+type checkoutTest struct {
+	app     *Application
+	server  *httptest.Server
+	sim     *darajasim.TestServer
+	client  *http.Client
+	variant int
+}
+
+func newCheckoutTest(t *testing.T, outcome darajasim.Outcome) *checkoutTest {
+	t.Helper()
+	if database.DB == nil {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	db := database.DB
+
+	// The simulator answers a moment after the push, once the app has saved
+	// the CheckoutRequestID, like Safaricom would
+	sim := darajasim.NewServer(darajasim.Config{Outcome: outcome, Delay: 200 * time.Millisecond})
+	t.Cleanup(sim.Close)
+
+	app := &Application{
+		Products: &repository.ProductModel{DB: db},
+		Orders:   &repository.OrderModel{DB: db},
+		Payments: &repository.PaymentModel{DB: db},
+		Refunds:  &repository.RefundModel{DB: db},
+		C2B:      &repository.C2BModel{DB: db},
+		Calendar: &repository.CalendarModel{DB: db},
+		Zones:    &repository.ZoneModel{DB: db},
+		Recovery: &repository.RecoveryModel{DB: db},
+		Promos:   &repository.PromotionModel{DB: db},
+		Users:    &repository.UserModel{DB: db},
+		Mailer:   mailer.New("", "", "", ""),
+
+		CapacityHold: 30 * time.Minute,
+		TrackLimiter: newRateLimiter(10, 15*time.Minute),
+		EmailLimiter: newRateLimiter(5, 15*time.Minute),
+	}
+	server := httptest.NewServer(app.routes())
+	t.Cleanup(server.Close)
+
+	app.Mpesa = daraja.NewService(daraja.MpesaConfig{
+		Environment:     "sandbox",
+		BaseURL:         sim.URL,
+		ConsumerKey:     "key",
+		ConsumerSecret:  "secret",
+		BusinessCode:    "174379",
+		PartyB:          "174379",
+		TransactionType: daraja.PayBillOnline,
+		Passkey:         "passkey",
+		CallbackURL:     server.URL + "/api/callback/mpesa",
+	})
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{
+		Jar: jar,
+		// Each step checks where it was sent instead of following it
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+
+	// A cake of its own, so other data in the database doesn't matter
+	suffix := strconv.FormatInt(time.Now().UnixNano(), 36)
+	var categoryID, productID, variantID int
+	err = db.QueryRow(`INSERT INTO categories (name, slug) VALUES ($1, $1) RETURNING id`, "test-"+suffix).Scan(&categoryID)
+	if err == nil {
+		err = db.QueryRow(`INSERT INTO products (category_id, name, is_active) VALUES ($1, $2, true) RETURNING id`, categoryID, "Test Cake "+suffix).Scan(&productID)
+	}
+	if err == nil {
+		err = db.QueryRow(`INSERT INTO product_variants (product_id, weight_label, price) VALUES ($1, '1 Kg', 2500) RETURNING id`, productID).Scan(&variantID)
+	}
+	if err != nil {
+		t.Fatal("seeding a cake:", err)
+	}
+
+	return &checkoutTest{app: app, server: server, sim: sim, client: client, variant: variantID}
+}
+
+// post submits a form and returns the response, which the caller closes
+func (c *checkoutTest) post(t *testing.T, path string, form url.Values) *http.Response {
+	t.Helper()
+	resp, err := c.client.PostForm(c.server.URL+path, form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+// placeOrder puts a cake in the cart and checks out, returning the order's
+// public token from the redirect to the payment page
+func (c *checkoutTest) placeOrder(t *testing.T) string {
+	t.Helper()
+
+	resp := c.post(t, "/cart/add", url.Values{
+		"variant_id": {strconv.Itoa(c.variant)},
+		"quantity":   {"1"},
+	})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("adding to cart: status %d", resp.StatusCode)
+	}
+
+	resp = c.post(t, "/checkout", url.Values{
+		"first_name":      {"Wanjiku"},
+		"last_name":       {"Test"},
+		"mpesa_phone":     {"0712345678"},
+		"fulfilment_type": {models.FulfilmentPickup},
+		"fulfilment_date": {today().AddDate(0, 0, 3).Format(models.DateLayout)},
+		"time_slot":       {models.TimeSlots[len(models.TimeSlots)-1]},
+	})
+	resp.Body.Close()
+	to, err := resp.Location()
+	if err != nil || to.Path != "/payment" {
+		t.Fatalf("checkout: status %d, sent to %v (%v)", resp.StatusCode, to, err)
+	}
+	return to.Query().Get("ref")
+}
+
+// pay opens the payment page, which pushes the prompt, and waits for the
+// simulated customer to answer it
+func (c *checkoutTest) pay(t *testing.T, ref string) {
+	t.Helper()
+
+	resp, err := c.client.Get(c.server.URL + "/payment?ref=" + url.QueryEscape(ref))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("payment page: status %d", resp.StatusCode)
+	}
+	c.sim.Wait()
+}
+
+// state loads the order and its latest payment attempt
+func (c *checkoutTest) state(t *testing.T, ref string) (*models.Order, *models.PaymentAttempt) {
+	t.Helper()
+
+	order, err := c.app.Orders.GetByToken(ref)
+	if err != nil {
+		t.Fatal("loading order:", err)
+	}
+	attempt, err := c.app.Payments.LatestAttempt(order.ID)
+	if err != nil {
+		t.Fatal("loading payment attempt:", err)
+	}
+	if attempt == nil {
+		t.Fatalf("order %s has no payment attempt", order.PublicCode)
+	}
+	return order, attempt
+}
+
+// onlyPush returns the one STK Push the simulator received
+func (c *checkoutTest) onlyPush(t *testing.T) darajasim.Push {
+	t.Helper()
+
+	pushes := c.sim.Pushes()
+	if len(pushes) != 1 {
+		t.Fatalf("got %d STK Pushes, want 1", len(pushes))
+	}
+	return pushes[0]
+}
+
+func TestCheckoutPaid(t *testing.T) {
+	c := newCheckoutTest(t, darajasim.Success)
+	ref := c.placeOrder(t)
+	c.pay(t, ref)
+
+	push := c.onlyPush(t)
+	if push.Amount != 2500 || push.PhoneNumber != "254712345678" {
+		t.Errorf("pushed KES %.2f to %s, want KES 2500.00 to 254712345678", push.Amount, push.PhoneNumber)
+	}
+	if push.CallbackStatus != http.StatusOK {
+		t.Errorf("callback answered with status %d", push.CallbackStatus)
+	}
+
+	order, attempt := c.state(t, ref)
+	if order.Status != models.StatusPaid || order.AmountPaid != 2500 || order.MpesaReceipt != push.Receipt {
+		t.Errorf("order is %s with KES %.2f paid (receipt %q), want PAID with KES 2500.00 (receipt %q)",
+			order.Status, order.AmountPaid, order.MpesaReceipt, push.Receipt)
+	}
+	if attempt.Status != "SUCCESS" || attempt.MpesaReceipt != push.Receipt {
+		t.Errorf("attempt is %s (receipt %q), want SUCCESS (receipt %q)", attempt.Status, attempt.MpesaReceipt, push.Receipt)
+	}
+}
+
+func TestCheckoutPromptCancelled(t *testing.T) {
+	c := newCheckoutTest(t, darajasim.Cancelled)
+	ref := c.placeOrder(t)
+	c.pay(t, ref)
+	c.onlyPush(t)
+
+	order, attempt := c.state(t, ref)
+	if order.Status != models.StatusFailed || order.AmountPaid != 0 {
+		t.Errorf("order is %s with KES %.2f paid, want FAILED with nothing paid", order.Status, order.AmountPaid)
+	}
+	if attempt.Status != "FAILED" || attempt.ResultCode != 1032 {
+		t.Errorf("attempt is %s (code %d), want FAILED (code 1032)", attempt.Status, attempt.ResultCode)
+	}
+}
+
+func TestCheckoutPromptTimeout(t *testing.T) {
+	c := newCheckoutTest(t, darajasim.Timeout)
+	ref := c.placeOrder(t)
+	c.pay(t, ref)
+	c.onlyPush(t)
+
+	order, attempt := c.state(t, ref)
+	if order.Status != models.StatusFailed || order.AmountPaid != 0 {
+		t.Errorf("order is %s with KES %.2f paid, want FAILED with nothing paid", order.Status, order.AmountPaid)
+	}
+	if attempt.Status != "FAILED" || attempt.ResultCode != 1037 {
+		t.Errorf("attempt is %s (code %d), want FAILED (code 1037)", attempt.Status, attempt.ResultCode)
+	}
+}
+
+func TestCheckoutDuplicateCallback(t *testing.T) {
+	c := newCheckoutTest(t, darajasim.Success)
+	ref := c.placeOrder(t)
+	c.pay(t, ref)
+	push := c.onlyPush(t)
+
+	// Safaricom sends the same callback again
+	body, err := json.Marshal(map[string]interface{}{
+		"Body": map[string]interface{}{
+			"stkCallback": map[string]interface{}{
+				"MerchantRequestID": push.MerchantRequestID,
+				"CheckoutRequestID": push.CheckoutRequestID,
+				"ResultCode":        0,
+				"ResultDesc":        "The service request is processed successfully.",
+				"CallbackMetadata": map[string]interface{}{
+					"Item": []map[string]interface{}{
+						{"Name": "Amount", "Value": push.Amount},
+						{"Name": "MpesaReceiptNumber", "Value": push.Receipt},
+						{"Name": "PhoneNumber", "Value": 254712345678},
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Post(push.CallbackURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var ack struct {
+		ResultCode int
+		ResultDesc string
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&ack); err != nil {
+		t.Fatal("reading ack:", err)
+	}
+	if ack.ResultCode != 1 {
+		t.Errorf("duplicate callback acknowledged with %d %q, want it rejected", ack.ResultCode, ack.ResultDesc)
+	}
+
+	order, attempt := c.state(t, ref)
+	if order.Status != models.StatusPaid || order.AmountPaid != 2500 {
+		t.Errorf("order is %s with KES %.2f paid, want PAID with KES 2500.00 (counted once)", order.Status, order.AmountPaid)
+	}
+	if attempt.Status != "SUCCESS" {
+		t.Errorf("attempt is %s, want SUCCESS", attempt.Status)
+	}
+	if !strings.HasSuffix(push.CallbackURL, "/"+order.CallbackToken) {
+		t.Errorf("callback went to %s, not the order's own URL", push.CallbackURL)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"crave-and-glaze/internal/models"
+)
+
+// checkDelivery validates the delivery zone and address from the checkout
+// form. It returns the zone, or a checkoutMessages key when the customer
+// needs to choose again.
+func (app *Application) checkDelivery(zoneID, address string, subtotal float64) (*models.DeliveryZone, string, error) {
+	id, err := strconv.Atoi(zoneID)
+	if err != nil {
+		return nil, "zone", nil
+	}
+	zone, err := app.Zones.Get(id)
+	if err != nil {
+		// Deleted while the customer was checking out, or never existed
+		return nil, "zone", nil
+	}
+	if address == "" {
+		return nil, "addr", nil
+	}
+	if subtotal < zone.MinOrder {
+		return nil, "min", nil
+	}
+	return zone, "", nil
+}
+
+// parseAmount reads a shilling amount from a form, treating junk as 0
+func parseAmount(s string) float64 {
+	amount, err := strconv.ParseFloat(s, 64)
+	if err != nil || amount < 0 {
+		return 0
+	}
+	return amount
+}
+
+// zoneFromForm reads a delivery zone from the admin forms
+func zoneFromForm(r *http.Request) models.DeliveryZone {
+	id, _ := strconv.Atoi(r.FormValue("id"))
+	return models.DeliveryZone{
+		ID:       id,
+		Name:     strings.TrimSpace(r.FormValue("name")),
+		Fee:      parseAmount(r.FormValue("fee")),
+		MinOrder: parseAmount(r.FormValue("min_order")),
+		FreeOver: parseAmount(r.FormValue("free_over")),
+	}
+}
+
+// adminZonesHandler lists the delivery zones and their fees
+func (app *Application) adminZonesHandler(w http.ResponseWriter, r *http.Request) {
+	zones, err := app.Zones.All()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Server Error", 500)
+		return
+	}
+
+	data := &models.TemplateData{
+		Title:   "Delivery Zones",
+		Zones:   zones,
+		IsAdmin: true,
+	}
+
+	app.render(w, r, "admin/delivery_zones.page.html", data)
+}
+
+func (app *Application) adminAddZoneHandler(w http.ResponseWriter, r *http.Request) {
+	zone := zoneFromForm(r)
+	if zone.Name != "" {
+		if err := app.Zones.Insert(zone); err != nil {
+			log.Println("Error adding delivery zone:", err)
+		}
+	}
+	http.Redirect(w, r, "/admin/delivery-zones", http.StatusSeeOther)
+}
+
+func (app *Application) adminUpdateZoneHandler(w http.ResponseWriter, r *http.Request) {
+	zone := zoneFromForm(r)
+	if zone.Name != "" {
+		if err := app.Zones.Update(zone); err != nil {
+			log.Println("Error updating delivery zone:", err)
+		}
+	}
+	http.Redirect(w, r, "/admin/delivery-zones", http.StatusSeeOther)
+}
+
+func (app *Application) adminDeleteZoneHandler(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(r.FormValue("id"))
+	if err := app.Zones.Delete(id); err != nil {
+		log.Println("Error deleting delivery zone:", err)
+	}
+	http.Redirect(w, r, "/admin/delivery-zones", http.StatusSeeOther)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"math"
+	"strconv"
+
+	"crave-and-glaze/internal/cart"
+)
+
+// depositFor works out the upfront payment for a cart. Lines whose product (or
+// category) takes a deposit count at that percentage, everything else is paid
+// in full. It returns 0 when the whole total is due upfront.
+func (app *Application) depositFor(items []cart.Item) (float64, error) {
+	percents, err := app.Products.DepositPercents(variantIDs(items))
+	if err != nil {
+		return 0, err
+	}
+
+	var deposit float64
+	hasDeposit := false
+	for _, item := range items {
+		line := item.Price * float64(item.Quantity)
+		pct := percents[item.VariantID]
+		if pct <= 0 || pct >= 100 {
+			deposit += line
+			continue
+		}
+		hasDeposit = true
+		deposit += line * float64(pct) / 100
+	}
+	if !hasDeposit {
+		return 0, nil
+	}
+
+	// M-Pesa takes whole shillings; round the deposit up rather than under-collect
+	return math.Ceil(deposit), nil
+}
+
+// parsePercent reads a 0-100 percentage from a form, treating junk as 0
+func parsePercent(s string) int {
+	pct, err := strconv.Atoi(s)
+	if err != nil || pct < 0 {
+		return 0
+	}
+	if pct > 100 {
+		return 100
+	}
+	return pct
+}
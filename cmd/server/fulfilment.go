@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"crave-and-glaze/internal/cart"
+	"crave-and-glaze/internal/models"
+)
+
+// bakeryTime is Nairobi time (EAT has no daylight saving), so "today" and slot
+// times mean the same thing whatever zone the server runs in
+var bakeryTime = time.FixedZone("EAT", 3*60*60)
+
+// bookingDays is how far ahead customers can pick a date at checkout
+const bookingDays = 30
+
+// Messages shown on the checkout page, keyed by ?msg=
+var checkoutMessages = map[string]string{
+	"type":   "Please choose pickup or delivery.",
+	"date":   "Please choose a date from the list.",
+	"slot":   "Please choose a time slot.",
+	"closed": "Sorry, we're closed on that date. Please choose another.",
+	"notice": "Your order needs more notice than that. Please choose a later date or time slot.",
+	"full":   "Sorry, we're fully booked on that date. Please choose another.",
+	"zone":   "Please choose the area we should deliver to.",
+	"addr":   "Please enter the delivery address.",
+	"min":    "Your order is below the minimum for delivery to that area. Add another cake or choose pickup.",
+	"prices": "Some cakes in your cart have changed price or are no longer available. Please check your order below.",
+	"usedup": "Sorry, that discount code has just been used up. Your order has not been placed yet.",
+	"limit":  "You've already used that discount code as many times as it allows. Your order has not been placed yet.",
+}
+
+// variantIDs lists the variant of each cart line
+func variantIDs(items []cart.Item) []int {
+	ids := make([]int, 0, len(items))
+	for _, item := range items {
+		ids = append(ids, item.VariantID)
+	}
+	return ids
+}
+
+// today is midnight at the start of the current day in Nairobi
+func today() time.Time {
+	now := time.Now().In(bakeryTime)
+	return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, bakeryTime)
+}
+
+// slotStart is when a time slot opens on a day, or false if it isn't one of ours
+func slotStart(day time.Time, slot string) (time.Time, bool) {
+	for _, s := range models.TimeSlots {
+		if s != slot {
+			continue
+		}
+		start, err := time.Parse("15:04", strings.SplitN(s, "-", 2)[0])
+		if err != nil {
+			return time.Time{}, false
+		}
+		return day.Add(time.Duration(start.Hour())*time.Hour + time.Duration(start.Minute())*time.Minute), true
+	}
+	return time.Time{}, false
+}
+
+// fulfilmentDays lists the dates offered at checkout, marking the ones the
+// bakery is closed, the ones that don't give the cart enough notice and the
+// ones with no room left for the cart
+func (app *Application) fulfilmentDays(leadTime time.Duration, load models.DayLoad) ([]models.FulfilmentDay, error) {
+	first := today()
+	last := first.AddDate(0, 0, bookingDays-1)
+	closed, err := app.Calendar.ClosedBetween(first, last)
+	if err != nil {
+		return nil, err
+	}
+	capacity, err := app.capacityBetween(first, last)
+	if err != nil {
+		return nil, err
+	}
+
+	earliest := time.Now().Add(leadTime)
+	lastSlot := models.TimeSlots[len(models.TimeSlots)-1]
+
+	days := make([]models.FulfilmentDay, 0, bookingDays)
+	for i := 0; i < bookingDays; i++ {
+		day := first.AddDate(0, 0, i)
+		d := models.FulfilmentDay{
+			Date:  day.Format(models.DateLayout),
+			Label: day.Format("Mon 2 Jan"),
+		}
+		if reason, ok := closed[d.Date]; ok {
+			d.Unavailable = "closed"
+			if reason != "" {
+				d.Unavailable += ": " + reason
+			}
+		} else if start, _ := slotStart(day, lastSlot); start.Before(earliest) {
+			d.Unavailable = "not enough notice"
+		} else if c := capacity[d.Date]; !c.Fits(c.Booked.Add(load)) {
+			d.Unavailable = "fully booked"
+		}
+		days = append(days, d)
+	}
+	return days, nil
+}
+
+// checkFulfilment validates the pickup/delivery choice from the checkout form.
+// It returns a checkoutMessages key when the customer needs to choose again.
+func (app *Application) checkFulfilment(kind, date, slot string, leadTime time.Duration, load models.DayLoad) (string, error) {
+	if kind != models.FulfilmentPickup && kind != models.FulfilmentDelivery {
+		return "type", nil
+	}
+
+	day, err := time.ParseInLocation(models.DateLayout, date, bakeryTime)
+	if err != nil || day.Before(today()) || !day.Before(today().AddDate(0, 0, bookingDays)) {
+		return "date", nil
+	}
+
+	start, ok := slotStart(day, slot)
+	if !ok {
+		return "slot", nil
+	}
+
+	closed, err := app.Calendar.ClosedBetween(day, day)
+	if err != nil {
+		return "", err
+	}
+	if _, ok := closed[date]; ok {
+		return "closed", nil
+	}
+
+	if start.Before(time.Now().Add(leadTime)) {
+		return "notice", nil
+	}
+
+	// Tells the customer early; Orders.Create checks again with the day locked
+	capacity, err := app.capacityBetween(day, day)
+	if err != nil {
+		return "", err
+	}
+	if c := capacity[date]; !c.Fits(c.Booked.Add(load)) {
+		return "full", nil
+	}
+	return "", nil
+}
+
+// parseHours reads a lead time in hours from a form, treating junk as none
+func parseHours(s string) int {
+	hours, err := strconv.Atoi(s)
+	if err != nil || hours < 0 {
+		return 0
+	}
+	return hours
+}
+
+// adminClosedDatesHandler lists the days the bakery is closed
+func (app *Application) adminClosedDatesHandler(w http.ResponseWriter, r *http.Request) {
+	dates, err := app.Calendar.UpcomingClosed()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Server Error", 500)
+		return
+	}
+
+	data := &models.TemplateData{
+		Title:       "Closed Dates",
+		ClosedDates: dates,
+		Flash:       r.URL.Query().Get("msg"),
+		IsAdmin:     true,
+	}
+
+	app.render(w, r, "admin/closed_dates.page.html", data)
+}
+
+// adminCloseDateHandler stops customers picking a date at checkout
+func (app *Application) adminCloseDateHandler(w http.ResponseWriter, r *http.Request) {
+	date := r.FormValue("date")
+	reason := strings.TrimSpace(r.FormValue("reason"))
+
+	back := func(msg string) {
+		http.Redirect(w, r, "/admin/closed-dates?msg="+url.QueryEscape(msg), http.StatusSeeOther)
+	}
+
+	if _, err := time.Parse(models.DateLayout, date); err != nil {
+		back("Please pick a date.")
+		return
+	}
+
+	if err := app.Calendar.Close(date, reason); err != nil {
+		log.Println("Error closing date:", err)
+		http.Error(w, "Server Error", 500)
+		return
+	}
+
+	// Orders already booked for that day are not moved automatically
+	booked, err := app.Orders.Schedule(mustDate(date), 1)
+	if err != nil {
+		log.Println(err)
+	}
+	msg := fmt.Sprintf("%s is now closed.", date)
+	if len(booked) > 0 {
+		msg += fmt.Sprintf(" %d order(s) are already booked for that day.", len(booked))
+	}
+	back(msg)
+}
+
+// adminReopenDateHandler makes a closed date bookable again
+func (app *Application) adminReopenDateHandler(w http.ResponseWriter, r *http.Request) {
+	if err := app.Calendar.Reopen(r.FormValue("date")); err != nil {
+		log.Println("Error reopening date:", err)
+	}
+	http.Redirect(w, r, "/admin/closed-dates", http.StatusSeeOther)
+}
+
+// mustDate parses a date that has already been validated
+func mustDate(date string) time.Time {
+	day, _ := time.ParseInLocation(models.DateLayout, date, bakeryTime)
+	return day
+}
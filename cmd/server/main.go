@@ -1,11 +1,15 @@
 package main
 
 import (
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"path/filepath"
 	"time"
 
@@ -28,9 +32,31 @@ import (
 type Application struct {
 	Products *repository.ProductModel
 	Orders   *repository.OrderModel
+	Payments *repository.PaymentModel
+	Refunds  *repository.RefundModel
+	C2B      *repository.C2BModel
+	Calendar *repository.CalendarModel
+	Zones    *repository.ZoneModel
+	Recovery *repository.RecoveryModel
+	Promos   *repository.PromotionModel
 	Mpesa    *daraja.Service
 	Users    *repository.UserModel
 	Mailer   *mailer.Mailer
+
+	// M-Pesa callback source checks
+	CallbackIPs []*net.IPNet // Empty means any source is allowed
+	ProxyHops   int          // Proxies appending to X-Forwarded-For (0 = ignore the header)
+
+	// How long an unpaid order keeps its place in the day's baking capacity
+	CapacityHold time.Duration
+
+	// Lookups on the public order tracking page
+	TrackLimiter *rateLimiter
+	// Cart reminder sign-ups at checkout
+	EmailLimiter *rateLimiter
+
+	// When to email customers who left a cart or didn't pay (empty means never)
+	ReminderDelays []time.Duration
 }
 
 func main() {
@@ -41,11 +67,35 @@ func main() {
 	// 1. Init DB
 	database.InitDB()
 
-	mpesaService := daraja.NewService(
-		os.Getenv("MPESA_KEY"),
-		os.Getenv("MPESA_SECRET"),
-	)
-	mpesaService.Config.CallbackURL = "https://crave-and-glaze-final.onrender.com/api/callback/mpesa"
+	// M-Pesa settings come from MPESA_* env vars; refuse to start if they are wrong
+	mpesaConfig, err := daraja.ConfigFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid M-Pesa configuration:\n%v", err)
+	}
+	log.Printf("M-Pesa: %s environment, shortcode %s (%s)", mpesaConfig.Environment, mpesaConfig.BusinessCode, mpesaConfig.TransactionType)
+	mpesaService := daraja.NewService(mpesaConfig)
+
+	callbackIPs, err := callbackAllowlistFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	proxyHops, err := proxyHopsFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	reminderDelays, err := reminderDelaysFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Carts live in Postgres; the cookie only holds the cart's signed ID, and
+	// without a fixed secret those IDs don't survive a restart
+	cart.SetStore(&cart.PostgresStore{DB: database.DB})
+	if secret := os.Getenv("CART_SECRET"); secret != "" {
+		cart.SetKey([]byte(secret))
+	} else {
+		log.Println("CART_SECRET is not set: using a random key, carts will empty on restart")
+	}
 
 	mailService := mailer.New(
 		os.Getenv("SMTP_HOST"),
@@ -58,15 +108,71 @@ func main() {
 	app := &Application{
 		Products: &repository.ProductModel{DB: database.DB},
 		Orders:   &repository.OrderModel{DB: database.DB},
+		Payments: &repository.PaymentModel{DB: database.DB},
+		Refunds:  &repository.RefundModel{DB: database.DB},
+		C2B:      &repository.C2BModel{DB: database.DB},
+		Calendar: &repository.CalendarModel{DB: database.DB},
+		Zones:    &repository.ZoneModel{DB: database.DB},
+		Recovery: &repository.RecoveryModel{DB: database.DB},
+		Promos:   &repository.PromotionModel{DB: database.DB},
 		Mpesa:    mpesaService,
 		Users:    &repository.UserModel{DB: database.DB},
 		Mailer:   mailService,
+
+		CallbackIPs: callbackIPs,
+		ProxyHops:   proxyHops,
+
+		CapacityHold: envDuration("CAPACITY_HOLD", 30*time.Minute),
+
+		TrackLimiter: newRateLimiter(10, 15*time.Minute),
+		EmailLimiter: newRateLimiter(5, 15*time.Minute),
+
+		ReminderDelays: reminderDelays,
+	}
+
+	// 3. Configure Server
+	srv := &http.Server{
+		Addr:         ":8080",
+		Handler:      app.routes(),
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+
+	// 4. Settle payments whose callback never arrived
+	go app.runReconciler(
+		envDuration("MPESA_RECONCILE_INTERVAL", time.Minute),
+		envDuration("MPESA_RECONCILE_AFTER", 2*time.Minute),
+	)
+
+	// 5. Remind customers about carts they left and orders they didn't pay for,
+	// and clear out expired carts
+	go app.runRecovery(envDuration("RECOVERY_INTERVAL", 5*time.Minute))
+
+	// 6. Tell Safaricom where to send Paybill/Till payments (only needed once per shortcode).
+	// Anyone could post a payment to those URLs, so only Safaricom's addresses may.
+	if os.Getenv("MPESA_C2B_REGISTER") == "true" && len(callbackIPs) == 0 {
+		log.Println("C2B URLs not registered: set MPESA_CALLBACK_ALLOWED_IPS to Safaricom's addresses first")
+	} else if os.Getenv("MPESA_C2B_REGISTER") == "true" {
+		go func() {
+			if err := mpesaService.RegisterC2BURLs(); err != nil {
+				log.Println("C2B URL registration failed:", err)
+				return
+			}
+			log.Printf("C2B URLs registered under %s", mpesaConfig.C2BURL)
+		}()
 	}
 
-	// 3. Setup Router
+	fmt.Println("Crave & Glaze Server starting on http://localhost:8080")
+	log.Fatal(srv.ListenAndServe())
+}
+
+// routes builds the router. It is separate from main so the app can be mounted
+// without main's startup work (env, migrations, background workers). For end to
+// end payment runs, point MPESA_BASE_URL at cmd/darajasim.
+func (app *Application) routes() http.Handler {
 	mux := http.NewServeMux()
 
-	// 3. Serve Static Files (Updated)
+	// Serve Static Files (Updated)
 	// Get the current working directory to ensure we are looking in the right place
 	workDir, _ := os.Getwd()
 	filesDir := http.Dir(filepath.Join(workDir, "web", "static"))
@@ -94,17 +200,36 @@ func main() {
 	mux.HandleFunc("GET /cart", app.viewCartHandler)
 	mux.HandleFunc("POST /cart/remove", app.removeFromCartHandler)
 	mux.HandleFunc("POST /cart/update", app.updateCartHandler)
+	mux.HandleFunc("GET /cart/restore", app.restoreCartHandler)
+	mux.HandleFunc("GET /reminders/stop", app.stopRemindersHandler)
 
 	// Checkout & Payment
 	mux.HandleFunc("GET /checkout", app.checkoutPageHandler)
 	mux.HandleFunc("POST /checkout", app.placeOrderHandler)
+	mux.HandleFunc("POST /checkout/email", app.checkoutEmailHandler)
 	mux.HandleFunc("GET /payment", app.paymentHandler)
+	mux.HandleFunc("POST /payment/resend", app.paymentResendHandler)
+	mux.HandleFunc("POST /payment/retry", app.paymentRetryHandler)
+	mux.HandleFunc("POST /payment/manual", app.paymentManualHandler)
 	mux.HandleFunc("GET /order-confirmed", app.orderConfirmedHandler)
 	mux.HandleFunc("GET /payment-failed", app.paymentFailedHandler)
+	mux.HandleFunc("GET /track", app.trackOrderPageHandler)
+	mux.HandleFunc("POST /track", app.trackOrderHandler)
+	mux.HandleFunc("GET /order/cancel", app.cancelOrderPageHandler)
+	mux.HandleFunc("POST /order/cancel", app.cancelOrderHandler)
 
 	// API Routes (MPESA & AJAX)
-	mux.HandleFunc("GET /api/order/status", app.apiCheckStatusHandler)   // JS polling
-	mux.HandleFunc("POST /api/callback/mpesa", app.mpesaCallbackHandler) // Safaricom callback
+	mux.HandleFunc("GET /api/order/status", app.apiCheckStatusHandler) // JS polling
+	// Safaricom callbacks (each order, and each refund, has its own token in the URL)
+	mux.HandleFunc("POST /api/callback/mpesa/{token}", app.mpesaCallback("STK", app.mpesaCallbackHandler))
+	mux.HandleFunc("POST /api/callback/mpesa/refund/result/{token}", app.mpesaCallback("REFUND_RESULT", app.mpesaRefundResultHandler))
+	mux.HandleFunc("POST /api/callback/mpesa/refund/timeout/{token}", app.mpesaCallback("REFUND_TIMEOUT", app.mpesaRefundTimeoutHandler))
+	// Paybill/Till payments (Safaricom won't register C2B URLs containing "mpesa"),
+	// and the Transaction Status results that confirm them
+	mux.HandleFunc("POST /api/c2b/{token}/validation", app.mpesaCallback("C2B_VALIDATION", app.c2bValidationHandler))
+	mux.HandleFunc("POST /api/c2b/{token}/confirmation", app.mpesaCallback("C2B_CONFIRMATION", app.c2bConfirmationHandler))
+	mux.HandleFunc("POST /api/callback/mpesa/status/result/{token}", app.mpesaCallback("C2B_STATUS_RESULT", app.c2bStatusResultHandler))
+	mux.HandleFunc("POST /api/callback/mpesa/status/timeout/{token}", app.mpesaCallback("C2B_STATUS_TIMEOUT", app.c2bStatusTimeoutHandler))
 
 	// Authentication
 	mux.HandleFunc("GET /admin/login", app.loginPageHandler)
@@ -119,11 +244,40 @@ func main() {
 	mux.HandleFunc("GET /admin/dashboard", app.requireAdmin(app.adminDashboardHandler))
 	mux.HandleFunc("POST /admin/order/status", app.requireAdmin(app.adminUpdateStatusHandler))
 	mux.HandleFunc("GET /admin/orders/view", app.requireAdmin(app.adminOrderViewHandler))
+	mux.HandleFunc("GET /admin/orders/export", app.requireAdmin(app.adminExportOrdersHandler))
+	mux.HandleFunc("POST /admin/orders/refund", app.requireAdmin(app.adminRefundHandler))
+	mux.HandleFunc("POST /admin/orders/refund/send", app.requireAdmin(app.adminSendRefundHandler))
+	mux.HandleFunc("POST /admin/orders/confirm-payment", app.requireAdmin(app.adminConfirmPaymentHandler))
+	mux.HandleFunc("POST /admin/payments/receipt", app.requireAdmin(app.adminPaymentReceiptHandler))
+	mux.HandleFunc("GET /admin/payments/unallocated", app.requireAdmin(app.adminUnallocatedPaymentsHandler))
+	mux.HandleFunc("POST /admin/payments/assign", app.requireAdmin(app.adminAssignPaymentHandler))
+	mux.HandleFunc("GET /admin/recovery", app.requireAdmin(app.adminRecoveryHandler))
+
+	// Promotions (discount codes)
+	mux.HandleFunc("GET /admin/promotions", app.requireAdmin(app.adminPromotionsHandler))
+	mux.HandleFunc("GET /admin/promotions/edit", app.requireAdmin(app.adminPromotionFormHandler))
+	mux.HandleFunc("POST /admin/promotions/save", app.requireAdmin(app.adminSavePromotionHandler))
+	mux.HandleFunc("POST /admin/promotions/active", app.requireAdmin(app.adminTogglePromotionHandler))
+	mux.HandleFunc("POST /admin/promotions/delete", app.requireAdmin(app.adminDeletePromotionHandler))
 
 	// Category Management
 	mux.HandleFunc("GET /admin/categories", app.requireAdmin(app.adminCategoriesHandler))
 	mux.HandleFunc("POST /admin/categories/add", app.requireAdmin(app.adminAddCategoryHandler))
 	mux.HandleFunc("POST /admin/categories/delete", app.requireAdmin(app.adminDeleteCategoryHandler))
+	mux.HandleFunc("POST /admin/categories/deposit", app.requireAdmin(app.adminCategoryDepositHandler))
+
+	// Closed Dates (no pickups or deliveries)
+	mux.HandleFunc("GET /admin/closed-dates", app.requireAdmin(app.adminClosedDatesHandler))
+	mux.HandleFunc("POST /admin/closed-dates/add", app.requireAdmin(app.adminCloseDateHandler))
+	mux.HandleFunc("POST /admin/closed-dates/delete", app.requireAdmin(app.adminReopenDateHandler))
+	mux.HandleFunc("GET /admin/delivery-zones", app.requireAdmin(app.adminZonesHandler))
+	mux.HandleFunc("POST /admin/delivery-zones/add", app.requireAdmin(app.adminAddZoneHandler))
+	mux.HandleFunc("POST /admin/delivery-zones/update", app.requireAdmin(app.adminUpdateZoneHandler))
+	mux.HandleFunc("POST /admin/delivery-zones/delete", app.requireAdmin(app.adminDeleteZoneHandler))
+	mux.HandleFunc("GET /admin/capacity", app.requireAdmin(app.adminCapacityHandler))
+	mux.HandleFunc("POST /admin/capacity/weekdays", app.requireAdmin(app.adminWeekdayCapacityHandler))
+	mux.HandleFunc("POST /admin/capacity/override", app.requireAdmin(app.adminCapacityOverrideHandler))
+	mux.HandleFunc("POST /admin/capacity/override/delete", app.requireAdmin(app.adminDeleteCapacityOverrideHandler))
 
 	// Product Management
 	mux.HandleFunc("GET /admin/products", app.requireAdmin(app.adminProductsListHandler))
@@ -134,16 +288,8 @@ func main() {
 	mux.HandleFunc("POST /admin/products/delete", app.requireAdmin(app.adminDeleteProductHandler))
 	//search route
 	mux.HandleFunc("GET /search", app.searchHandler)
-	// 4. Start Server
-	srv := &http.Server{
-		Addr:         ":8080",
-		Handler:      mux,
-		ReadTimeout:  10 * time.Second,
-		WriteTimeout: 10 * time.Second,
-	}
 
-	fmt.Println("Crave & Glaze Server starting on http://localhost:8080")
-	log.Fatal(srv.ListenAndServe())
+	return mux
 }
 
 func (app *Application) homeHandler(w http.ResponseWriter, r *http.Request) {
@@ -197,7 +343,6 @@ func (app *Application) addToCartHandler(w http.ResponseWriter, r *http.Request)
 	}
 
 	// Get IDs and convert to int
-	productID, _ := strconv.Atoi(r.FormValue("product_id"))
 	variantID, _ := strconv.Atoi(r.FormValue("variant_id"))
 	quantity, _ := strconv.Atoi(r.FormValue("quantity"))
 
@@ -211,37 +356,26 @@ func (app *Application) addToCartHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	// Fetch the specific variant to get the correct Price
-	// (We need a helper for this in models, but for now let's reuse GetVariants
-	// and loop, or write a quick GetVariantByID. For simplicity, let's trust the form
-	// or fetch properly. Let's do it properly.)
-
-	// TODO: Ideally, fetch the specific price from DB here to prevent tampering.
-	// For this step, we will assume the price calculation happens at checkout
-	// or fetch it now. Let's fetch the Product Name for display.
-	product, _ := app.Products.Get(productID)
-
-	// Quick hack: We need the price of the selected variant.
-	// In a real app, create a method: app.Products.GetVariant(variantID)
-	// Here, we fetch all and find the match.
-	variants, _ := app.Products.GetVariants(productID)
-	var selectedPrice float64
-	var sizeLabel string
-
-	for _, v := range variants {
-		if v.ID == variantID {
-			selectedPrice = v.Price
-			sizeLabel = v.WeightLabel
-			break
-		}
+	// Fetch the variant's price from the DB; the form only says which one.
+	// Checkout prices the cart again in case it changes in the meantime.
+	variants, err := app.Products.Sellable([]int{variantID})
+	if err != nil {
+		log.Println("Error loading variant:", err)
+		http.Error(w, "Server Error", 500)
+		return
+	}
+	v, ok := variants[variantID]
+	if !ok {
+		http.Error(w, "Sorry, that cake is no longer available", 404)
+		return
 	}
 
 	// Create Item
 	item := cart.Item{
 		VariantID:   variantID,
-		ProductName: product.Name + " (" + sizeLabel + ")",
-		ImageURL:    product.ImageURL,
-		Price:       selectedPrice,
+		ProductName: v.ProductName + " (" + v.WeightLabel + ")",
+		ImageURL:    v.ImageURL,
+		Price:       v.Price,
 		Quantity:    quantity,
 		Message:     msg,
 		Icing:       icing,
@@ -255,16 +389,25 @@ func (app *Application) addToCartHandler(w http.ResponseWriter, r *http.Request)
 }
 
 func (app *Application) viewCartHandler(w http.ResponseWriter, r *http.Request) {
-	// 1. Get Cart Data
-	items := cart.Get(r)
+	// 1. Get Cart Data, at today's prices
+	items, notices, err := app.repriceCart(cart.Get(r))
+	if err != nil {
+		log.Println("Error pricing cart:", err)
+		http.Error(w, "Server Error", 500)
+		return
+	}
+	if len(notices) > 0 {
+		cart.Save(w, r, items)
+	}
 	total := cart.Total(items)
 
 	// 2. Create the Template Data
 	// We assign directly to Items and Total, just like in the Checkout handler
 	data := &models.TemplateData{
-		Title: "Your Cart",
-		Items: items,
-		Total: total,
+		Title:   "Your Cart",
+		Items:   items,
+		Total:   total,
+		Notices: notices,
 	}
 
 	// 3. Render using the helper
@@ -272,24 +415,77 @@ func (app *Application) viewCartHandler(w http.ResponseWriter, r *http.Request)
 }
 
 func (app *Application) checkoutPageHandler(w http.ResponseWriter, r *http.Request) {
-	// 1. Get Cart Items
-	items := cart.Get(r)
+	// 1. Get Cart Items, at today's prices
+	items, notices, err := app.repriceCart(cart.Get(r))
+	if err != nil {
+		log.Println("Error pricing cart:", err)
+		http.Error(w, "Server Error", 500)
+		return
+	}
+	if len(notices) > 0 {
+		cart.Save(w, r, items)
+	}
 	if len(items) == 0 {
 		http.Redirect(w, r, "/cakes", http.StatusSeeOther)
 		return
 	}
 
-	// 2. Calculate Total
+	// 2. Calculate Total (and the deposit, for wedding cakes and the like),
+	// less any discount code the customer applied
 	total := cart.Total(items)
+	deposit, err := app.depositFor(items)
+	if err != nil {
+		log.Println("Error working out deposit:", err)
+	}
+	var promo *models.Promotion
+	var discount float64
+	var promoError string
+	if code := strings.TrimSpace(r.URL.Query().Get("code")); code != "" {
+		promo, discount, promoError, err = app.applyPromotion(code, items)
+		if err != nil {
+			log.Println("Error applying discount code:", err)
+			promoError = "We couldn't check that code just now. Please try again."
+		}
+		deposit = discountDeposit(deposit, total, discount)
+		total -= discount
+	}
 
-	// 3. Prepare Data using the master TemplateData struct
-	data := &models.TemplateData{
-		Title: "Checkout",
-		Items: items, // <--- Pass items here
-		Total: total, // <--- Pass total here
+	// 3. Dates the cart can be collected or delivered on
+	leadTime, err := app.Products.LeadTime(variantIDs(items))
+	if err != nil {
+		log.Println("Error working out lead time:", err)
+	}
+	load, err := app.cartLoad(items)
+	if err != nil {
+		log.Println("Error working out cart weight:", err)
+	}
+	days, err := app.fulfilmentDays(leadTime, load)
+	if err != nil {
+		log.Println("Error loading closed dates:", err)
+	}
+	zones, err := app.Zones.All()
+	if err != nil {
+		log.Println("Error loading delivery zones:", err)
 	}
 
-	// 4. Render using the helper (Fixes Navbar & Layout)
+	// 4. Prepare Data using the master TemplateData struct
+	data := &models.TemplateData{
+		Title:     "Checkout",
+		Items:     items, // <--- Pass items here
+		Total:     total, // <--- Pass total here
+		Deposit:   deposit,
+		Days:      days,
+		TimeSlots: models.TimeSlots,
+		Zones:     zones,
+		Notices:   notices,
+		Flash:     checkoutMessages[r.URL.Query().Get("msg")],
+
+		Promotion:  promo,
+		Discount:   discount,
+		PromoError: promoError,
+	}
+
+	// 5. Render using the helper (Fixes Navbar & Layout)
 	app.render(w, r, "checkout.page.html", data)
 }
 
@@ -312,13 +508,108 @@ func (app *Application) placeOrderHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	// 2. Get Cart
-	cartItems := cart.Get(r)
+	// Back to checkout with a message, keeping the discount code applied
+	promoCode := strings.TrimSpace(r.FormValue("promo_code"))
+	back := func(msg string) {
+		to := "/checkout?msg=" + msg
+		if promoCode != "" {
+			to += "&code=" + url.QueryEscape(promoCode)
+		}
+		http.Redirect(w, r, to, http.StatusSeeOther)
+	}
+
+	// 2. Get Cart, priced from the catalogue rather than the cookie. If
+	// anything changed, the customer sees it on the checkout page before paying.
+	cartItems, notices, err := app.repriceCart(cart.Get(r))
+	if err != nil {
+		log.Println("Error pricing cart:", err)
+		http.Error(w, "Failed to place order", 500)
+		return
+	}
+	if len(notices) > 0 {
+		cart.Save(w, r, cartItems)
+		back("prices")
+		return
+	}
 	if len(cartItems) == 0 {
 		http.Redirect(w, r, "/cakes", http.StatusSeeOther)
 		return
 	}
 	total := cart.Total(cartItems)
+	deposit, err := app.depositFor(cartItems)
+	if err != nil {
+		log.Println("Error working out deposit:", err)
+		http.Error(w, "Failed to place order", 500)
+		return
+	}
+
+	// The discount code is checked again, as the cart or the code may have
+	// changed since the checkout page was shown
+	var promo *models.Promotion
+	var discount float64
+	if promoCode != "" {
+		var problem string
+		promo, discount, problem, err = app.applyPromotion(promoCode, cartItems)
+		if err != nil {
+			log.Println("Error applying discount code:", err)
+			http.Error(w, "Failed to place order", 500)
+			return
+		}
+		if problem != "" {
+			// The checkout page explains what is wrong with the code
+			http.Redirect(w, r, "/checkout?code="+url.QueryEscape(promoCode), http.StatusSeeOther)
+			return
+		}
+		deposit = discountDeposit(deposit, total, discount)
+		total -= discount
+	}
+
+	// Pickup or delivery, on a day we're open, with enough notice for every
+	// cake and room in the kitchen for them
+	fulfilmentType := r.FormValue("fulfilment_type")
+	fulfilmentDate := r.FormValue("fulfilment_date")
+	timeSlot := r.FormValue("time_slot")
+	leadTime, err := app.Products.LeadTime(variantIDs(cartItems))
+	var load models.DayLoad
+	if err == nil {
+		load, err = app.cartLoad(cartItems)
+	}
+	if err == nil {
+		var problem string
+		problem, err = app.checkFulfilment(fulfilmentType, fulfilmentDate, timeSlot, leadTime, load)
+		if problem != "" {
+			back(problem)
+			return
+		}
+	}
+	if err != nil {
+		log.Println("Error checking fulfilment date:", err)
+		http.Error(w, "Failed to place order", 500)
+		return
+	}
+
+	// Deliveries pay their zone's fee on top of the cakes, upfront with any deposit
+	var zone models.DeliveryZone
+	address := strings.TrimSpace(r.FormValue("delivery_address"))
+	if fulfilmentType == models.FulfilmentDelivery {
+		z, problem, err := app.checkDelivery(r.FormValue("zone_id"), address, total)
+		if problem != "" {
+			back(problem)
+			return
+		}
+		if err != nil {
+			log.Println("Error checking delivery zone:", err)
+			http.Error(w, "Failed to place order", 500)
+			return
+		}
+		zone = *z
+	} else {
+		address = ""
+	}
+	fee := zone.FeeFor(total)
+	if deposit > 0 {
+		deposit += fee
+	}
 
 	// 3. Prepare Order Model
 	order := &models.Order{
@@ -327,7 +618,25 @@ func (app *Application) placeOrderHandler(w http.ResponseWriter, r *http.Request
 		Email:          email,
 		WhatsappNumber: whatsapp,
 		CustomerPhone:  mpesaPhone,
-		TotalAmount:    total,
+		TotalAmount:    total + fee,
+		DepositAmount:  deposit,
+		DeliveryFee:    fee,
+		FulfilmentType: fulfilmentType,
+		FulfilmentDate: fulfilmentDate,
+		TimeSlot:       timeSlot,
+		DeliveryZone:   zone.Name,
+		Address:        address,
+	}
+	var claim *repository.PromotionClaim
+	if promo != nil {
+		order.DiscountCode = promo.Code
+		order.DiscountAmount = discount
+		claim = &repository.PromotionClaim{
+			PromotionID: promo.ID,
+			Phone:       daraja.FormatPhone(mpesaPhone),
+			Email:       strings.ToLower(strings.TrimSpace(email)),
+			HoldSince:   time.Now().Add(-app.CapacityHold),
+		}
 	}
 
 	// 4. Convert Items
@@ -342,8 +651,21 @@ func (app *Application) placeOrderHandler(w http.ResponseWriter, r *http.Request
 		})
 	}
 
-	// 5. Save to Database (FIXED: Uncommented this line!)
-	orderID, err := app.Orders.Create(order, orderItems)
+	// 5. Save to Database, checking the date again now that it is locked
+	booking := &repository.Booking{Load: load, HoldSince: time.Now().Add(-app.CapacityHold)}
+	orderID, err := app.Orders.Create(order, orderItems, claim, booking)
+	if errors.Is(err, repository.ErrFullyBooked) {
+		back("full")
+		return
+	}
+	if errors.Is(err, repository.ErrPromotionUsedUp) || errors.Is(err, repository.ErrPromotionLimit) {
+		msg := "usedup"
+		if errors.Is(err, repository.ErrPromotionLimit) {
+			msg = "limit"
+		}
+		http.Redirect(w, r, "/checkout?msg="+msg, http.StatusSeeOther)
+		return
+	}
 	if err != nil {
 		log.Println("Failed to create order:", err)
 		http.Error(w, "Failed to place order", 500)
@@ -353,52 +675,50 @@ func (app *Application) placeOrderHandler(w http.ResponseWriter, r *http.Request
 	// NOTE: Email logic REMOVED from here.
 	// It is now in mpesaCallbackHandler so it only sends AFTER payment.
 
-	// 6. Clear the Cart
-	http.SetCookie(w, &http.Cookie{
-		Name:   "crave_cart",
-		Value:  "",
-		Path:   "/",
-		MaxAge: -1,
-	})
+	// 6. Clear the Cart. Any reminders about it are now about paying for the order.
+	if err := app.Recovery.TrackOrder(cart.ID(r), orderID, email); err != nil {
+		log.Println("Error tracking order for reminders:", err)
+	}
+	cart.Clear(w, r)
 
-	// 7. Redirect to Payment
-	redirectURL := fmt.Sprintf("/payment?order_id=%d", orderID)
-	http.Redirect(w, r, redirectURL, http.StatusSeeOther)
+	// 7. Redirect to Payment (Create filled in the order's public token)
+	log.Printf("Order #%d placed as %s", orderID, order.PublicCode)
+	http.Redirect(w, r, "/payment?ref="+order.PublicToken, http.StatusSeeOther)
 }
 
 func (app *Application) paymentHandler(w http.ResponseWriter, r *http.Request) {
-	// 1. Get Order ID from URL
-	orderIDStr := r.URL.Query().Get("order_id")
-	var orderID int
-	fmt.Sscanf(orderIDStr, "%d", &orderID)
-
-	// 2. Fetch the Full Order Details from DB
-	order, err := app.Orders.Get(orderID)
+	// 1. Fetch the Full Order Details from DB, by the token in the URL
+	order, err := app.orderFromRef(r)
 	if err != nil {
 		http.Error(w, "Order not found", 404)
 		return
 	}
 
-	// 3. Initiate STK Push (Only if pending)
-	if order.Status == "PENDING" {
-		// Format phone to 254...
-		phone := order.CustomerPhone
-		if len(phone) > 0 && phone[0] == '0' {
-			phone = "254" + phone[1:]
-		}
-
-		// Trigger M-Pesa
-		err := app.Mpesa.InitiateSTKPush(phone, order.TotalAmount, orderID)
-		if err != nil {
+	// 3. Initiate STK Push, but only the first time the page loads.
+	// Reloads and the back button must not prompt the customer again.
+	if order.Status == models.StatusPendingPayment {
+		err = app.pushPayment(order, firstPushPolicy)
+		switch {
+		case err == nil:
+		case errors.Is(err, repository.ErrOrderNotPayable),
+			errors.Is(err, repository.ErrAttemptInFlight),
+			errors.Is(err, repository.ErrResendCooldown),
+			errors.Is(err, repository.ErrTooManyAttempts):
+			// Already prompted; the customer can use the resend button instead
+		default:
 			log.Println("Mpesa Error:", err)
 		}
 	}
 
 	// 4. Prepare Data for Template
 	// We wrap the order in a struct matching the template's expectation {{.Order}}
+	// A balance is only pushed when the customer asks for it
+	resend := r.URL.Query().Get("resend")
 	data := &models.TemplateData{
-		Title: "Processing Payment",
-		Order: order,
+		Title:    "Processing Payment",
+		Order:    order,
+		Flash:    resendMessages[resend],
+		Prompted: order.AmountPaid == 0 || resend == "sent",
 	}
 
 	// 5. Render
@@ -409,17 +729,53 @@ func (app *Application) adminDashboardHandler(w http.ResponseWriter, r *http.Req
 	// Security: In a real app, check for a session cookie here!
 	// For now, we assume anyone accessing this URL is the admin (Localhost dev mode).
 
-	orders, err := app.Orders.GetAll()
+	filter := orderFilterFrom(r.URL.Query())
+	orders, next, err := app.Orders.Search(filter)
+	if errors.Is(err, repository.ErrBadCursor) {
+		http.Redirect(w, r, "/admin/dashboard?"+orderFilterQuery(filter).Encode(), http.StatusSeeOther)
+		return
+	}
 	if err != nil {
 		log.Println(err)
 		http.Error(w, "Server Error", 500)
 		return
 	}
 
+	// Page links keep the filters; there is no "previous", just back to the start
+	var nextPage, firstPage string
+	if next != "" {
+		q := orderFilterQuery(filter)
+		q.Set("after", next)
+		nextPage = "/admin/dashboard?" + q.Encode()
+	}
+	if filter.After != "" {
+		firstPage = "/admin/dashboard?" + orderFilterQuery(filter).Encode()
+	}
+
+	// What the kitchen has to hand over this week
+	schedule, err := app.Orders.Schedule(today(), 7)
+	if err != nil {
+		log.Println(err)
+	}
+
 	data := struct {
-		Orders []models.Order
+		Orders    []models.Order
+		Schedule  []models.Order
+		Filter    repository.OrderFilter
+		Statuses  []string
+		Sorts     []string
+		NextPage  string
+		FirstPage string
+		ExportURL string
 	}{
-		Orders: orders,
+		Orders:    orders,
+		Schedule:  schedule,
+		Filter:    filter,
+		Statuses:  models.AllStatuses,
+		Sorts:     repository.OrderSorts,
+		NextPage:  nextPage,
+		FirstPage: firstPage,
+		ExportURL: "/admin/orders/export?" + orderFilterQuery(filter).Encode(),
 	}
 
 	files := []string{
@@ -445,17 +801,41 @@ func (app *Application) adminUpdateStatusHandler(w http.ResponseWriter, r *http.
 
 	idStr := r.FormValue("order_id")
 	status := r.FormValue("status")
+	note := strings.TrimSpace(r.FormValue("note"))
 
 	var id int
 	fmt.Sscanf(idStr, "%d", &id)
 
-	err := app.Orders.UpdateStatus(id, status)
-	if err != nil {
-		log.Println("Error updating status:", err)
+	// Payments and refunds move orders into the other statuses themselves
+	msg := "Order moved to " + status + "."
+	if !models.CanSetByAdmin(status) {
+		msg = status + " can't be set by hand."
+	} else {
+		err := app.Orders.Transition(id, status, adminActor(), note)
+		switch {
+		case errors.Is(err, repository.ErrUnknownOrder):
+			http.NotFound(w, r)
+			return
+		case errors.Is(err, repository.ErrBadTransition):
+			msg = "This order can't move to " + status + " from where it is now."
+		case err != nil:
+			log.Println("Error updating status:", err)
+			http.Error(w, "Server Error", 500)
+			return
+		}
 	}
 
-	// Redirect back to dashboard
-	http.Redirect(w, r, "/admin/dashboard", http.StatusSeeOther)
+	// Back to the order, where the message and history show
+	http.Redirect(w, r, fmt.Sprintf("/admin/orders/view?id=%d&msg=%s", id, url.QueryEscape(msg)), http.StatusSeeOther)
+}
+
+// adminActor names the admin in order history. There is a single admin
+// account, configured by ADMIN_USERNAME.
+func adminActor() string {
+	if name := os.Getenv("ADMIN_USERNAME"); name != "" {
+		return name
+	}
+	return "admin"
 }
 
 // Add this helper function to your Application struct or as a standalone
@@ -547,10 +927,12 @@ func (app *Application) adminAddProductHandler(w http.ResponseWriter, r *http.Re
 
 	// 4. Save Product
 	p := models.Product{
-		Name:        name,
-		Description: desc,
-		Category:    strconv.Itoa(catID), // Storing ID in the struct field temporarily
-		ImageURL:    imagePath,
+		Name:           name,
+		Description:    desc,
+		Category:       strconv.Itoa(catID), // Storing ID in the struct field temporarily
+		ImageURL:       imagePath,
+		DepositPercent: parsePercent(r.FormValue("deposit_percent")),
+		LeadTimeHours:  parseHours(r.FormValue("lead_time_hours")),
 	}
 
 	newID, err := app.Products.InsertProduct(p)
@@ -623,7 +1005,7 @@ func (app *Application) adminAddCategoryHandler(w http.ResponseWriter, r *http.R
 	// Generate a simple slug (e.g., "Wedding Cakes" -> "wedding-cakes")
 	slug := strings.ToLower(strings.ReplaceAll(name, " ", "-"))
 
-	err := app.Products.InsertCategory(name, slug)
+	err := app.Products.InsertCategory(name, slug, parsePercent(r.FormValue("deposit_percent")))
 	if err != nil {
 		log.Println("Error adding category:", err)
 	}
@@ -631,6 +1013,18 @@ func (app *Application) adminAddCategoryHandler(w http.ResponseWriter, r *http.R
 	http.Redirect(w, r, "/admin/categories", http.StatusSeeOther)
 }
 
+// adminCategoryDepositHandler sets the deposit percentage for a category
+func (app *Application) adminCategoryDepositHandler(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(r.FormValue("id"))
+
+	err := app.Products.UpdateCategoryDeposit(id, parsePercent(r.FormValue("deposit_percent")))
+	if err != nil {
+		log.Println("Error updating category deposit:", err)
+	}
+
+	http.Redirect(w, r, "/admin/categories", http.StatusSeeOther)
+}
+
 func (app *Application) adminDeleteCategoryHandler(w http.ResponseWriter, r *http.Request) {
 	idStr := r.FormValue("id")
 	id, _ := strconv.Atoi(idStr)
@@ -681,10 +1075,35 @@ func (app *Application) adminOrderViewHandler(w http.ResponseWriter, r *http.Req
 		return
 	}
 
+	// 3. Get the payments received, and any refunds made against it
+	payments, err := app.Payments.ForOrder(id)
+	if err != nil {
+		log.Println(err)
+	}
+	refunds, err := app.Refunds.ForOrder(id)
+	if err != nil {
+		log.Println(err)
+	}
+	refundable, err := app.Refunds.Refundable(id)
+	if err != nil {
+		log.Println(err)
+	}
+
+	// 4. Who moved it through the lifecycle, and when
+	history, err := app.Orders.History(id)
+	if err != nil {
+		log.Println(err)
+	}
+
 	data := &models.TemplateData{
 		Title:      "Order Details",
 		Order:      order,
 		OrderItems: items,
+		Payments:   payments,
+		History:    history,
+		Refunds:    refunds,
+		Refundable: refundable,
+		Flash:      r.URL.Query().Get("msg"),
 		IsAdmin:    true,
 	}
 
@@ -692,12 +1111,8 @@ func (app *Application) adminOrderViewHandler(w http.ResponseWriter, r *http.Req
 }
 
 func (app *Application) removeFromCartHandler(w http.ResponseWriter, r *http.Request) {
-	// Parse the Variant ID from the form
-	idStr := r.FormValue("variant_id")
-	id, _ := strconv.Atoi(idStr)
-
-	// Remove it
-	cart.Remove(w, r, id)
+	// Remove the line named in the form
+	cart.Remove(w, r, r.FormValue("line_id"))
 
 	// Refresh the page
 	http.Redirect(w, r, "/cart", http.StatusSeeOther)
@@ -705,22 +1120,21 @@ func (app *Application) removeFromCartHandler(w http.ResponseWriter, r *http.Req
 
 func (app *Application) updateCartHandler(w http.ResponseWriter, r *http.Request) {
 	// Parse IDs
-	variantID, _ := strconv.Atoi(r.FormValue("variant_id"))
+	lineID := r.FormValue("line_id")
 	action := r.FormValue("action") // will be "increase" or "decrease"
 
 	switch action {
 	case "increase":
-		cart.UpdateQuantity(w, r, variantID, 1)
+		cart.UpdateQuantity(w, r, lineID, 1)
 	case "decrease":
-		cart.UpdateQuantity(w, r, variantID, -1)
+		cart.UpdateQuantity(w, r, lineID, -1)
 	}
 
 	http.Redirect(w, r, "/cart", http.StatusSeeOther)
 }
 
 func (app *Application) removeCartHandler(w http.ResponseWriter, r *http.Request) {
-	variantID, _ := strconv.Atoi(r.FormValue("variant_id"))
-	cart.RemoveItem(w, r, variantID)
+	cart.RemoveItem(w, r, r.FormValue("line_id"))
 	http.Redirect(w, r, "/cart", http.StatusSeeOther)
 }
 
@@ -806,11 +1220,13 @@ func (app *Application) adminEditProductHandler(w http.ResponseWriter, r *http.R
 
 	// Update Main Product
 	p := models.Product{
-		ID:          id,
-		Name:        name,
-		Description: desc,
-		Category:    catID,
-		ImageURL:    imagePath,
+		ID:             id,
+		Name:           name,
+		Description:    desc,
+		Category:       catID,
+		ImageURL:       imagePath,
+		DepositPercent: parsePercent(r.FormValue("deposit_percent")),
+		LeadTimeHours:  parseHours(r.FormValue("lead_time_hours")),
 	}
 	app.Products.UpdateProduct(p)
 
@@ -850,15 +1266,14 @@ func (app *Application) orderStatusHandler(w http.ResponseWriter, r *http.Reques
 	w.Write([]byte(fmt.Sprintf(`{"status": "%s"}`, status)))
 }
 func (app *Application) apiCheckStatusHandler(w http.ResponseWriter, r *http.Request) {
-	// 1. Get the Order ID
-	idStr := r.URL.Query().Get("id")
-	var id int
-	fmt.Sscanf(idStr, "%d", &id)
+	// 1. Get the order's public token
+	ref := r.URL.Query().Get("ref")
 
-	// 2. Fetch the current status from the Database
+	// 2. Fetch the current status (and what's been paid, for deposit orders) from the Database
 	var status string
-	stmt := `SELECT status FROM orders WHERE id = $1`
-	err := app.Orders.DB.QueryRow(stmt, id).Scan(&status)
+	var amountPaid float64
+	stmt := `SELECT status, COALESCE(amount_paid, 0) FROM orders WHERE public_token = $1`
+	err := app.Orders.DB.QueryRow(stmt, ref).Scan(&status, &amountPaid)
 	if err != nil {
 		// If order not found or error, return generic JSON error
 		w.Header().Set("Content-Type", "application/json")
@@ -867,50 +1282,32 @@ func (app *Application) apiCheckStatusHandler(w http.ResponseWriter, r *http.Req
 	}
 
 	// 3. Return as JSON
-	// The JavaScript expects: { "status": "PAID" } or { "status": "PENDING" }
+	// The JavaScript expects: { "status": "PAID", "amount_paid": 4000 } or { "status": "PENDING_PAYMENT", ... }
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{
-		"status": status,
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":      status,
+		"amount_paid": amountPaid,
 	})
 }
 
-// MpesaCallbackStructure defines the JSON format sent by Safaricom
-type MpesaCallbackStructure struct {
-	Body struct {
-		StkCallback struct {
-			MerchantRequestID string
-			CheckoutRequestID string
-			ResultCode        int
-			ResultDesc        string
-			CallbackMetadata  struct {
-				Item []struct {
-					Name  string
-					Value interface{}
-				}
-			}
-		}
-	}
-}
-
 func (app *Application) mpesaCallbackHandler(w http.ResponseWriter, r *http.Request) {
 	// 1. Decode JSON
-	var callback MpesaCallbackStructure
+	var callback models.MpesaCallbackResponse
 	err := json.NewDecoder(r.Body).Decode(&callback)
 	if err != nil {
-		log.Println("Error decoding callback:", err)
+		rejectCallback(w, r, "", "invalid JSON: "+err.Error())
 		return
 	}
-	defer r.Body.Close()
 
-	// 2. Check Result Code
-	resultCode := callback.Body.StkCallback.ResultCode
+	stk := callback.Body.StkCallback
+	ref := stk.CheckoutRequestID
 
-	// 3. Extract Phone & Receipt
+	// 2. Extract Phone, Receipt & Amount
 	var phoneNumber string
 	var mpesaReceipt string
+	var amountPaid float64
 
-	items := callback.Body.StkCallback.CallbackMetadata.Item
-	for _, item := range items {
+	for _, item := range stk.CallbackMetadata.Item {
 		if item.Name == "PhoneNumber" {
 			if val, ok := item.Value.(float64); ok {
 				phoneNumber = fmt.Sprintf("%.0f", val)
@@ -921,99 +1318,156 @@ func (app *Application) mpesaCallbackHandler(w http.ResponseWriter, r *http.Requ
 				mpesaReceipt = val
 			}
 		}
+		if item.Name == "Amount" {
+			if val, ok := item.Value.(float64); ok {
+				amountPaid = val
+			}
+		}
 	}
 
-	// 4. Handle Logic
-	if resultCode == 0 {
-		log.Printf("Payment Confirmed: %s - %s", phoneNumber, mpesaReceipt)
+	// 3. Find the STK Push this is for, and check the URL token belongs to its order
+	attempt, err := app.Payments.GetAttempt(ref)
+	if errors.Is(err, repository.ErrUnknownCheckout) {
+		rejectCallback(w, r, ref, "unknown CheckoutRequestID")
+		return
+	}
+	if err != nil {
+		log.Println("Error loading payment attempt:", err)
+		http.Error(w, "Server Error", 500)
+		return
+	}
+
+	order, err := app.Orders.Get(attempt.OrderID)
+	if err != nil {
+		log.Println("Error loading order for callback:", err)
+		http.Error(w, "Server Error", 500)
+		return
+	}
+	token := r.PathValue("token")
+	if order.CallbackToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(order.CallbackToken)) != 1 {
+		rejectCallback(w, r, ref, fmt.Sprintf("callback token does not match order #%d", order.ID))
+		return
+	}
 
-		// Phone formatting (254 -> 07)
-		altPhone := phoneNumber
-		if len(phoneNumber) == 12 && phoneNumber[0:3] == "254" {
-			altPhone = "0" + phoneNumber[3:]
+	// 4. A success must be for exactly what we asked for
+	if stk.ResultCode == 0 && amountPaid != attempt.Amount {
+		note := fmt.Sprintf("amount %.2f does not match %.2f requested for order #%d (receipt %s)", amountPaid, attempt.Amount, order.ID, mpesaReceipt)
+		if err := app.Payments.Reject(ref, note); err != nil {
+			log.Println("Error rejecting payment attempt:", err)
 		}
+		rejectCallback(w, r, ref, note)
+		return
+	}
 
-		// 5. Update DB & Get User Info for Email (Using RETURNING)
-		stmt := `
-			UPDATE orders 
-			SET status = 'PAID', mpesa_receipt = $1
-			WHERE (customer_phone = $2 OR customer_phone = $3) 
-			AND status = 'PENDING'
-			AND id = (
-				SELECT id FROM orders 
-				WHERE (customer_phone = $2 OR customer_phone = $3) 
-				AND status = 'PENDING' 
-				ORDER BY id DESC LIMIT 1
-			)
-			RETURNING id, email, first_name, last_name, total_amount
-		`
-
-		var orderID int
-		var email, firstName, lastName string
-		var amount float64
-
-		// We scan the returned values
-		err := app.Orders.DB.QueryRow(stmt, mpesaReceipt, phoneNumber, altPhone).Scan(&orderID, &email, &firstName, &lastName, &amount)
+	// 5. Settle the exact order that owns this CheckoutRequestID
+	orderID, err := app.Payments.Settle(ref, stk.ResultCode, stk.ResultDesc, mpesaReceipt, amountPaid)
+	switch {
+	case errors.Is(err, repository.ErrAttemptSettled):
+		rejectCallback(w, r, ref, fmt.Sprintf("already settled (order #%d)", orderID))
+		return
+	case errors.Is(err, repository.ErrDuplicateReceipt):
+		rejectCallback(w, r, ref, fmt.Sprintf("receipt %s was already used (order #%d)", mpesaReceipt, orderID))
+		return
+	case errors.Is(err, repository.ErrPaymentRefunded):
+		// No receipt email: the order isn't going ahead on this money
+		log.Printf("Payment for order #%d arrived after it stopped taking payments, refund requested: %s", orderID, mpesaReceipt)
+		acceptCallback(w, r, ref, fmt.Sprintf("order #%d not awaiting payment, refund of %s requested", orderID, mpesaReceipt))
+		return
+	case err != nil:
+		log.Println("Error settling payment:", err)
+		http.Error(w, "Server Error", 500)
+		return
+	}
 
-		if err != nil {
-			log.Println("Error updating DB or finding order:", err)
-		} else {
-			// ==========================================
-			// 6. SEND EMAILS (Corrected)
-			// ==========================================
-
-			// We need to fetch the items to show them in the receipt
-			// (Assuming app.Orders.GetOrderItems exists from previous steps)
-			// If this fails, we just send an empty list to avoid crashing
-			orderItems, _ := app.Orders.GetOrderItems(orderID)
-
-			// Construct the data object for the HTML template
-			emailData := struct {
-				ID            int
-				CustomerName  string
-				CustomerPhone string
-				TotalAmount   float64
-				Items         interface{} // interface{} allows us to pass your OrderDetailItem slice
-				Receipt       string
-			}{
-				ID:            orderID,
-				CustomerName:  firstName + " " + lastName,
-				CustomerPhone: phoneNumber,
-				TotalAmount:   amount,
-				Items:         orderItems,
-				Receipt:       mpesaReceipt,
-			}
+	// 6. Handle Logic
+	if stk.ResultCode != 0 {
+		log.Printf("Payment Failed/Cancelled for order #%d. Code: %d (%s)", orderID, stk.ResultCode, stk.ResultDesc)
+		acceptCallback(w, r, ref, fmt.Sprintf("order #%d failed: %s", orderID, stk.ResultDesc))
+		return
+	}
 
-			// A. Customer Email
-			if email != "" {
-				// FIX: Passing 4 arguments: To, Subject, TemplateFile, Data
-				go app.Mailer.Send(email, "Payment Received - Order #"+fmt.Sprint(orderID), "customer_receipt.html", emailData)
-			}
+	log.Printf("Payment Confirmed for order #%d: %s - %s", orderID, phoneNumber, mpesaReceipt)
 
-			// B. Admin Email
-			adminEmail := os.Getenv("ADMIN_EMAIL")
-			if adminEmail != "" {
-				// FIX: Passing 4 arguments here too
-				go app.Mailer.Send(adminEmail, "💰 New Payment Received!", "admin_alert.html", emailData)
-			}
-		}
+	app.sendPaymentEmails(orderID, phoneNumber, mpesaReceipt)
 
-	} else {
-		// PAYMENT FAILED logic
-		log.Printf("Payment Failed/Cancelled. Code: %d", resultCode)
+	acceptCallback(w, r, ref, fmt.Sprintf("order #%d paid: %s", orderID, mpesaReceipt))
+}
 
-		if phoneNumber != "" {
-			altPhone := phoneNumber
-			if len(phoneNumber) == 12 && phoneNumber[0:3] == "254" {
-				altPhone = "0" + phoneNumber[3:]
-			}
-			stmt := `UPDATE orders SET status = 'FAILED' WHERE (customer_phone = $1 OR customer_phone = $2) AND status = 'PENDING'`
-			app.Orders.DB.Exec(stmt, phoneNumber, altPhone)
-		}
+// sendPaymentEmails sends the customer receipt and the admin alert for a paid order
+func (app *Application) sendPaymentEmails(orderID int, phoneNumber, mpesaReceipt string) {
+	order, err := app.Orders.Get(orderID)
+	if err != nil {
+		log.Println("Error loading paid order:", err)
+		return
 	}
+	if phoneNumber == "" {
+		phoneNumber = order.CustomerPhone
+	}
+
+	// We need to fetch the items to show them in the receipt
+	// If this fails, we just send an empty list to avoid crashing
+	orderItems, _ := app.Orders.GetOrderItems(orderID)
+
+	// Deposit orders get a link to pay the balance (needs SITE_URL for an absolute link)
+	var balanceURL string
+	if siteURL := strings.TrimRight(os.Getenv("SITE_URL"), "/"); siteURL != "" && order.BalanceDue() > 0 {
+		balanceURL = fmt.Sprintf("%s/payment?ref=%s", siteURL, order.PublicToken)
+	}
+
+	// Construct the data object for the HTML template
+	emailData := struct {
+		ID            int
+		Code          string // What the customer knows the order as
+		CustomerName  string
+		CustomerPhone string
+		TotalAmount   float64
+		DeliveryFee   float64
+		Discount      float64
+		PromoCode     string
+		AmountPaid    float64
+		BalanceDue    float64
+		BalanceURL    string
+		Fulfilment    string
+		Address       string
+		Items         interface{} // interface{} allows us to pass your OrderDetailItem slice
+		Receipt       string
+	}{
+		ID:            orderID,
+		Code:          order.PublicCode,
+		CustomerName:  order.FirstName + " " + order.LastName,
+		CustomerPhone: phoneNumber,
+		TotalAmount:   order.TotalAmount,
+		DeliveryFee:   order.DeliveryFee,
+		Discount:      order.DiscountAmount,
+		PromoCode:     order.DiscountCode,
+		AmountPaid:    order.AmountPaid,
+		BalanceDue:    order.BalanceDue(),
+		BalanceURL:    balanceURL,
+		Fulfilment:    order.Fulfilment(),
+		Address:       order.Address,
+		Items:         orderItems,
+		Receipt:       mpesaReceipt,
+	}
+
+	// A. Customer Email
+	if order.Email != "" {
+		go app.Mailer.Send(order.Email, "Payment Received - Order "+order.PublicCode, "customer_receipt.html", emailData)
+	}
+
+	// B. Admin Email
+	adminEmail := os.Getenv("ADMIN_EMAIL")
+	if adminEmail != "" {
+		go app.Mailer.Send(adminEmail, "💰 New Payment Received!", "admin_alert.html", emailData)
+	}
+}
 
+// writeCallbackAck answers Safaricom in the format it expects
+func writeCallbackAck(w http.ResponseWriter, code int, desc string) {
 	w.Header().Set("Content-Type", "application/json")
-	w.Write([]byte(`{"ResultCode":0,"ResultDesc":"Accepted"}`))
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"ResultCode": code,
+		"ResultDesc": desc,
+	})
 }
 
 func (app *Application) loginPageHandler(w http.ResponseWriter, r *http.Request) {
@@ -1073,17 +1527,10 @@ func (app *Application) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
 		next(w, r)
 	}
 }
-func (app *Application) paymentFailedHandler(w http.ResponseWriter, r *http.Request) {
-	app.render(w, r, "payment_failed.page.html", &models.TemplateData{Title: "Payment Failed"})
-}
 
 func (app *Application) orderConfirmedHandler(w http.ResponseWriter, r *http.Request) {
-	idStr := r.URL.Query().Get("id")
-	var id int
-	fmt.Sscanf(idStr, "%d", &id)
-
 	// Fetch order details to show on the Thank You page
-	order, err := app.Orders.Get(id)
+	order, err := app.orderFromRef(r)
 	if err != nil {
 		http.NotFound(w, r)
 		return
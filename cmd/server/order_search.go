@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+	"time"
+
+	"crave-and-glaze/internal/models"
+	"crave-and-glaze/internal/repository"
+)
+
+// orderFilterFrom reads the dashboard's search form. Dates that don't parse
+// are dropped rather than failing the whole page.
+func orderFilterFrom(q url.Values) repository.OrderFilter {
+	date := func(name string) string {
+		d := strings.TrimSpace(q.Get(name))
+		if _, err := time.Parse(models.DateLayout, d); err != nil {
+			return ""
+		}
+		return d
+	}
+
+	return repository.OrderFilter{
+		Status:     q.Get("status"),
+		From:       date("from"),
+		To:         date("to"),
+		Fulfilment: date("due"),
+		Phone:      strings.TrimSpace(q.Get("phone")),
+		Name:       strings.TrimSpace(q.Get("name")),
+		Email:      strings.TrimSpace(q.Get("email")),
+		Receipt:    strings.TrimSpace(q.Get("receipt")),
+		Sort:       q.Get("sort"),
+		After:      q.Get("after"),
+	}
+}
+
+// orderFilterQuery turns a filter back into the dashboard's query string,
+// leaving out the page cursor and anything not filtered on
+func orderFilterQuery(f repository.OrderFilter) url.Values {
+	q := url.Values{}
+	set := func(name, value string) {
+		if value != "" {
+			q.Set(name, value)
+		}
+	}
+	set("status", f.Status)
+	set("from", f.From)
+	set("to", f.To)
+	set("due", f.Fulfilment)
+	set("phone", f.Phone)
+	set("name", f.Name)
+	set("email", f.Email)
+	set("receipt", f.Receipt)
+	set("sort", f.Sort)
+	return q
+}
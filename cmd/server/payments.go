@@ -0,0 +1,312 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"crave-and-glaze/internal/daraja"
+	"crave-and-glaze/internal/models"
+	"crave-and-glaze/internal/repository"
+)
+
+// Safaricom drops an unanswered PIN prompt after about a minute, so a push
+// younger than InFlight is still live on the customer's phone.
+var resendPolicy = repository.AttemptPolicy{
+	InFlight:    90 * time.Second,
+	Cooldown:    60 * time.Second,
+	MaxAttempts: 3,
+}
+
+// firstPushPolicy is used when the payment page loads: it only pushes if the
+// customer has never been prompted, so reloading the page never prompts again.
+var firstPushPolicy = repository.AttemptPolicy{
+	InFlight:    resendPolicy.InFlight,
+	Cooldown:    resendPolicy.Cooldown,
+	MaxAttempts: 1,
+}
+
+// Messages shown on the payment page after a resend, keyed by ?resend=
+var resendMessages = map[string]string{
+	"sent":     "We've sent a new payment prompt to your phone.",
+	"inflight": "Your last prompt is still active. Check your phone, or try again in a minute.",
+	"cooldown": "Please wait a minute before requesting another prompt.",
+	"limit":    "You've reached the maximum number of payment prompts for this order.",
+	"error":    "We couldn't reach M-Pesa. Please try again shortly.",
+}
+
+// orderFromRef loads the order a customer link or form points to (?ref=<token>).
+// Customer-facing URLs never carry the order ID, so they can't be enumerated.
+func (app *Application) orderFromRef(r *http.Request) (*models.Order, error) {
+	return app.Orders.GetByToken(r.FormValue("ref"))
+}
+
+// pushPayment sends an STK Push for what is due on the order if the policy allows it
+func (app *Application) pushPayment(order *models.Order, policy repository.AttemptPolicy) error {
+	phone := daraja.FormatPhone(order.CustomerPhone)
+
+	// Reserve the attempt first so concurrent requests can't both push
+	amount := math.Ceil(order.AmountDue())
+	attemptID, err := app.Payments.ReserveAttempt(order.ID, phone, amount, policy)
+	if err != nil {
+		return err
+	}
+	return app.sendPush(order, phone, amount, attemptID)
+}
+
+// retryPayment re-opens a failed order on a (possibly new) phone and pushes again
+func (app *Application) retryPayment(order *models.Order, phone string) error {
+	phone = daraja.FormatPhone(phone)
+
+	amount := math.Ceil(order.AmountDue())
+	attemptID, err := app.Payments.ReserveRetry(order.ID, phone, amount, resendPolicy)
+	if err != nil {
+		return err
+	}
+	return app.sendPush(order, phone, amount, attemptID)
+}
+
+// sendPush triggers M-Pesa for an attempt that has already been reserved.
+// amount is the deposit, the balance, or the whole total, in whole shillings
+// (rounded up, so the order is never marked paid for less than it costs).
+func (app *Application) sendPush(order *models.Order, phone string, amount float64, attemptID int) error {
+	stk, err := app.Mpesa.InitiateSTKPush(phone, amount, order.PublicCode, order.CallbackToken)
+	if err != nil {
+		if markErr := app.Payments.MarkSendFailed(attemptID, err.Error()); markErr != nil {
+			log.Println("Error closing payment attempt:", markErr)
+		}
+		return err
+	}
+
+	// Remember the CheckoutRequestID so the callback can find this exact order
+	if err := app.Payments.MarkSent(attemptID, stk.MerchantRequestID, stk.CheckoutRequestID); err != nil {
+		log.Println("Error saving payment attempt:", err)
+	}
+	return nil
+}
+
+// resendResult turns a push error into the ?resend= code the payment page understands
+func resendResult(err error) string {
+	switch {
+	case err == nil:
+		return "sent"
+	case errors.Is(err, repository.ErrAttemptInFlight):
+		return "inflight"
+	case errors.Is(err, repository.ErrResendCooldown):
+		return "cooldown"
+	case errors.Is(err, repository.ErrTooManyAttempts):
+		return "limit"
+	}
+	log.Println("Mpesa Error:", err)
+	return "error"
+}
+
+// paymentResendHandler is the "Resend payment prompt" button on the payment page
+func (app *Application) paymentResendHandler(w http.ResponseWriter, r *http.Request) {
+	order, err := app.orderFromRef(r)
+	if err != nil {
+		http.Error(w, "Order not found", 404)
+		return
+	}
+
+	err = app.pushPayment(order, resendPolicy)
+	if errors.Is(err, repository.ErrOrderNotPayable) {
+		// Paid or failed in the meantime; the page's status check takes over
+		err = nil
+	}
+	result := resendResult(err)
+
+	http.Redirect(w, r, fmt.Sprintf("/payment?ref=%s&resend=%s", order.PublicToken, result), http.StatusSeeOther)
+}
+
+// Messages shown on the failed page, keyed by ?msg=
+var failedMessages = map[string]string{
+	"phone":    "Please enter a valid Safaricom number, e.g. 0712 345 678.",
+	"method":   "Please choose how you'd like to pay.",
+	"bankref":  "Please enter the reference of your bank transfer.",
+	"inflight": resendMessages["inflight"],
+	"cooldown": resendMessages["cooldown"],
+	"limit":    "You've used all your M-Pesa attempts for this order. You can still pay on pickup or by bank transfer.",
+	"error":    resendMessages["error"],
+	"closed":   "This order can no longer be paid for. Please contact us if you need help.",
+}
+
+// paymentFailedHandler lets the customer try again on the same order instead of
+// rebuilding their cart: a new M-Pesa prompt (maybe to another number), or a
+// manual method that an admin confirms later.
+func (app *Application) paymentFailedHandler(w http.ResponseWriter, r *http.Request) {
+	data := &models.TemplateData{
+		Title:       "Payment Failed",
+		Flash:       failedMessages[r.URL.Query().Get("msg")],
+		BankDetails: os.Getenv("BANK_TRANSFER_DETAILS"),
+	}
+
+	if order, err := app.orderFromRef(r); err == nil {
+		// A late callback may have paid it while the customer was being redirected
+		if order.AmountPaid > 0 || order.Status == models.StatusAwaitingManual {
+			http.Redirect(w, r, "/order-confirmed?ref="+order.PublicToken, http.StatusSeeOther)
+			return
+		}
+		data.Order = order
+	}
+
+	app.render(w, r, "payment_failed.page.html", data)
+}
+
+// paymentRetryHandler re-opens a failed order and sends a new STK Push,
+// to the number the customer entered on the failed page
+func (app *Application) paymentRetryHandler(w http.ResponseWriter, r *http.Request) {
+	phone := strings.TrimSpace(r.FormValue("mpesa_phone"))
+
+	order, err := app.orderFromRef(r)
+	if err != nil {
+		http.Error(w, "Order not found", 404)
+		return
+	}
+
+	back := func(msg string) {
+		http.Redirect(w, r, fmt.Sprintf("/payment-failed?ref=%s&msg=%s", order.PublicToken, msg), http.StatusSeeOther)
+	}
+
+	if !daraja.ValidPhone(phone) {
+		back("phone")
+		return
+	}
+
+	err = app.retryPayment(order, phone)
+	switch {
+	case err == nil:
+	case errors.Is(err, repository.ErrOrderNotPayable):
+		back("closed")
+		return
+	case errors.Is(err, repository.ErrAttemptInFlight),
+		errors.Is(err, repository.ErrResendCooldown),
+		errors.Is(err, repository.ErrTooManyAttempts):
+		back(resendResult(err))
+		return
+	default:
+		// The order is PENDING_PAYMENT on the new number; the payment page can resend
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/payment?ref=%s&resend=%s", order.PublicToken, resendResult(err)), http.StatusSeeOther)
+}
+
+// paymentManualHandler switches a failed order to pay on pickup or bank transfer
+func (app *Application) paymentManualHandler(w http.ResponseWriter, r *http.Request) {
+	method := r.FormValue("method")
+	reference := strings.TrimSpace(r.FormValue("reference"))
+
+	order, err := app.orderFromRef(r)
+	if err != nil {
+		http.Error(w, "Order not found", 404)
+		return
+	}
+	orderID := order.ID
+
+	back := func(msg string) {
+		http.Redirect(w, r, fmt.Sprintf("/payment-failed?ref=%s&msg=%s", order.PublicToken, msg), http.StatusSeeOther)
+	}
+
+	switch method {
+	case "PICKUP":
+		reference = ""
+	case "BANK_TRANSFER":
+		if reference == "" {
+			back("bankref")
+			return
+		}
+	default:
+		back("method")
+		return
+	}
+
+	err = app.Orders.RequestManualPayment(orderID, method, reference)
+	if errors.Is(err, repository.ErrOrderNotPayable) {
+		back("closed")
+		return
+	}
+	if err != nil {
+		log.Println("Error switching order to manual payment:", err)
+		http.Error(w, "Server Error", 500)
+		return
+	}
+
+	log.Printf("Order #%d is awaiting manual payment (%s)", orderID, method)
+	http.Redirect(w, r, "/order-confirmed?ref="+order.PublicToken, http.StatusSeeOther)
+}
+
+// adminConfirmPaymentHandler marks a pay-on-pickup or bank transfer order PAID,
+// or records the balance of a deposit order collected on delivery
+func (app *Application) adminConfirmPaymentHandler(w http.ResponseWriter, r *http.Request) {
+	orderID, _ := strconv.Atoi(r.FormValue("order_id"))
+
+	order, err := app.Orders.Get(orderID)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	msg := "Payment confirmed. The order is paid in full."
+	err = app.Orders.ConfirmManualPayment(orderID, adminActor())
+	switch {
+	case errors.Is(err, repository.ErrOrderNotPayable):
+		msg = "This order is not awaiting a manual or balance payment."
+	case err != nil:
+		log.Println("Error confirming manual payment:", err)
+		http.Error(w, "Server Error", 500)
+		return
+	default:
+		receipt := "Paid on pickup"
+		switch {
+		case order.AmountPaid > 0:
+			receipt = "Balance paid on delivery"
+		case order.PaymentMethod == "BANK_TRANSFER":
+			receipt = "Bank transfer " + order.PaymentRef
+		}
+		app.sendPaymentEmails(orderID, "", receipt)
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/admin/orders/view?id=%d&msg=%s", orderID, url.QueryEscape(msg)), http.StatusSeeOther)
+}
+
+// receiptPattern is what an M-Pesa receipt number looks like, e.g. "QKJ4ABC123"
+var receiptPattern = regexp.MustCompile(`^[A-Z0-9]{10}$`)
+
+// adminPaymentReceiptHandler fills in the receipt of an M-Pesa payment the
+// reconciler confirmed by STK Query (which doesn't return one), so the order
+// can be found by receipt and reversed like any other
+func (app *Application) adminPaymentReceiptHandler(w http.ResponseWriter, r *http.Request) {
+	orderID, _ := strconv.Atoi(r.FormValue("order_id"))
+	attemptID, _ := strconv.Atoi(r.FormValue("attempt_id"))
+	receipt := strings.ToUpper(strings.TrimSpace(r.FormValue("receipt")))
+
+	back := func(msg string) {
+		http.Redirect(w, r, fmt.Sprintf("/admin/orders/view?id=%d&msg=%s", orderID, url.QueryEscape(msg)), http.StatusSeeOther)
+	}
+
+	if !receiptPattern.MatchString(receipt) {
+		back("Please enter the 10 character M-Pesa receipt number from the statement.")
+		return
+	}
+
+	err := app.Payments.SetReceipt(orderID, attemptID, receipt, adminActor())
+	switch {
+	case errors.Is(err, repository.ErrDuplicateReceipt):
+		back("That receipt is already recorded against another payment.")
+	case errors.Is(err, repository.ErrReceiptNotPending), errors.Is(err, repository.ErrUnknownOrder):
+		back("That payment already has a receipt.")
+	case err != nil:
+		log.Println("Error saving M-Pesa receipt:", err)
+		http.Error(w, "Server Error", 500)
+	default:
+		back("Receipt " + receipt + " saved.")
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+
+	"crave-and-glaze/internal/cart"
+)
+
+// repriceCart brings every cart line up to date with the catalogue: current
+// price and name, and lines whose cake has been removed or hidden are dropped.
+// The cookie is only a convenience; what an order costs is always decided
+// here. It returns the lines and a notice for each change the customer
+// should see before paying.
+func (app *Application) repriceCart(items []cart.Item) ([]cart.Item, []string, error) {
+	if len(items) == 0 {
+		return items, nil, nil
+	}
+	variants, err := app.Products.Sellable(variantIDs(items))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fresh := make([]cart.Item, 0, len(items))
+	var notices []string
+	for _, item := range items {
+		v, ok := variants[item.VariantID]
+		if !ok {
+			notices = append(notices, fmt.Sprintf("%s is no longer available and has been removed from your cart.", item.ProductName))
+			continue
+		}
+
+		item.ProductName = v.ProductName + " (" + v.WeightLabel + ")"
+		item.ImageURL = v.ImageURL
+		if item.Price != v.Price {
+			notices = append(notices, fmt.Sprintf("The price of %s has changed from KES %.0f to KES %.0f.", item.ProductName, item.Price, v.Price))
+			item.Price = v.Price
+		}
+		if item.Quantity < 1 {
+			item.Quantity = 1
+		}
+		fresh = append(fresh, item)
+	}
+	return fresh, notices, nil
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"crave-and-glaze/internal/cart"
+	"crave-and-glaze/internal/models"
+	"crave-and-glaze/internal/repository"
+)
+
+// applyPromotion works out what a discount code takes off the cart. When the
+// code can't be used it returns why, for the checkout page. The per-customer
+// limit needs the order's phone number, so it is only checked as the order is placed.
+func (app *Application) applyPromotion(code string, items []cart.Item) (*models.Promotion, float64, string, error) {
+	promo, err := app.Promos.GetByCode(code)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && !promo.Active) {
+		return nil, 0, "We don't recognise that discount code.", nil
+	}
+	if err != nil {
+		return nil, 0, "", err
+	}
+
+	day := today().Format(models.DateLayout)
+	if promo.StartsOn != "" && day < promo.StartsOn {
+		return nil, 0, "That code can be used from " + mustDate(promo.StartsOn).Format("Mon 2 Jan") + ".", nil
+	}
+	if promo.EndsOn != "" && day > promo.EndsOn {
+		return nil, 0, "That code expired on " + mustDate(promo.EndsOn).Format("Mon 2 Jan") + ".", nil
+	}
+	if total := cart.Total(items); total < promo.MinSpend {
+		return nil, 0, fmt.Sprintf("That code needs an order of at least KES %.0f.", promo.MinSpend), nil
+	}
+
+	eligible, err := app.Promos.Eligible(promo, variantIDs(items))
+	if err != nil {
+		return nil, 0, "", err
+	}
+	var subtotal float64
+	for _, item := range items {
+		if eligible[item.VariantID] {
+			subtotal += item.Price * float64(item.Quantity)
+		}
+	}
+	discount := promo.DiscountOn(subtotal)
+	if discount <= 0 {
+		return nil, 0, "That code doesn't apply to the cakes in your cart.", nil
+	}
+	// M-Pesa can't collect nothing, so leave at least a shilling to pay
+	if total := cart.Total(items); discount >= total {
+		discount = total - 1
+	}
+
+	if promo.MaxUses > 0 {
+		uses, err := app.Promos.Uses(promo.ID, time.Now().Add(-app.CapacityHold))
+		if err != nil {
+			return nil, 0, "", err
+		}
+		if uses >= promo.MaxUses {
+			return nil, 0, "Sorry, that code has been used up.", nil
+		}
+	}
+	return promo, discount, "", nil
+}
+
+// discountDeposit shares a discount out over a deposit, so a deposit order
+// still pays the same share of its (now lower) price upfront
+func discountDeposit(deposit, subtotal, discount float64) float64 {
+	if deposit <= 0 || discount <= 0 || subtotal <= 0 {
+		return deposit
+	}
+	return math.Ceil(deposit * (subtotal - discount) / subtotal)
+}
+
+// Messages shown on the promotions page, keyed by ?msg=
+var promotionMessages = map[string]string{
+	"saved":   "Promotion saved.",
+	"deleted": "Promotion deleted.",
+}
+
+// parseLimit reads a usage limit from a form, treating junk as no limit
+func parseLimit(s string) int {
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
+
+// promotionFromForm reads a promotion from the admin form. It returns what is
+// wrong with it, if anything.
+func promotionFromForm(r *http.Request) (*models.Promotion, string) {
+	id, _ := strconv.Atoi(r.FormValue("id"))
+	p := &models.Promotion{
+		ID:             id,
+		Code:           strings.ToUpper(strings.TrimSpace(r.FormValue("code"))),
+		Description:    strings.TrimSpace(r.FormValue("description")),
+		Kind:           r.FormValue("kind"),
+		Value:          parseAmount(r.FormValue("value")),
+		MinSpend:       parseAmount(r.FormValue("min_spend")),
+		StartsOn:       r.FormValue("starts_on"),
+		EndsOn:         r.FormValue("ends_on"),
+		MaxUses:        parseLimit(r.FormValue("max_uses")),
+		MaxPerCustomer: parseLimit(r.FormValue("max_per_customer")),
+		Active:         r.FormValue("active") == "on",
+	}
+	for _, v := range r.Form["product_ids"] {
+		if pid, err := strconv.Atoi(v); err == nil {
+			p.ProductIDs = append(p.ProductIDs, pid)
+		}
+	}
+	for _, v := range r.Form["category_ids"] {
+		if cid, err := strconv.Atoi(v); err == nil {
+			p.CategoryIDs = append(p.CategoryIDs, cid)
+		}
+	}
+
+	switch {
+	case p.Code == "" || len(p.Code) > 30 || strings.ContainsAny(p.Code, " \t"):
+		return p, "Please enter a code of up to 30 letters and numbers, without spaces."
+	case p.Kind != models.PromoPercent && p.Kind != models.PromoFixed:
+		return p, "Please choose a percentage or a fixed amount off."
+	case p.Value <= 0 || (p.Kind == models.PromoPercent && p.Value > 100):
+		return p, "Please enter how much the code takes off (a percentage up to 100, or an amount in KES)."
+	}
+	for _, date := range []string{p.StartsOn, p.EndsOn} {
+		if _, err := time.Parse(models.DateLayout, date); date != "" && err != nil {
+			return p, "Please pick valid start and end dates."
+		}
+	}
+	if p.StartsOn != "" && p.EndsOn != "" && p.EndsOn < p.StartsOn {
+		return p, "The end date is before the start date."
+	}
+	return p, ""
+}
+
+// adminPromotionsHandler lists the discount codes with how often each was
+// used, what it gave away and what those orders brought in
+func (app *Application) adminPromotionsHandler(w http.ResponseWriter, r *http.Request) {
+	promotions, err := app.Promos.All()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Server Error", 500)
+		return
+	}
+
+	data := &models.TemplateData{
+		Title:      "Promotions",
+		Promotions: promotions,
+		Flash:      promotionMessages[r.URL.Query().Get("msg")],
+		IsAdmin:    true,
+	}
+
+	app.render(w, r, "admin/promotions.page.html", data)
+}
+
+// adminPromotionFormHandler shows the form for a new promotion, or for
+// editing one (?id=) along with the orders that used it
+func (app *Application) adminPromotionFormHandler(w http.ResponseWriter, r *http.Request) {
+	promo := &models.Promotion{Kind: models.PromoPercent, Active: true}
+	var redemptions []models.Redemption
+
+	if id, _ := strconv.Atoi(r.URL.Query().Get("id")); id != 0 {
+		var err error
+		promo, err = app.Promos.Get(id)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		redemptions, err = app.Promos.Redemptions(id, 100)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+
+	app.renderPromotionForm(w, r, promo, redemptions, "")
+}
+
+// renderPromotionForm shows the promotion form, with the cakes it can be
+// limited to (render adds the categories)
+func (app *Application) renderPromotionForm(w http.ResponseWriter, r *http.Request, promo *models.Promotion, redemptions []models.Redemption, flash string) {
+	products, err := app.Products.All()
+	if err != nil {
+		log.Println(err)
+	}
+
+	data := &models.TemplateData{
+		Title:       "Promotion",
+		Promotion:   promo,
+		Redemptions: redemptions,
+		Products:    products,
+		Flash:       flash,
+		IsAdmin:     true,
+	}
+
+	app.render(w, r, "admin/promotion_form.page.html", data)
+}
+
+// adminSavePromotionHandler adds a promotion, or updates one when the form has an id
+func (app *Application) adminSavePromotionHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Bad Request", 400)
+		return
+	}
+
+	promo, problem := promotionFromForm(r)
+	if problem != "" {
+		app.renderPromotionForm(w, r, promo, nil, problem)
+		return
+	}
+
+	var err error
+	if promo.ID == 0 {
+		_, err = app.Promos.Insert(promo)
+	} else {
+		err = app.Promos.Update(promo)
+	}
+	if errors.Is(err, repository.ErrDuplicateCode) {
+		app.renderPromotionForm(w, r, promo, nil, "Another promotion already uses the code "+promo.Code+".")
+		return
+	}
+	if err != nil {
+		log.Println("Error saving promotion:", err)
+		http.Error(w, "Server Error", 500)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/promotions?msg=saved", http.StatusSeeOther)
+}
+
+// adminTogglePromotionHandler switches a code on or off, e.g. when a promotion ends early
+func (app *Application) adminTogglePromotionHandler(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(r.FormValue("id"))
+	if err := app.Promos.SetActive(id, r.FormValue("active") == "true"); err != nil {
+		log.Println("Error switching promotion:", err)
+	}
+	http.Redirect(w, r, "/admin/promotions", http.StatusSeeOther)
+}
+
+func (app *Application) adminDeletePromotionHandler(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(r.FormValue("id"))
+	if err := app.Promos.Delete(id); err != nil {
+		log.Println("Error deleting promotion:", err)
+		http.Error(w, "Server Error", 500)
+		return
+	}
+	http.Redirect(w, r, "/admin/promotions?msg=deleted", http.StatusSeeOther)
+}
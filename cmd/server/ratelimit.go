@@ -0,0 +1,48 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter allows a fixed number of hits per key (an IP, an order number)
+// in each window. It lives in memory, so limits reset when the server restarts.
+type rateLimiter struct {
+	mu     sync.Mutex
+	limit  int
+	window time.Duration
+	hits   map[string]*rateWindow
+}
+
+type rateWindow struct {
+	start time.Time
+	count int
+}
+
+func newRateLimiter(limit int, window time.Duration) *rateLimiter {
+	return &rateLimiter{limit: limit, window: window, hits: make(map[string]*rateWindow)}
+}
+
+// Allow records a hit for key and reports whether it is within the limit
+func (l *rateLimiter) Allow(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	// Forget windows that have ended so the map doesn't grow forever
+	if len(l.hits) > 10000 {
+		for k, w := range l.hits {
+			if now.Sub(w.start) >= l.window {
+				delete(l.hits, k)
+			}
+		}
+	}
+
+	w, ok := l.hits[key]
+	if !ok || now.Sub(w.start) >= l.window {
+		l.hits[key] = &rateWindow{start: now, count: 1}
+		return true
+	}
+	w.count++
+	return w.count <= l.limit
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"time"
+
+	"crave-and-glaze/internal/daraja"
+	"crave-and-glaze/internal/repository"
+)
+
+// runReconciler periodically asks Safaricom about STK Pushes that never got a
+// callback (Render cold starts, a stale ngrok URL...) and settles them the same
+// way mpesaCallbackHandler would, so orders don't sit in PENDING forever.
+func (app *Application) runReconciler(interval, olderThan time.Duration) {
+	log.Printf("Payment reconciler running every %s for attempts older than %s", interval, olderThan)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		app.reconcilePendingPayments(olderThan)
+	}
+}
+
+// reconcilePendingPayments runs one pass over the stale PENDING attempts
+func (app *Application) reconcilePendingPayments(olderThan time.Duration) {
+	attempts, err := app.Payments.StalePending(olderThan)
+	if err != nil {
+		log.Println("Reconciler: error loading pending attempts:", err)
+		return
+	}
+
+	for _, a := range attempts {
+		result, err := app.Mpesa.QuerySTKPush(a.CheckoutRequestID)
+		if errors.Is(err, daraja.ErrQueryPending) {
+			continue // Customer hasn't answered the prompt yet, try again next tick
+		}
+		if err != nil {
+			log.Printf("Reconciler: query failed for order #%d: %v", a.OrderID, err)
+			continue
+		}
+
+		// STK Query carries no receipt. The payment shows as "receipt pending" on the
+		// admin order page until a late callback fills it in or an admin enters it.
+		orderID, err := app.Payments.Settle(a.CheckoutRequestID, result.Code(), result.ResultDesc, "", 0)
+		if errors.Is(err, repository.ErrAttemptSettled) {
+			continue // The callback beat us to it
+		}
+		if errors.Is(err, repository.ErrPaymentRefunded) {
+			log.Printf("Reconciler: order #%d was paid after it stopped taking payments, refund requested", orderID)
+			continue
+		}
+		if err != nil {
+			log.Printf("Reconciler: error settling order #%d: %v", a.OrderID, err)
+			continue
+		}
+
+		if result.Code() != 0 {
+			log.Printf("Reconciler: order #%d FAILED. Code: %d (%s)", orderID, result.Code(), result.ResultDesc)
+			continue
+		}
+
+		log.Printf("Reconciler: order #%d PAID (M-Pesa receipt pending)", orderID)
+		app.sendPaymentEmails(orderID, a.PhoneNumber, "")
+	}
+}
+
+// envDuration reads a duration like "90s" or "5m" from the environment
+func envDuration(key string, fallback time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		log.Printf("Warning: invalid %s=%q, using %s", key, value, fallback)
+		return fallback
+	}
+	return d
+}
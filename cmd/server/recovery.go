@@ -0,0 +1,293 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"crave-and-glaze/internal/cart"
+	"crave-and-glaze/internal/models"
+)
+
+// recoveryWindow is how long after the customer was last active we keep
+// reminding them. Unpaid orders older than this are not picked up at all.
+const recoveryWindow = 7 * 24 * time.Hour
+
+// reminderDelaysFromEnv reads the reminder sequence from RECOVERY_REMINDERS,
+// e.g. "1h,24h,72h": one email per entry, that long after the customer left.
+// "off" sends none.
+func reminderDelaysFromEnv() ([]time.Duration, error) {
+	value := strings.TrimSpace(os.Getenv("RECOVERY_REMINDERS"))
+	switch value {
+	case "":
+		value = "1h,24h,72h"
+	case "off":
+		return nil, nil
+	}
+
+	var delays []time.Duration
+	for _, entry := range strings.Split(value, ",") {
+		d, err := time.ParseDuration(strings.TrimSpace(entry))
+		if err != nil {
+			return nil, fmt.Errorf("RECOVERY_REMINDERS: %w", err)
+		}
+		if len(delays) > 0 && d <= delays[len(delays)-1] {
+			return nil, fmt.Errorf("RECOVERY_REMINDERS: %s must come after %s", d, delays[len(delays)-1])
+		}
+		if d <= 0 || d >= recoveryWindow {
+			return nil, fmt.Errorf("RECOVERY_REMINDERS: %s must be between 0 and %s", d, recoveryWindow)
+		}
+		delays = append(delays, d)
+	}
+	return delays, nil
+}
+
+// runRecovery periodically emails customers who left a cart at checkout or
+// never paid for their order, and deletes carts past their lifetime. The
+// links in the emails need SITE_URL.
+func (app *Application) runRecovery(interval time.Duration) {
+	siteURL := strings.TrimRight(os.Getenv("SITE_URL"), "/")
+	remind := len(app.ReminderDelays) > 0 && siteURL != ""
+	if remind {
+		log.Printf("Cart reminders running every %s, sent after %v", interval, app.ReminderDelays)
+	} else {
+		log.Println("Cart reminders are off (needs RECOVERY_REMINDERS and SITE_URL)")
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		// Expired carts go either way, so the carts table doesn't grow forever
+		if n, err := cart.DeleteExpired(); err != nil {
+			log.Println("Recovery: error deleting expired carts:", err)
+		} else if n > 0 {
+			log.Printf("Recovery: deleted %d expired carts", n)
+		}
+
+		if remind {
+			app.sendReminders(siteURL)
+		}
+	}
+}
+
+// sendReminders runs one pass: it picks up new unpaid orders, stops the
+// reminders that are no longer wanted and sends the ones that are due
+func (app *Application) sendReminders(siteURL string) {
+	delays := app.ReminderDelays
+	if err := app.Recovery.Refresh(recoveryWindow, len(delays)); err != nil {
+		log.Println("Recovery: error refreshing reminders:", err)
+		return
+	}
+	open, err := app.Recovery.Open()
+	if err != nil {
+		log.Println("Recovery: error loading reminders:", err)
+		return
+	}
+
+	for i := range open {
+		rec := &open[i]
+
+		// The latest step that is due; any earlier ones we missed are skipped
+		step := -1
+		for s := rec.Step; s < len(delays) && time.Since(rec.StepSince) >= delays[s]; s++ {
+			step = s
+		}
+		if step < 0 {
+			continue
+		}
+
+		sent, err := app.sendReminder(siteURL, rec, step == len(delays)-1)
+		if err != nil {
+			log.Printf("Recovery: error emailing reminder #%d: %v", rec.ID, err)
+			continue
+		}
+		if !sent {
+			continue // Nothing went out, so the step is not used up
+		}
+		if err := app.Recovery.MarkSent(rec.ID, rec.Step, step); err != nil {
+			log.Printf("Recovery: error saving reminder #%d: %v", rec.ID, err)
+		}
+	}
+}
+
+// sendReminder emails one reminder, listing what is in the cart or order.
+// sent is false when the cart turned out to be empty and nothing went out.
+func (app *Application) sendReminder(siteURL string, rec *models.CartRecovery, last bool) (sent bool, err error) {
+	emailData := struct {
+		Name       string
+		Code       string // Set for unpaid orders
+		Items      interface{}
+		Total      float64
+		Last       bool
+		RestoreURL string
+		StopURL    string
+	}{
+		Last:       last,
+		RestoreURL: siteURL + "/cart/restore?t=" + rec.Token,
+		StopURL:    siteURL + "/reminders/stop?t=" + rec.Token,
+	}
+
+	subject := "You left some cakes in your cart"
+	if rec.Order != nil {
+		items, err := app.Orders.GetOrderItems(rec.OrderID)
+		if err != nil {
+			return false, err
+		}
+		emailData.Name = rec.Order.FirstName
+		emailData.Code = rec.Order.PublicCode
+		emailData.Items = items
+		emailData.Total = rec.Order.TotalAmount
+		subject = "Your order " + rec.Order.PublicCode + " is waiting for payment"
+	} else {
+		items, err := cart.Load(rec.CartID)
+		if err != nil {
+			return false, err
+		}
+		if len(items) == 0 {
+			return false, nil // Emptied since the last pass; the next Refresh closes it
+		}
+		emailData.Items = items
+		emailData.Total = cart.Total(items)
+	}
+	if last {
+		subject = "Last reminder: " + subject
+	}
+
+	if err := app.Mailer.Send(rec.Email, subject, "cart_reminder.html", emailData); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// restoreCartHandler is the link in a reminder email. It brings back the cart
+// the customer left, or takes them to pay for the order they placed.
+func (app *Application) restoreCartHandler(w http.ResponseWriter, r *http.Request) {
+	rec, err := app.Recovery.ByToken(r.URL.Query().Get("t"))
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Redirect(w, r, "/cart", http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		log.Println("Error loading reminder:", err)
+		http.Error(w, "Server Error", 500)
+		return
+	}
+
+	if rec.Order != nil {
+		order, err := app.Orders.Get(rec.OrderID)
+		if err != nil {
+			http.Error(w, "Order not found", 404)
+			return
+		}
+		switch order.Status {
+		case models.StatusPendingPayment:
+			http.Redirect(w, r, "/payment?ref="+order.PublicToken, http.StatusSeeOther)
+		case models.StatusFailed:
+			http.Redirect(w, r, "/payment-failed?ref="+order.PublicToken, http.StatusSeeOther)
+		case models.StatusCancelled:
+			http.Redirect(w, r, "/order/cancel?ref="+order.PublicToken, http.StatusSeeOther)
+		default:
+			http.Redirect(w, r, "/order-confirmed?ref="+order.PublicToken, http.StatusSeeOther)
+		}
+		return
+	}
+
+	if err := cart.Restore(w, r, rec.CartID); err != nil {
+		log.Println("Error restoring cart:", err)
+		http.Error(w, "Server Error", 500)
+		return
+	}
+	http.Redirect(w, r, "/cart", http.StatusSeeOther)
+}
+
+// stopRemindersHandler is the unsubscribe link in a reminder email
+func (app *Application) stopRemindersHandler(w http.ResponseWriter, r *http.Request) {
+	rec, err := app.Recovery.ByToken(r.URL.Query().Get("t"))
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		log.Println("Error loading reminder:", err)
+		http.Error(w, "Server Error", 500)
+		return
+	}
+
+	data := &models.TemplateData{
+		Title: "Reminders",
+		Flash: "We couldn't find that link. If you keep getting reminders, just reply to one and we'll stop them.",
+	}
+	if rec != nil {
+		if err := app.Recovery.OptOut(rec.Email); err != nil {
+			log.Println("Error opting out of reminders:", err)
+			http.Error(w, "Server Error", 500)
+			return
+		}
+		data.Flash = "Done. We won't send " + rec.Email + " any more reminders about carts or unpaid orders."
+	}
+
+	app.render(w, r, "reminders_stopped.page.html", data)
+}
+
+// checkoutEmailHandler remembers the email of a checkout visitor who ticked
+// "remind me", so we can remind them about their cart if they leave without
+// ordering. Unticking it forgets the cart again.
+func (app *Application) checkoutEmailHandler(w http.ResponseWriter, r *http.Request) {
+	email := strings.TrimSpace(r.FormValue("email"))
+	id := cart.ID(r)
+	if id == "" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	// Each call can send someone an email, so limit them per visitor and per cart
+	if !app.EmailLimiter.Allow("ip:"+app.clientIP(r)) || !app.EmailLimiter.Allow("cart:"+id) {
+		http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+		return
+	}
+
+	var err error
+	if r.FormValue("remind") != "yes" {
+		err = app.Recovery.ForgetCart(id)
+	} else if strings.Contains(email, "@") && len(email) <= 255 {
+		err = app.Recovery.TrackCart(id, email, cart.Total(cart.Get(r)))
+	}
+	if err != nil {
+		log.Println("Error tracking cart:", err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// adminRecoveryHandler reports how many carts and unpaid orders the reminder
+// emails brought back, and what they were worth
+func (app *Application) adminRecoveryHandler(w http.ResponseWriter, r *http.Request) {
+	days, err := strconv.Atoi(r.URL.Query().Get("days"))
+	if err != nil || days < 1 || days > 365 {
+		days = 30
+	}
+
+	report, err := app.Recovery.Report(days)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Server Error", 500)
+		return
+	}
+	recent, err := app.Recovery.Recent(50)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Server Error", 500)
+		return
+	}
+
+	data := &models.TemplateData{
+		Title:      "Cart Reminders",
+		Recovery:   report,
+		Recoveries: recent,
+		IsAdmin:    true,
+	}
+
+	app.render(w, r, "admin/recovery.page.html", data)
+}
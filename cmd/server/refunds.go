@@ -0,0 +1,321 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"crave-and-glaze/internal/daraja"
+	"crave-and-glaze/internal/models"
+	"crave-and-glaze/internal/repository"
+)
+
+// adminRefundHandler refunds a paid order from the admin order page.
+// A Reversal returns the original M-Pesa payment; B2C sends money to the
+// customer's M-Pesa number (used when the payment is too old to reverse).
+func (app *Application) adminRefundHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Bad Request", 400)
+		return
+	}
+
+	orderID, _ := strconv.Atoi(r.FormValue("order_id"))
+	amount, _ := strconv.ParseFloat(r.FormValue("amount"), 64)
+	reason := strings.TrimSpace(r.FormValue("reason"))
+	method := r.FormValue("method")
+
+	back := func(msg string) {
+		http.Redirect(w, r, fmt.Sprintf("/admin/orders/view?id=%d&msg=%s", orderID, url.QueryEscape(msg)), http.StatusSeeOther)
+	}
+
+	if reason == "" {
+		back("Please give a reason for the refund.")
+		return
+	}
+	// M-Pesa only moves whole shillings, and we record exactly what it sends
+	if amount <= 0 || amount != math.Trunc(amount) {
+		back("Please enter the refund in whole shillings.")
+		return
+	}
+	if method != "REVERSAL" && method != "B2C" {
+		back("Please choose a refund method.")
+		return
+	}
+	if !app.Mpesa.RefundsEnabled() {
+		back(daraja.ErrRefundsDisabled.Error())
+		return
+	}
+
+	order, err := app.Orders.Get(orderID)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	// A reversal returns the one payment behind the order's receipt; the rest
+	// of an order paid in several goes to the customer's number by B2C
+	parts := []models.Refund{{OrderID: orderID, Method: method, Amount: amount, Reason: reason}}
+	if method == "REVERSAL" {
+		reversible, err := app.reversible(order)
+		if err != nil {
+			log.Println("Error checking what can be reversed:", err)
+			http.Error(w, "Server Error", 500)
+			return
+		}
+		if reversible <= 0 {
+			back("This order has no M-Pesa payment left to reverse. Use a B2C refund instead.")
+			return
+		}
+		if amount > reversible {
+			parts[0].Amount = reversible
+			parts = append(parts, models.Refund{OrderID: orderID, Method: "B2C", Amount: amount - reversible, Reason: reason})
+		}
+	}
+
+	// 1. Reserve the refunds first so the amount can't be refunded twice
+	for i := range parts {
+		id, err := app.Refunds.Create(&parts[i])
+		if err != nil && i > 0 {
+			// Don't leave half a refund reserved
+			app.Refunds.Fail(parts[0].ID, "not sent: the B2C part could not be reserved")
+		}
+		switch {
+		case errors.Is(err, repository.ErrNotRefundable):
+			back("Only paid orders can be refunded.")
+			return
+		case errors.Is(err, repository.ErrRefundTooLarge):
+			back("That amount is more than is left to refund on this order.")
+			return
+		case errors.Is(err, repository.ErrReversalTooLarge):
+			back("That is more than is left of the M-Pesa payment to reverse. Use a B2C refund instead.")
+			return
+		case err != nil:
+			log.Println("Error creating refund:", err)
+			http.Error(w, "Server Error", 500)
+			return
+		}
+		parts[i].ID = id
+	}
+
+	// 2. Ask Safaricom to move the money
+	failed := false
+	for _, p := range parts {
+		if err := app.sendRefund(order, p.ID, p.Method, p.Amount, p.Reason); err != nil {
+			failed = true
+		}
+	}
+	if failed {
+		back("M-Pesa rejected the refund request. See the refund list for details.")
+		return
+	}
+
+	if len(parts) > 1 {
+		back(fmt.Sprintf("Refund requested: KES %.0f by reversal and KES %.0f to the customer's M-Pesa number. It will show as completed once M-Pesa confirms it.", parts[0].Amount, parts[1].Amount))
+		return
+	}
+	back("Refund requested. It will show as completed once M-Pesa confirms it.")
+}
+
+// reversible is how much of a refund can go back by reversing the order's
+// M-Pesa receipt, in whole shillings; 0 if it has none
+func (app *Application) reversible(order *models.Order) (float64, error) {
+	if order.MpesaReceipt == "" {
+		return 0, nil
+	}
+	left, err := app.Refunds.Reversible(order.ID)
+	return math.Floor(left), err
+}
+
+// adminSendRefundHandler sends a refund the customer was promised when they
+// cancelled online, by the method the admin picks
+func (app *Application) adminSendRefundHandler(w http.ResponseWriter, r *http.Request) {
+	orderID, _ := strconv.Atoi(r.FormValue("order_id"))
+	refundID, _ := strconv.Atoi(r.FormValue("refund_id"))
+	method := r.FormValue("method")
+
+	back := func(msg string) {
+		http.Redirect(w, r, fmt.Sprintf("/admin/orders/view?id=%d&msg=%s", orderID, url.QueryEscape(msg)), http.StatusSeeOther)
+	}
+
+	if method != "REVERSAL" && method != "B2C" {
+		back("Please choose a refund method.")
+		return
+	}
+	if !app.Mpesa.RefundsEnabled() {
+		back(daraja.ErrRefundsDisabled.Error())
+		return
+	}
+
+	order, err := app.Orders.Get(orderID)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	var reversible float64
+	if method == "REVERSAL" {
+		if reversible, err = app.reversible(order); err != nil {
+			log.Println("Error checking what can be reversed:", err)
+			http.Error(w, "Server Error", 500)
+			return
+		}
+		if reversible <= 0 {
+			back("This order has no M-Pesa payment left to reverse. Use a B2C refund instead.")
+			return
+		}
+	}
+
+	// Claim it first so two admins can't both send it
+	refund, err := app.Refunds.Start(refundID, method)
+	if errors.Is(err, repository.ErrRefundNotRequested) || (err == nil && refund.OrderID != orderID) {
+		back("That refund has already been sent.")
+		return
+	}
+	if err != nil {
+		log.Println("Error starting refund:", err)
+		http.Error(w, "Server Error", 500)
+		return
+	}
+
+	// Reverse what the receipt covers and send the rest to the customer's number
+	rest := &models.Refund{Method: "B2C", Reason: refund.Reason}
+	if method == "REVERSAL" && refund.Amount > reversible {
+		rest.ID, err = app.Refunds.Split(refund.ID, reversible)
+		if err != nil {
+			log.Println("Error splitting refund:", err)
+			app.Refunds.Fail(refund.ID, "not sent: "+err.Error())
+			back("The refund could not be split between a reversal and B2C. See the refund list for details.")
+			return
+		}
+		rest.Amount = refund.Amount - reversible
+		refund.Amount = reversible
+	}
+
+	failed := app.sendRefund(order, refund.ID, method, refund.Amount, refund.Reason) != nil
+	if rest.ID != 0 && app.sendRefund(order, rest.ID, rest.Method, rest.Amount, rest.Reason) != nil {
+		failed = true
+	}
+	if failed {
+		back("M-Pesa rejected the refund request. See the refund list for details.")
+		return
+	}
+
+	back("Refund requested. It will show as completed once M-Pesa confirms it.")
+}
+
+// sendRefund asks Safaricom to move the money for a PENDING refund. A rejected
+// request marks the refund FAILED; otherwise the result arrives later on
+// /api/callback/mpesa/refund/result/{token}.
+func (app *Application) sendRefund(order *models.Order, refundID int, method string, amount float64, reason string) error {
+	remarks := fmt.Sprintf("Refund Order-%d: %s", order.ID, reason)
+
+	// Only Safaricom gets the URL with this token, so only it can settle the refund
+	token, err := app.Refunds.IssueToken(refundID)
+	if err != nil {
+		log.Printf("Refund #%d for order #%d not sent: %v", refundID, order.ID, err)
+		app.Refunds.Fail(refundID, err.Error())
+		return err
+	}
+
+	var resp *daraja.AsyncResponse
+	if method == "REVERSAL" {
+		resp, err = app.Mpesa.ReverseTransaction(order.MpesaReceipt, amount, remarks, token)
+	} else {
+		resp, err = app.Mpesa.B2CPayment(daraja.FormatPhone(order.CustomerPhone), amount, remarks, token)
+	}
+	if err != nil {
+		log.Printf("Refund #%d for order #%d rejected: %v", refundID, order.ID, err)
+		app.Refunds.Fail(refundID, err.Error())
+		return err
+	}
+
+	if err := app.Refunds.SetConversation(refundID, resp.OriginatorConversationID, resp.ConversationID); err != nil {
+		log.Println("Error saving refund conversation IDs:", err)
+	}
+	return nil
+}
+
+// mpesaRefundResultHandler receives the async result of a Reversal or B2C request
+func (app *Application) mpesaRefundResultHandler(w http.ResponseWriter, r *http.Request) {
+	raw, err := io.ReadAll(r.Body)
+	if err != nil {
+		rejectCallback(w, r, "", "unreadable body")
+		return
+	}
+
+	var callback models.MpesaResultResponse
+	if err := json.Unmarshal(raw, &callback); err != nil {
+		rejectCallback(w, r, "", "invalid JSON: "+err.Error())
+		return
+	}
+
+	app.applyRefundResult(w, r, callback.Result, string(raw))
+}
+
+// mpesaRefundTimeoutHandler is called when Safaricom gives up on a queued refund
+func (app *Application) mpesaRefundTimeoutHandler(w http.ResponseWriter, r *http.Request) {
+	raw, err := io.ReadAll(r.Body)
+	if err != nil {
+		rejectCallback(w, r, "", "unreadable body")
+		return
+	}
+
+	var callback models.MpesaResultResponse
+	if err := json.Unmarshal(raw, &callback); err != nil {
+		rejectCallback(w, r, "", "invalid JSON: "+err.Error())
+		return
+	}
+
+	// A queue timeout carries no ResultCode of its own, so force a failure
+	result := callback.Result
+	if result.ResultCode == 0 {
+		result.ResultCode = -1
+	}
+	if result.ResultDesc == "" {
+		result.ResultDesc = "Request timed out in the M-Pesa queue"
+	}
+
+	app.applyRefundResult(w, r, result, string(raw))
+}
+
+// applyRefundResult settles the refund a result is for, once the token in the
+// URL matches the one that refund was sent with
+func (app *Application) applyRefundResult(w http.ResponseWriter, r *http.Request, result models.MpesaResult, raw string) {
+	ref := result.ConversationID
+	refund, err := app.Refunds.ByConversation(result.ConversationID, result.OriginatorConversationID)
+	if errors.Is(err, repository.ErrUnknownRefund) {
+		rejectCallback(w, r, ref, "unknown ConversationID")
+		return
+	}
+	if err != nil {
+		log.Println("Error loading refund:", err)
+		http.Error(w, "Server Error", 500)
+		return
+	}
+	token := r.PathValue("token")
+	if refund.CallbackToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(refund.CallbackToken)) != 1 {
+		rejectCallback(w, r, ref, fmt.Sprintf("callback token does not match refund #%d (order #%d)", refund.ID, refund.OrderID))
+		return
+	}
+
+	orderID, err := app.Refunds.ApplyResult(refund.ID, result, raw)
+	switch {
+	case errors.Is(err, repository.ErrRefundSettled):
+		acceptCallback(w, r, ref, fmt.Sprintf("already settled (order #%d), ignored", orderID))
+		return
+	case err != nil:
+		log.Println("Error applying refund result:", err)
+		http.Error(w, "Server Error", 500)
+		return
+	}
+
+	log.Printf("Refund result for order #%d: %d (%s)", orderID, result.ResultCode, result.ResultDesc)
+	acceptCallback(w, r, ref, fmt.Sprintf("order #%d refund: %s", orderID, result.ResultDesc))
+}
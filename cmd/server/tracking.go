@@ -0,0 +1,95 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+
+	"crave-and-glaze/internal/daraja"
+	"crave-and-glaze/internal/models"
+)
+
+// trackNotFound is shown for an unknown order and for a wrong phone alike, so
+// the page can't be used to find out which order numbers exist
+const trackNotFound = "We couldn't find an order with that number and phone. Please check both and try again."
+
+// trackOrderPageHandler shows the "Track my order" form
+func (app *Application) trackOrderPageHandler(w http.ResponseWriter, r *http.Request) {
+	app.render(w, r, "track.page.html", &models.TemplateData{Title: "Track My Order"})
+}
+
+// trackOrderHandler looks an order up by its code and the phone it was placed with
+func (app *Application) trackOrderHandler(w http.ResponseWriter, r *http.Request) {
+	data := &models.TemplateData{Title: "Track My Order"}
+
+	code := strings.TrimSpace(r.FormValue("code"))
+	phone := strings.TrimSpace(r.FormValue("phone"))
+
+	if code == "" || phone == "" {
+		data.Flash = "Please enter your order number and phone number."
+		app.render(w, r, "track.page.html", data)
+		return
+	}
+
+	// Anything that isn't an order code can't match, so it costs no guesses
+	code, ok := models.ParsePublicCode(code)
+	if !ok {
+		data.Flash = trackNotFound
+		app.render(w, r, "track.page.html", data)
+		return
+	}
+
+	// Limit guesses per visitor and per order, whichever runs out first. The
+	// order is keyed by its canonical code, however it was typed.
+	if !app.TrackLimiter.Allow("ip:"+app.clientIP(r)) || !app.TrackLimiter.Allow("order:"+code) {
+		w.WriteHeader(http.StatusTooManyRequests)
+		data.Flash = "Too many lookups. Please wait a few minutes and try again."
+		app.render(w, r, "track.page.html", data)
+		return
+	}
+
+	order, err := app.Orders.GetByCode(code)
+	if err != nil || !samePhone(phone, order.CustomerPhone, order.WhatsappNumber) {
+		data.Flash = trackNotFound
+		app.render(w, r, "track.page.html", data)
+		return
+	}
+
+	items, err := app.Orders.GetOrderItems(order.ID)
+	if err != nil {
+		log.Println(err)
+	}
+	history, err := app.Orders.History(order.ID)
+	if err != nil {
+		log.Println(err)
+	}
+
+	data.Order = order
+	data.OrderItems = items
+	data.History = customerHistory(history)
+	app.render(w, r, "track.page.html", data)
+}
+
+// samePhone reports whether phone is one of the numbers on the order,
+// however either was typed
+func samePhone(phone string, numbers ...string) bool {
+	want := daraja.FormatPhone(phone)
+	for _, n := range numbers {
+		if n != "" && daraja.FormatPhone(n) == want {
+			return true
+		}
+	}
+	return false
+}
+
+// customerHistory keeps the actual status changes, dropping notes the
+// kitchen added along the way (payments, partial refunds)
+func customerHistory(history []models.OrderStatusChange) []models.OrderStatusChange {
+	var changes []models.OrderStatusChange
+	for _, c := range history {
+		if c.FromStatus != c.ToStatus {
+			changes = append(changes, c)
+		}
+	}
+	return changes
+}
@@ -6,4 +6,4 @@ require github.com/lib/pq v1.10.9
 
 require github.com/joho/godotenv v1.5.1
 
-require golang.org/x/crypto v0.47.0 // indirect
+require golang.org/x/crypto v0.47.0
@@ -1,12 +1,66 @@
 package cart
 
 import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
-	"encoding/json"
+	"encoding/hex"
+	"fmt"
+	"log"
 	"net/http"
+	"strings"
 	"time"
 )
 
+// cookieName holds the signed ID of the visitor's cart; the lines themselves
+// live in the Store
+const cookieName = "crave_cart"
+
+// cartLifetime is how long a cart is kept after it was last changed
+const cartLifetime = 30 * 24 * time.Hour
+
+// store keeps the carts. Without SetStore they are kept in memory and lost
+// whenever the server restarts.
+var store Store = NewMemoryStore()
+
+// SetStore chooses where carts are kept, e.g. a PostgresStore
+func SetStore(s Store) {
+	store = s
+}
+
+// DeleteExpired removes the carts whose cookie has expired, if the store can,
+// returning how many went
+func DeleteExpired() (int64, error) {
+	p, ok := store.(Pruner)
+	if !ok {
+		return 0, nil
+	}
+	return p.DeleteSavedBefore(time.Now().Add(-cartLifetime))
+}
+
+// key signs the cart cookie so a made-up cart ID is turned away without a
+// lookup. Without SetKey it is random, and carts are lost whenever the server restarts.
+var key = func() []byte {
+	k := make([]byte, 32)
+	if _, err := rand.Read(k); err != nil {
+		panic(err)
+	}
+	return k
+}()
+
+// SetKey sets the secret the cart cookie is signed with (CART_SECRET)
+func SetKey(secret []byte) {
+	key = secret
+}
+
+// sign returns the HMAC of a cookie payload
+func sign(payload string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
 // Item represents one line in the shopping cart
 type Item struct {
 	VariantID   int
@@ -18,60 +72,165 @@ type Item struct {
 	Icing       string
 }
 
-// Get reads the cart from the cookie
-func Get(r *http.Request) []Item {
-	cookie, err := r.Cookie("crave_cart")
+// LineID identifies a line by what was ordered: the same cake with another
+// message or icing is a line of its own. Add new customisation options here.
+func (i Item) LineID() string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%d\x00%s\x00%s", i.VariantID, i.Icing, i.Message)))
+	return hex.EncodeToString(sum[:8])
+}
+
+// ID returns the visitor's cart ID from their cookie, or "" if they have no
+// cart yet. A cookie that has been tampered with (or signed with another key)
+// counts as no cart.
+func ID(r *http.Request) string {
+	cookie, err := r.Cookie(cookieName)
 	if err != nil {
+		return ""
+	}
+
+	// Check the signature before trusting anything in it
+	id, sig, ok := strings.Cut(cookie.Value, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(sign(id))) {
+		return ""
+	}
+	return id
+}
+
+// Get reads the visitor's cart
+func Get(r *http.Request) []Item {
+	id := ID(r)
+	if id == "" {
 		return []Item{} // Return empty cart if no cookie exists
 	}
 
-	// Decode Base64
-	data, err := base64.StdEncoding.DecodeString(cookie.Value)
+	items, err := store.Load(id)
 	if err != nil {
+		log.Println("Error loading cart:", err)
 		return []Item{}
 	}
-
-	// Unmarshal JSON
-	var items []Item
-	_ = json.Unmarshal(data, &items)
 	return items
 }
 
-// Add appends a new item to the cart and updates the cookie
+// Add appends a new item to the cart and saves it
 func Add(w http.ResponseWriter, r *http.Request, newItem Item) {
-	items := Get(r)
+	items := addItem(Get(r), newItem)
+	saveCart(w, r, items)
+}
 
-	// Check if item already exists (same variant), if so, just add quantity
-	found := false
+// addItem adds a line to a cart, or its quantity to an identical line
+func addItem(items []Item, newItem Item) []Item {
+	// Check if the line already exists (same cake, same options), if so, just add quantity
+	lineID := newItem.LineID()
 	for i, item := range items {
-		if item.VariantID == newItem.VariantID {
+		if item.LineID() == lineID {
 			items[i].Quantity += newItem.Quantity
-			found = true
-			break
+			return items
 		}
 	}
+	return append(items, newItem)
+}
 
-	if !found {
-		items = append(items, newItem)
+// Save replaces the whole cart, e.g. after checkout has refreshed its prices
+func Save(w http.ResponseWriter, r *http.Request, items []Item) {
+	saveCart(w, r, items)
+}
+
+// Clear empties the cart once it has become an order
+func Clear(w http.ResponseWriter, r *http.Request) {
+	if id := ID(r); id != "" {
+		if err := store.Delete(id); err != nil {
+			log.Println("Error clearing cart:", err)
+		}
 	}
+	http.SetCookie(w, &http.Cookie{
+		Name:   cookieName,
+		Value:  "",
+		Path:   "/",
+		MaxAge: -1,
+	})
+}
 
-	saveCart(w, items)
+// Merge moves the lines of one cart into another, e.g. the cart a customer
+// filled in before signing in into the one they already had. The first cart
+// is deleted.
+func Merge(fromID, intoID string) error {
+	if fromID == "" || fromID == intoID {
+		return nil
+	}
+	from, err := store.Load(fromID)
+	if err != nil {
+		return err
+	}
+	into, err := store.Load(intoID)
+	if err != nil {
+		return err
+	}
+	for _, item := range from {
+		into = addItem(into, item)
+	}
+	if err = store.Save(intoID, into); err != nil {
+		return err
+	}
+	return store.Delete(fromID)
 }
 
-// SaveCart writes the list back to the browser
-func saveCart(w http.ResponseWriter, items []Item) {
-	data, _ := json.Marshal(items)
-	encoded := base64.StdEncoding.EncodeToString(data)
+// Load reads a cart by its ID, e.g. to list it in a reminder email
+func Load(id string) ([]Item, error) {
+	return store.Load(id)
+}
 
+// Restore points the visitor's cookie at a cart they left, e.g. from the link
+// in a reminder email. Anything already in their current cart is added to it.
+func Restore(w http.ResponseWriter, r *http.Request, id string) error {
+	if err := Merge(ID(r), id); err != nil {
+		return err
+	}
+	items, err := store.Load(id)
+	if err != nil {
+		return err
+	}
+	if err = store.Save(id, items); err != nil {
+		return err
+	}
+	setCookie(w, id)
+	return nil
+}
+
+// saveCart stores the cart, starting a new one (and its cookie) for a
+// first-time visitor. The cookie is renewed on every change.
+func saveCart(w http.ResponseWriter, r *http.Request, items []Item) {
+	id := ID(r)
+	if id == "" {
+		id = newID()
+	}
+	if err := store.Save(id, items); err != nil {
+		log.Println("Error saving cart:", err)
+		return
+	}
+	setCookie(w, id)
+}
+
+// setCookie hands the visitor the signed ID of their cart
+func setCookie(w http.ResponseWriter, id string) {
 	http.SetCookie(w, &http.Cookie{
-		Name:     "crave_cart",
-		Value:    encoded,
+		Name:     cookieName,
+		Value:    id + "." + sign(id),
 		Path:     "/",
-		Expires:  time.Now().Add(24 * time.Hour), // Cart lasts 24 hours
-		HttpOnly: true,                           // Javascript cannot access this (Security)
+		Expires:  time.Now().Add(cartLifetime),
+		HttpOnly: true, // Javascript cannot access this (Security)
+		SameSite: http.SameSiteLaxMode,
 	})
 }
 
+// newID makes an opaque, unguessable cart ID
+func newID() string {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
 // Total calculates the total cost
 func Total(items []Item) float64 {
 	var total float64
@@ -81,27 +240,27 @@ func Total(items []Item) float64 {
 	return total
 }
 
-// Remove deletes an item by its VariantID
-func Remove(w http.ResponseWriter, r *http.Request, variantID int) {
+// Remove deletes a line by its LineID
+func Remove(w http.ResponseWriter, r *http.Request, lineID string) {
 	items := Get(r)
 	var newItems []Item
 
-	// Keep everything EXCEPT the one matching variantID
+	// Keep everything EXCEPT the one matching lineID
 	for _, item := range items {
-		if item.VariantID != variantID {
+		if item.LineID() != lineID {
 			newItems = append(newItems, item)
 		}
 	}
 
-	saveCart(w, newItems)
+	saveCart(w, r, newItems)
 }
 
-// UpdateQuantity changes the quantity of a specific item
-func UpdateQuantity(w http.ResponseWriter, r *http.Request, variantID int, change int) {
+// UpdateQuantity changes the quantity of a specific line
+func UpdateQuantity(w http.ResponseWriter, r *http.Request, lineID string, change int) {
 	items := Get(r)
 
 	for i, item := range items {
-		if item.VariantID == variantID {
+		if item.LineID() == lineID {
 			newQty := item.Quantity + change
 
 			// Ensure quantity doesn't go below 1
@@ -114,19 +273,19 @@ func UpdateQuantity(w http.ResponseWriter, r *http.Request, variantID int, chang
 		}
 	}
 
-	saveCart(w, items)
+	saveCart(w, r, items)
 }
 
-// RemoveItem completely deletes an item (You might already have something like this)
-func RemoveItem(w http.ResponseWriter, r *http.Request, variantID int) {
+// RemoveItem completely deletes a line (You might already have something like this)
+func RemoveItem(w http.ResponseWriter, r *http.Request, lineID string) {
 	items := Get(r)
 	var newItems []Item
 
 	for _, item := range items {
-		if item.VariantID != variantID {
+		if item.LineID() != lineID {
 			newItems = append(newItems, item)
 		}
 	}
 
-	saveCart(w, newItems)
+	saveCart(w, r, newItems)
 }
@@ -0,0 +1,87 @@
+package cart
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// PostgresStore keeps carts in the carts and cart_items tables, so they
+// survive restarts and can be picked up again days later
+type PostgresStore struct {
+	DB *sql.DB
+}
+
+func (s *PostgresStore) Load(id string) ([]Item, error) {
+	stmt := `
+		SELECT product_variant_id, product_name, image_url, price, quantity, custom_message, icing_flavor
+		FROM cart_items WHERE cart_id = $1 ORDER BY position ASC
+	`
+	rows, err := s.DB.Query(stmt, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []Item{}
+	for rows.Next() {
+		var i Item
+		err = rows.Scan(&i.VariantID, &i.ProductName, &i.ImageURL, &i.Price, &i.Quantity, &i.Message, &i.Icing)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	return items, rows.Err()
+}
+
+func (s *PostgresStore) Save(id string, items []Item) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO carts (id, created_at, updated_at) VALUES ($1, $2, $2)
+		ON CONFLICT (id) DO UPDATE SET updated_at = EXCLUDED.updated_at`,
+		id, time.Now(),
+	)
+	if err != nil {
+		return err
+	}
+
+	// The cart is small, so it is simplest to rewrite every line
+	if _, err = tx.ExecContext(ctx, `DELETE FROM cart_items WHERE cart_id = $1`, id); err != nil {
+		return err
+	}
+	for pos, i := range items {
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO cart_items (cart_id, position, product_variant_id, product_name, image_url, price, quantity, custom_message, icing_flavor)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+			id, pos, i.VariantID, i.ProductName, i.ImageURL, i.Price, i.Quantity, i.Message, i.Icing,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *PostgresStore) Delete(id string) error {
+	_, err := s.DB.Exec(`DELETE FROM carts WHERE id = $1`, id)
+	return err
+}
+
+// DeleteSavedBefore removes the carts last changed before t, and their lines
+func (s *PostgresStore) DeleteSavedBefore(t time.Time) (int64, error) {
+	res, err := s.DB.Exec(`DELETE FROM carts WHERE updated_at < $1`, t)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,55 @@
+package cart
+
+import (
+	"sync"
+	"time"
+)
+
+// Store keeps carts by ID. Saving an empty cart keeps the (empty) cart.
+type Store interface {
+	// Load returns the lines in a cart, or none if there is no such cart
+	Load(id string) ([]Item, error)
+	// Save replaces the lines in a cart, creating it if needed
+	Save(id string, items []Item) error
+	// Delete removes a cart
+	Delete(id string) error
+}
+
+// Pruner is a Store that can delete the carts last saved before a time.
+// Stores that aren't (MemoryStore) lose their carts on restart anyway.
+type Pruner interface {
+	DeleteSavedBefore(t time.Time) (int64, error)
+}
+
+// MemoryStore keeps carts in memory, for development and single-server setups
+// where losing carts on restart doesn't matter
+type MemoryStore struct {
+	mu    sync.Mutex
+	carts map[string][]Item
+}
+
+// NewMemoryStore makes an empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{carts: make(map[string][]Item)}
+}
+
+func (s *MemoryStore) Load(id string) ([]Item, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Hand out a copy so callers can't change the stored cart behind our back
+	return append([]Item{}, s.carts[id]...), nil
+}
+
+func (s *MemoryStore) Save(id string, items []Item) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.carts[id] = append([]Item{}, items...)
+	return nil
+}
+
+func (s *MemoryStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.carts, id)
+	return nil
+}
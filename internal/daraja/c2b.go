@@ -0,0 +1,87 @@
+package daraja
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// ErrC2BDisabled is returned when no C2B URL is configured
+var ErrC2BDisabled = errors.New("m-pesa C2B is not configured (set MPESA_C2B_URL)")
+
+// ErrStatusDisabled is returned when no initiator credentials are configured
+var ErrStatusDisabled = errors.New("m-pesa transaction status is not configured (set MPESA_INITIATOR_NAME and MPESA_SECURITY_CREDENTIAL)")
+
+// C2BEnabled reports whether we have somewhere for Safaricom to send C2B payments
+func (s *Service) C2BEnabled() bool {
+	return s.Config.C2BURL != ""
+}
+
+// RegisterC2BURLs tells Safaricom where to send payments customers make to our
+// shortcode from the M-Pesa menu. It only needs to run once per shortcode (and
+// again whenever the URLs change). The URLs carry C2BToken, so only Safaricom
+// knows where to post.
+func (s *Service) RegisterC2BURLs() error {
+	if !s.C2BEnabled() {
+		return ErrC2BDisabled
+	}
+
+	payload := map[string]string{
+		"ShortCode": s.Config.BusinessCode,
+		// If our validation URL is down, let the payment through rather than bounce it
+		"ResponseType":    "Completed",
+		"ConfirmationURL": s.Config.C2BURL + "/" + s.Config.C2BToken + "/confirmation",
+		"ValidationURL":   s.Config.C2BURL + "/" + s.Config.C2BToken + "/validation",
+	}
+
+	status, bodyBytes, err := s.postJSON("/mpesa/c2b/v1/registerurl", payload)
+	if err != nil {
+		return err
+	}
+	if status != 200 {
+		return fmt.Errorf("C2B Register Failed: %s", string(bodyBytes))
+	}
+
+	var result struct {
+		ResponseCode        string `json:"ResponseCode"`
+		ResponseDescription string `json:"ResponseDescription"`
+	}
+	if err := json.Unmarshal(bodyBytes, &result); err != nil {
+		return fmt.Errorf("C2B Register: bad response: %w", err)
+	}
+	// Safaricom answers "00000000" for success on this endpoint
+	if result.ResponseCode != "0" && result.ResponseCode != "00000000" {
+		return fmt.Errorf("C2B Register Rejected: %s", string(bodyBytes))
+	}
+	return nil
+}
+
+// StatusEnabled reports whether Transaction Status queries can be made. They
+// need the same API operator as refunds.
+func (s *Service) StatusEnabled() bool {
+	return s.Config.InitiatorName != "" && s.Config.SecurityCredential != ""
+}
+
+// TransactionStatus asks Safaricom about a payment by its receipt number, e.g.
+// to confirm a C2B confirmation is real before applying it. The answer arrives
+// later on StatusURL, which carries callbackToken.
+func (s *Service) TransactionStatus(transID, callbackToken string) (*AsyncResponse, error) {
+	if !s.StatusEnabled() {
+		return nil, ErrStatusDisabled
+	}
+
+	payload := map[string]interface{}{
+		"Initiator":          s.Config.InitiatorName,
+		"SecurityCredential": s.Config.SecurityCredential,
+		"CommandID":          "TransactionStatusQuery",
+		"TransactionID":      transID,
+		"PartyA":             s.Config.BusinessCode,
+		"IdentifierType":     "4", // 4 = organisation shortcode
+		"ResultURL":          s.Config.StatusURL + "/result/" + callbackToken,
+		"QueueTimeOutURL":    s.Config.StatusURL + "/timeout/" + callbackToken,
+		"Remarks":            "Confirm C2B payment",
+		"Occasion":           "C2B",
+	}
+
+	return s.postAsync("/mpesa/transactionstatus/v1/query", "Transaction Status", payload)
+}
@@ -4,50 +4,82 @@ import (
 	"bytes"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"strings"
+	"sync"
 	"time"
 )
 
-// MpesaConfig holds our keys
-type MpesaConfig struct {
-	ConsumerKey    string
-	ConsumerSecret string
-	BusinessCode   string // The Paybill (174379)
-	Passkey        string
-	CallbackURL    string // Where Safaricom sends the result
-}
+// tokenRefreshMargin renews the access token this long before Safaricom expires it
+const tokenRefreshMargin = 60 * time.Second
 
-// Service is the client we use in our app
+// Service is the client we use in our app.
+// It is safe for concurrent use by many request goroutines.
 type Service struct {
 	Config MpesaConfig
 	Client *http.Client
+
+	// Cached OAuth token. mu is held while refreshing, so concurrent callers
+	// wait for the one in-flight request instead of each fetching their own.
+	mu          sync.Mutex
+	token       string
+	tokenExpiry time.Time
 }
 
-// NewService creates a new instance
-func NewService(key, secret string) *Service {
+// NewService creates a new instance (see ConfigFromEnv)
+func NewService(cfg MpesaConfig) *Service {
 	return &Service{
-		Config: MpesaConfig{
-			ConsumerKey:    key,
-			ConsumerSecret: secret,
-			BusinessCode:   "174379",                                                           // Default Sandbox Paybill
-			Passkey:        "bfb279f9aa9bdbcf158e97dd71a467cd2e0c893059b10f78e6b72ada1ed2c919", // Default Sandbox Passkey
-			CallbackURL:    "https://e3d42c404fab.ngrok-free.app/api/callback",                 // Needs a real URL for callbacks to work
-		},
+		Config: cfg,
 		Client: &http.Client{Timeout: 30 * time.Second},
 	}
 }
 
 // 1. Get Access Token (Auth)
+// Returns the cached token, fetching a new one only when it is about to expire.
 func (s *Service) GetAccessToken() (string, error) {
-	url := "https://sandbox.safaricom.co.ke/oauth/v1/generate?grant_type=client_credentials"
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	req, err := http.NewRequest("GET", url, nil)
+	if s.token != "" && time.Now().Before(s.tokenExpiry) {
+		return s.token, nil
+	}
+
+	token, expiresIn, err := s.fetchAccessToken()
 	if err != nil {
 		return "", err
 	}
 
+	// Refresh a little early so a request never goes out with a token that dies in flight
+	margin := tokenRefreshMargin
+	if expiresIn <= 2*margin {
+		margin = expiresIn / 2
+	}
+
+	s.token = token
+	s.tokenExpiry = time.Now().Add(expiresIn - margin)
+	return s.token, nil
+}
+
+// InvalidateToken drops the cached token so the next call re-authenticates
+func (s *Service) InvalidateToken() {
+	s.mu.Lock()
+	s.token = ""
+	s.tokenExpiry = time.Time{}
+	s.mu.Unlock()
+}
+
+// fetchAccessToken calls /oauth/v1/generate
+func (s *Service) fetchAccessToken() (string, time.Duration, error) {
+	url := s.Config.BaseURL + "/oauth/v1/generate?grant_type=client_credentials"
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return "", 0, err
+	}
+
 	// Basic Auth: Base64(Key:Secret)
 	auth := s.Config.ConsumerKey + ":" + s.Config.ConsumerSecret
 	encodedAuth := base64.StdEncoding.EncodeToString([]byte(auth))
@@ -55,33 +87,84 @@ func (s *Service) GetAccessToken() (string, error) {
 
 	resp, err := s.Client.Do(req)
 	if err != nil {
-		return "", err
+		return "", 0, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != 200 {
 		body, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("auth failed: %s", string(body))
+		return "", 0, fmt.Errorf("auth failed: %s", string(body))
 	}
 
 	var result struct {
-		AccessToken string `json:"access_token"`
+		AccessToken string      `json:"access_token"`
+		ExpiresIn   json.Number `json:"expires_in"` // Seconds, sent as a string ("3599")
 	}
 	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return "", err
+		return "", 0, err
+	}
+	if result.AccessToken == "" {
+		return "", 0, errors.New("auth failed: empty access token")
+	}
+
+	seconds, err := result.ExpiresIn.Int64()
+	if err != nil || seconds <= 0 {
+		seconds = 3599 // Daraja tokens last an hour
 	}
 
-	return result.AccessToken, nil
+	return result.AccessToken, time.Duration(seconds) * time.Second, nil
 }
 
-// 2. Trigger STK Push
-func (s *Service) InitiateSTKPush(phoneNumber string, amount float64, orderID int) error {
+// postJSON sends an authenticated request to a Daraja endpoint and returns the raw reply.
+// A 401 means our cached token was revoked early, so it is dropped for the next call.
+func (s *Service) postJSON(path string, payload interface{}) (int, []byte, error) {
 	token, err := s.GetAccessToken()
 	if err != nil {
-		return err
+		return 0, nil, err
+	}
+
+	jsonData, err := json.Marshal(payload)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	req, err := http.NewRequest("POST", s.Config.BaseURL+path, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return 0, nil, err
 	}
 
-	url := "https://sandbox.safaricom.co.ke/mpesa/stkpush/v1/processrequest"
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		s.InvalidateToken()
+	}
+
+	bodyBytes, err := io.ReadAll(resp.Body)
+	return resp.StatusCode, bodyBytes, err
+}
+
+// STKPushResponse is what Safaricom sends back when it accepts an STK Push.
+// CheckoutRequestID is echoed in the callback, so we use it to find the order.
+type STKPushResponse struct {
+	MerchantRequestID   string `json:"MerchantRequestID"`
+	CheckoutRequestID   string `json:"CheckoutRequestID"`
+	ResponseCode        string `json:"ResponseCode"`
+	ResponseDescription string `json:"ResponseDescription"`
+	CustomerMessage     string `json:"CustomerMessage"`
+}
+
+// 2. Trigger STK Push
+// callbackToken is appended to CallbackURL so only Safaricom, who we gave the
+// URL to, can report a result for this order. accountRef is what the customer
+// sees on the prompt and their M-Pesa message (the order's public code).
+func (s *Service) InitiateSTKPush(phoneNumber string, amount float64, accountRef string, callbackToken string) (*STKPushResponse, error) {
 	timestamp := time.Now().Format("20060102150405")
 
 	// Password = Base64(Shortcode + Passkey + Timestamp)
@@ -93,36 +176,95 @@ func (s *Service) InitiateSTKPush(phoneNumber string, amount float64, orderID in
 		"BusinessShortCode": s.Config.BusinessCode,
 		"Password":          password,
 		"Timestamp":         timestamp,
-		"TransactionType":   "CustomerPayBillOnline",
+		"TransactionType":   s.Config.TransactionType,
 		"Amount":            int(amount), // Sandbox needs whole numbers
 		"PartyA":            phoneNumber, // The customer phone
-		"PartyB":            s.Config.BusinessCode,
+		"PartyB":            s.Config.PartyB,
 		"PhoneNumber":       phoneNumber,
-		"CallBackURL":       s.Config.CallbackURL,
-		"AccountReference":  fmt.Sprintf("Order-%d", orderID),
+		"CallBackURL":       strings.TrimRight(s.Config.CallbackURL, "/") + "/" + callbackToken,
+		"AccountReference":  accountRef,
 		"TransactionDesc":   "Payment for Cake",
 	}
 
-	jsonData, _ := json.Marshal(payload)
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
+	status, bodyBytes, err := s.postJSON("/mpesa/stkpush/v1/processrequest", payload)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if status != 200 {
+		return nil, fmt.Errorf("STK Push Failed: %s", string(bodyBytes))
 	}
 
-	req.Header.Set("Authorization", "Bearer "+token)
-	req.Header.Set("Content-Type", "application/json")
+	var result STKPushResponse
+	if err := json.Unmarshal(bodyBytes, &result); err != nil {
+		return nil, fmt.Errorf("STK Push: bad response: %w", err)
+	}
 
-	resp, err := s.Client.Do(req)
+	// ResponseCode "0" means Safaricom accepted the request and sent the prompt
+	if result.ResponseCode != "0" || result.CheckoutRequestID == "" {
+		return nil, fmt.Errorf("STK Push Rejected: %s", string(bodyBytes))
+	}
+
+	return &result, nil
+}
+
+// ErrQueryPending is returned by QuerySTKPush while the customer has not yet
+// answered the prompt (Safaricom's "The transaction is being processed")
+var ErrQueryPending = errors.New("stk push is still being processed")
+
+// STKQueryResponse is the outcome of an STK Push Query
+type STKQueryResponse struct {
+	ResponseCode        string      `json:"ResponseCode"`
+	ResponseDescription string      `json:"ResponseDescription"`
+	MerchantRequestID   string      `json:"MerchantRequestID"`
+	CheckoutRequestID   string      `json:"CheckoutRequestID"`
+	ResultCode          json.Number `json:"ResultCode"` // Sandbox sends "0", production sometimes sends 0
+	ResultDesc          string      `json:"ResultDesc"`
+}
+
+// Code returns the ResultCode as an int (0 = paid, anything else = failed)
+func (r *STKQueryResponse) Code() int {
+	code, err := r.ResultCode.Int64()
 	if err != nil {
-		return err
+		return -1
 	}
-	defer resp.Body.Close()
+	return int(code)
+}
 
-	bodyBytes, _ := io.ReadAll(resp.Body)
-	if resp.StatusCode != 200 {
-		return fmt.Errorf("STK Push Failed: %s", string(bodyBytes))
+// 3. Query the status of an earlier STK Push
+func (s *Service) QuerySTKPush(checkoutRequestID string) (*STKQueryResponse, error) {
+	timestamp := time.Now().Format("20060102150405")
+	password := base64.StdEncoding.EncodeToString([]byte(s.Config.BusinessCode + s.Config.Passkey + timestamp))
+
+	payload := map[string]interface{}{
+		"BusinessShortCode": s.Config.BusinessCode,
+		"Password":          password,
+		"Timestamp":         timestamp,
+		"CheckoutRequestID": checkoutRequestID,
+	}
+
+	status, bodyBytes, err := s.postJSON("/mpesa/stkpushquery/v1/query", payload)
+	if err != nil {
+		return nil, err
+	}
+	if status != 200 {
+		// Safaricom answers with an error body until the customer acts on the prompt
+		var apiErr struct {
+			ErrorCode    string `json:"errorCode"`
+			ErrorMessage string `json:"errorMessage"`
+		}
+		if json.Unmarshal(bodyBytes, &apiErr) == nil && apiErr.ErrorCode == "500.001.1001" {
+			return nil, ErrQueryPending
+		}
+		return nil, fmt.Errorf("STK Query Failed: %s", string(bodyBytes))
+	}
+
+	var result STKQueryResponse
+	if err := json.Unmarshal(bodyBytes, &result); err != nil {
+		return nil, fmt.Errorf("STK Query: bad response: %w", err)
+	}
+	if result.ResultCode == "" {
+		return nil, ErrQueryPending
 	}
 
-	// Success!
-	return nil
+	return &result, nil
 }
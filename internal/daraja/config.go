@@ -0,0 +1,250 @@
+package daraja
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Safaricom API hosts
+const (
+	SandboxBaseURL    = "https://sandbox.safaricom.co.ke"
+	ProductionBaseURL = "https://api.safaricom.co.ke"
+)
+
+// STK Push transaction types
+const (
+	PayBillOnline  = "CustomerPayBillOnline"  // Paybill: money goes to BusinessCode
+	BuyGoodsOnline = "CustomerBuyGoodsOnline" // Till: money goes to the till number in PartyB
+)
+
+// Public sandbox credentials published by Safaricom for testing
+const (
+	sandboxShortCode = "174379"
+	sandboxPasskey   = "bfb279f9aa9bdbcf158e97dd71a467cd2e0c893059b10f78e6b72ada1ed2c919"
+)
+
+// MpesaConfig holds our keys
+type MpesaConfig struct {
+	Environment     string // "sandbox" or "production"
+	BaseURL         string // Safaricom host, or a local mock in tests
+	ConsumerKey     string
+	ConsumerSecret  string
+	BusinessCode    string // The Paybill, or the Store number for a till
+	PartyB          string // Who receives the money: the Paybill, or the Till number
+	TransactionType string // PayBillOnline or BuyGoodsOnline
+	Passkey         string
+	CallbackURL     string // Where Safaricom sends the result
+
+	// Refunds (B2C and Reversal). Optional: refunds stay disabled without an initiator.
+	InitiatorName      string
+	SecurityCredential string // Initiator password encrypted with Safaricom's certificate
+	B2CShortCode       string // Shortcode refunds are paid from
+	ResultURL          string // Base URL; "/result/<token>" and "/timeout/<token>" are appended
+	StatusURL          string // Same, for Transaction Status results (verifying C2B payments)
+
+	// C2B (customers paying the Paybill/Till from their M-Pesa menu). Optional.
+	C2BURL   string // Base URL; "/<C2BToken>/validation" and "/<C2BToken>/confirmation" are appended
+	C2BToken string // Secret path segment, so only Safaricom knows where to post
+}
+
+// ConfigFromEnv builds the M-Pesa config from environment variables and validates it.
+//
+//	MPESA_ENV               sandbox (default) or production
+//	MPESA_BASE_URL          overrides the Safaricom host (e.g. a local mock)
+//	MPESA_KEY, MPESA_SECRET Daraja app credentials
+//	MPESA_SHORTCODE         Paybill or till Store number (sandbox default 174379)
+//	MPESA_TRANSACTION_TYPE  paybill (default) or till
+//	MPESA_TILL_NUMBER       till number receiving payments, required for till
+//	MPESA_PASSKEY           Lipa Na M-Pesa passkey (sandbox default provided)
+//	MPESA_CALLBACK_URL      public URL of /api/callback/mpesa
+//
+// Refunds are optional:
+//
+//	MPESA_INITIATOR_NAME, MPESA_SECURITY_CREDENTIAL  API operator for B2C/Reversal
+//	MPESA_B2C_SHORTCODE     shortcode refunds are paid from (defaults to MPESA_SHORTCODE)
+//	MPESA_RESULT_URL        public URL of /api/callback/mpesa/refund (derived from the callback URL)
+//	MPESA_STATUS_URL        public URL of /api/callback/mpesa/status (derived from the callback URL),
+//	                        where Transaction Status results confirming C2B payments arrive
+//
+// C2B is optional too:
+//
+//	MPESA_C2B_URL           public URL of /api/c2b. Safaricom refuses URLs containing "mpesa" or "safaricom".
+//	MPESA_C2B_TOKEN         random secret (at least 32 letters or digits) in the registered C2B URLs
+func ConfigFromEnv() (MpesaConfig, error) {
+	cfg := MpesaConfig{
+		Environment:     strings.ToLower(strings.TrimSpace(os.Getenv("MPESA_ENV"))),
+		BaseURL:         strings.TrimSpace(os.Getenv("MPESA_BASE_URL")),
+		ConsumerKey:     strings.TrimSpace(os.Getenv("MPESA_KEY")),
+		ConsumerSecret:  strings.TrimSpace(os.Getenv("MPESA_SECRET")),
+		BusinessCode:    strings.TrimSpace(os.Getenv("MPESA_SHORTCODE")),
+		PartyB:          strings.TrimSpace(os.Getenv("MPESA_TILL_NUMBER")),
+		TransactionType: strings.TrimSpace(os.Getenv("MPESA_TRANSACTION_TYPE")),
+		Passkey:         strings.TrimSpace(os.Getenv("MPESA_PASSKEY")),
+		CallbackURL:     strings.TrimSpace(os.Getenv("MPESA_CALLBACK_URL")),
+
+		InitiatorName:      strings.TrimSpace(os.Getenv("MPESA_INITIATOR_NAME")),
+		SecurityCredential: strings.TrimSpace(os.Getenv("MPESA_SECURITY_CREDENTIAL")),
+		B2CShortCode:       strings.TrimSpace(os.Getenv("MPESA_B2C_SHORTCODE")),
+		ResultURL:          strings.TrimSpace(os.Getenv("MPESA_RESULT_URL")),
+		StatusURL:          strings.TrimSpace(os.Getenv("MPESA_STATUS_URL")),
+
+		C2BURL:   strings.TrimSpace(os.Getenv("MPESA_C2B_URL")),
+		C2BToken: strings.TrimSpace(os.Getenv("MPESA_C2B_TOKEN")),
+	}
+
+	if cfg.Environment == "" {
+		cfg.Environment = "sandbox"
+	}
+
+	// Sandbox can run on Safaricom's published test paybill
+	if cfg.Environment == "sandbox" {
+		if cfg.BaseURL == "" {
+			cfg.BaseURL = SandboxBaseURL
+		}
+		if cfg.BusinessCode == "" {
+			cfg.BusinessCode = sandboxShortCode
+		}
+		if cfg.Passkey == "" {
+			cfg.Passkey = sandboxPasskey
+		}
+	}
+	if cfg.Environment == "production" && cfg.BaseURL == "" {
+		cfg.BaseURL = ProductionBaseURL
+	}
+
+	switch strings.ToLower(cfg.TransactionType) {
+	case "", "paybill", strings.ToLower(PayBillOnline):
+		cfg.TransactionType = PayBillOnline
+	case "till", "buygoods", strings.ToLower(BuyGoodsOnline):
+		cfg.TransactionType = BuyGoodsOnline
+	}
+
+	// For a Paybill the money goes to the shortcode itself
+	if cfg.TransactionType == PayBillOnline && cfg.PartyB == "" {
+		cfg.PartyB = cfg.BusinessCode
+	}
+
+	if cfg.B2CShortCode == "" {
+		cfg.B2CShortCode = cfg.BusinessCode
+	}
+	if cfg.ResultURL == "" && cfg.CallbackURL != "" {
+		cfg.ResultURL = strings.TrimRight(cfg.CallbackURL, "/") + "/refund"
+	}
+	if cfg.StatusURL == "" && cfg.CallbackURL != "" {
+		cfg.StatusURL = strings.TrimRight(cfg.CallbackURL, "/") + "/status"
+	}
+
+	cfg.BaseURL = strings.TrimRight(cfg.BaseURL, "/")
+	cfg.ResultURL = strings.TrimRight(cfg.ResultURL, "/")
+	cfg.StatusURL = strings.TrimRight(cfg.StatusURL, "/")
+	cfg.C2BURL = strings.TrimRight(cfg.C2BURL, "/")
+
+	return cfg, cfg.Validate()
+}
+
+// Validate reports every problem with the config at once so startup fails loudly
+func (c MpesaConfig) Validate() error {
+	var problems []error
+
+	if c.Environment != "sandbox" && c.Environment != "production" {
+		problems = append(problems, fmt.Errorf("MPESA_ENV must be sandbox or production, got %q", c.Environment))
+	}
+	if c.ConsumerKey == "" || c.ConsumerSecret == "" {
+		problems = append(problems, errors.New("MPESA_KEY and MPESA_SECRET are required"))
+	}
+	if err := checkURL(c.BaseURL, false); err != nil {
+		problems = append(problems, fmt.Errorf("MPESA_BASE_URL: %w", err))
+	}
+	if !isDigits(c.BusinessCode) {
+		problems = append(problems, fmt.Errorf("MPESA_SHORTCODE must be numeric, got %q", c.BusinessCode))
+	}
+	if c.Passkey == "" {
+		problems = append(problems, errors.New("MPESA_PASSKEY is required"))
+	}
+
+	switch c.TransactionType {
+	case PayBillOnline:
+	case BuyGoodsOnline:
+		if !isDigits(c.PartyB) {
+			problems = append(problems, fmt.Errorf("MPESA_TILL_NUMBER must be numeric for till payments, got %q", c.PartyB))
+		}
+	default:
+		problems = append(problems, fmt.Errorf("MPESA_TRANSACTION_TYPE must be paybill or till, got %q", c.TransactionType))
+	}
+
+	// Safaricom only delivers production callbacks over HTTPS
+	if err := checkURL(c.CallbackURL, c.Environment == "production"); err != nil {
+		problems = append(problems, fmt.Errorf("MPESA_CALLBACK_URL: %w", err))
+	}
+
+	if c.InitiatorName != "" || c.SecurityCredential != "" {
+		if c.InitiatorName == "" || c.SecurityCredential == "" {
+			problems = append(problems, errors.New("MPESA_INITIATOR_NAME and MPESA_SECURITY_CREDENTIAL must be set together"))
+		}
+		if !isDigits(c.B2CShortCode) {
+			problems = append(problems, fmt.Errorf("MPESA_B2C_SHORTCODE must be numeric, got %q", c.B2CShortCode))
+		}
+		if err := checkURL(c.ResultURL, c.Environment == "production"); err != nil {
+			problems = append(problems, fmt.Errorf("MPESA_RESULT_URL: %w", err))
+		}
+		if err := checkURL(c.StatusURL, c.Environment == "production"); err != nil {
+			problems = append(problems, fmt.Errorf("MPESA_STATUS_URL: %w", err))
+		}
+	}
+
+	if c.C2BURL != "" {
+		if err := checkURL(c.C2BURL, c.Environment == "production"); err != nil {
+			problems = append(problems, fmt.Errorf("MPESA_C2B_URL: %w", err))
+		}
+		lower := strings.ToLower(c.C2BURL)
+		if strings.Contains(lower, "mpesa") || strings.Contains(lower, "m-pesa") || strings.Contains(lower, "safaricom") {
+			problems = append(problems, fmt.Errorf("MPESA_C2B_URL must not contain \"mpesa\" or \"safaricom\" (Safaricom rejects it), got %q", c.C2BURL))
+		}
+		if len(c.C2BToken) < 32 || !isAlphanumeric(c.C2BToken) {
+			problems = append(problems, errors.New("MPESA_C2B_TOKEN must be a random string of at least 32 letters or digits when MPESA_C2B_URL is set"))
+		}
+	}
+
+	return errors.Join(problems...)
+}
+
+func checkURL(raw string, requireHTTPS bool) error {
+	if raw == "" {
+		return errors.New("is required")
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if u.Host == "" || (u.Scheme != "https" && u.Scheme != "http") {
+		return fmt.Errorf("%q is not an absolute http(s) URL", raw)
+	}
+	if requireHTTPS && u.Scheme != "https" {
+		return fmt.Errorf("%q must use https", raw)
+	}
+	return nil
+}
+
+func isAlphanumeric(s string) bool {
+	for _, r := range s {
+		if (r < '0' || r > '9') && (r < 'a' || r > 'z') && (r < 'A' || r > 'Z') {
+			return false
+		}
+	}
+	return true
+}
+
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
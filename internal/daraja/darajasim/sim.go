@@ -0,0 +1,620 @@
+// Package darajasim is a fake Daraja API for local development and Go tests.
+//
+// It implements the OAuth, STK Push and STK Push Query endpoints, and after a
+// configurable delay posts the STK callback to the CallBackURL from the push
+// request, exactly like Safaricom would. B2C and Reversal requests are always
+// accepted and answered with a successful result on their ResultURL. C2B URLs can be
+// registered, and PayBill plays a customer paying the Paybill from their phone.
+// Point the app at it with MPESA_BASE_URL, or start one inside a test with NewServer.
+package darajasim
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Outcome decides how the simulated customer answers the STK prompt
+type Outcome string
+
+const (
+	Success           Outcome = "success"            // Customer enters their PIN
+	Cancelled         Outcome = "cancel"             // Customer presses Cancel
+	Timeout           Outcome = "timeout"            // Prompt is never answered
+	InsufficientFunds Outcome = "insufficient_funds" // Not enough money in M-Pesa
+	NoCallback        Outcome = "no_callback"        // Paid, but the callback is lost (for the reconciler)
+)
+
+// ParseOutcome accepts the names above, as used by the -outcome flag
+func ParseOutcome(s string) (Outcome, error) {
+	switch o := Outcome(strings.ToLower(strings.TrimSpace(s))); o {
+	case Success, Cancelled, Timeout, InsufficientFunds, NoCallback:
+		return o, nil
+	}
+	return "", fmt.Errorf("unknown outcome %q (want success, cancel, timeout, insufficient_funds or no_callback)", s)
+}
+
+// resultFor maps an outcome to the ResultCode/ResultDesc Safaricom sends
+func resultFor(o Outcome) (int, string) {
+	switch o {
+	case Cancelled:
+		return 1032, "Request cancelled by user"
+	case Timeout:
+		return 1037, "DS timeout user cannot be reached"
+	case InsufficientFunds:
+		return 1, "The balance is insufficient for the transaction"
+	default:
+		return 0, "The service request is processed successfully."
+	}
+}
+
+// Config controls the simulator
+type Config struct {
+	Outcome     Outcome       // Default outcome for every push (Success if empty)
+	Delay       time.Duration // How long the "customer" takes before the callback is sent
+	CallbackURL string        // Overrides the CallBackURL sent in the push, if set
+	Client      *http.Client  // Used to deliver callbacks
+}
+
+// Push is one STK Push the simulator has received
+type Push struct {
+	MerchantRequestID string
+	CheckoutRequestID string
+	PhoneNumber       string
+	Amount            float64
+	AccountReference  string
+	CallbackURL       string
+	Outcome           Outcome
+	Completed         bool // The "customer" has answered
+	ResultCode        int
+	ResultDesc        string
+	Receipt           string
+	CallbackStatus    int // HTTP status our app answered the callback with (0 if not sent)
+
+	seq int
+}
+
+// Server is the fake Daraja API. It is an http.Handler.
+type Server struct {
+	mu            sync.Mutex
+	cfg           Config
+	phoneOutcomes map[string]Outcome
+	tokens        map[string]bool
+	pushes        map[string]*Push
+	order         []string
+	seq           int
+
+	c2bValidationURL   string
+	c2bConfirmationURL string
+	c2bPaid            map[string]float64 // PayBill receipts and their amounts, for Transaction Status
+
+	mux      *http.ServeMux
+	inflight sync.WaitGroup
+}
+
+// New creates a simulator. Mount it yourself or use NewServer.
+func New(cfg Config) *Server {
+	if cfg.Outcome == "" {
+		cfg.Outcome = Success
+	}
+	if cfg.Client == nil {
+		cfg.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	s := &Server{
+		cfg:           cfg,
+		phoneOutcomes: map[string]Outcome{},
+		tokens:        map[string]bool{},
+		pushes:        map[string]*Push{},
+		c2bPaid:       map[string]float64{},
+		mux:           http.NewServeMux(),
+	}
+
+	s.mux.HandleFunc("GET /oauth/v1/generate", s.handleOAuth)
+	s.mux.HandleFunc("POST /mpesa/stkpush/v1/processrequest", s.requireToken(s.handleSTKPush))
+	s.mux.HandleFunc("POST /mpesa/stkpushquery/v1/query", s.requireToken(s.handleSTKQuery))
+	s.mux.HandleFunc("POST /mpesa/b2c/v1/paymentrequest", s.requireToken(s.handleAsync))
+	s.mux.HandleFunc("POST /mpesa/reversal/v1/request", s.requireToken(s.handleAsync))
+	s.mux.HandleFunc("POST /mpesa/c2b/v1/registerurl", s.requireToken(s.handleC2BRegister))
+	s.mux.HandleFunc("POST /mpesa/transactionstatus/v1/query", s.requireToken(s.handleTransactionStatus))
+
+	return s
+}
+
+// TestServer is a simulator listening on a local port
+type TestServer struct {
+	*Server
+	HTTP *httptest.Server
+	URL  string // Use as MpesaConfig.BaseURL
+}
+
+// NewServer starts a simulator on a random local port (remember to Close it)
+func NewServer(cfg Config) *TestServer {
+	s := New(cfg)
+	ts := httptest.NewServer(s)
+	return &TestServer{Server: s, HTTP: ts, URL: ts.URL}
+}
+
+// Close waits for outstanding callbacks, then stops the listener
+func (t *TestServer) Close() {
+	t.Wait()
+	t.HTTP.Close()
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// SetOutcome changes the default outcome for future pushes
+func (s *Server) SetOutcome(o Outcome) {
+	s.mu.Lock()
+	s.cfg.Outcome = o
+	s.mu.Unlock()
+}
+
+// SetPhoneOutcome makes pushes to one phone (2547XXXXXXXX) behave differently
+func (s *Server) SetPhoneOutcome(phone string, o Outcome) {
+	s.mu.Lock()
+	s.phoneOutcomes[phone] = o
+	s.mu.Unlock()
+}
+
+// SetDelay changes how long future pushes wait before answering
+func (s *Server) SetDelay(d time.Duration) {
+	s.mu.Lock()
+	s.cfg.Delay = d
+	s.mu.Unlock()
+}
+
+// RevokeTokens expires every access token, so the next call gets a 401
+func (s *Server) RevokeTokens() {
+	s.mu.Lock()
+	s.tokens = map[string]bool{}
+	s.mu.Unlock()
+}
+
+// Pushes returns a copy of every STK Push received, oldest first
+func (s *Server) Pushes() []Push {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := make([]Push, 0, len(s.order))
+	for _, id := range s.order {
+		out = append(out, *s.pushes[id])
+	}
+	return out
+}
+
+// Wait blocks until every scheduled callback has been delivered
+func (s *Server) Wait() {
+	s.inflight.Wait()
+}
+
+// --- Handlers ---
+
+func (s *Server) handleOAuth(w http.ResponseWriter, r *http.Request) {
+	if _, _, ok := r.BasicAuth(); !ok {
+		http.Error(w, `{"errorMessage":"Invalid Authentication passed"}`, http.StatusBadRequest)
+		return
+	}
+
+	token := randomHex(14)
+	s.mu.Lock()
+	s.tokens[token] = true
+	s.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, map[string]string{
+		"access_token": token,
+		"expires_in":   "3599",
+	})
+}
+
+func (s *Server) requireToken(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+		s.mu.Lock()
+		ok := s.tokens[token]
+		s.mu.Unlock()
+
+		if !ok {
+			writeJSON(w, http.StatusUnauthorized, apiError("404.001.03", "Invalid Access Token"))
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (s *Server) handleSTKPush(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		BusinessShortCode string
+		Password          string
+		Timestamp         string
+		TransactionType   string
+		Amount            json.Number
+		PartyA            string
+		PartyB            string
+		PhoneNumber       string
+		CallBackURL       string
+		AccountReference  string
+		TransactionDesc   string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError("400.002.02", "Bad Request - Invalid Body"))
+		return
+	}
+
+	amount, err := req.Amount.Float64()
+	if err != nil || amount < 1 {
+		writeJSON(w, http.StatusBadRequest, apiError("400.002.02", "Bad Request - Invalid Amount"))
+		return
+	}
+	if req.PhoneNumber == "" || req.CallBackURL == "" || req.BusinessShortCode == "" {
+		writeJSON(w, http.StatusBadRequest, apiError("400.002.02", "Bad Request - Missing fields"))
+		return
+	}
+
+	s.mu.Lock()
+	s.seq++
+	outcome, ok := s.phoneOutcomes[req.PhoneNumber]
+	if !ok {
+		outcome = s.cfg.Outcome
+	}
+	callbackURL := req.CallBackURL
+	if s.cfg.CallbackURL != "" {
+		callbackURL = s.cfg.CallbackURL
+	}
+	push := &Push{
+		MerchantRequestID: fmt.Sprintf("29115-%d-1", 34620000+s.seq),
+		CheckoutRequestID: fmt.Sprintf("ws_CO_%s%06d", time.Now().Format("020120061504"), s.seq),
+		PhoneNumber:       req.PhoneNumber,
+		Amount:            amount,
+		AccountReference:  req.AccountReference,
+		CallbackURL:       callbackURL,
+		Outcome:           outcome,
+		seq:               s.seq,
+	}
+	s.pushes[push.CheckoutRequestID] = push
+	s.order = append(s.order, push.CheckoutRequestID)
+	delay := s.cfg.Delay
+	s.mu.Unlock()
+
+	s.inflight.Add(1)
+	time.AfterFunc(delay, func() {
+		defer s.inflight.Done()
+		s.complete(push.CheckoutRequestID)
+	})
+
+	writeJSON(w, http.StatusOK, map[string]string{
+		"MerchantRequestID":   push.MerchantRequestID,
+		"CheckoutRequestID":   push.CheckoutRequestID,
+		"ResponseCode":        "0",
+		"ResponseDescription": "Success. Request accepted for processing",
+		"CustomerMessage":     "Success. Request accepted for processing",
+	})
+}
+
+func (s *Server) handleSTKQuery(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		CheckoutRequestID string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError("400.002.02", "Bad Request - Invalid Body"))
+		return
+	}
+
+	s.mu.Lock()
+	push, ok := s.pushes[req.CheckoutRequestID]
+	var p Push
+	if ok {
+		p = *push
+	}
+	s.mu.Unlock()
+
+	if !ok {
+		writeJSON(w, http.StatusBadRequest, apiError("400.002.02", "Bad Request - Invalid CheckoutRequestID"))
+		return
+	}
+	if !p.Completed {
+		writeJSON(w, http.StatusInternalServerError, apiError("500.001.1001", "The transaction is being processed"))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{
+		"ResponseCode":        "0",
+		"ResponseDescription": "The service request has been accepted successsfully",
+		"MerchantRequestID":   p.MerchantRequestID,
+		"CheckoutRequestID":   p.CheckoutRequestID,
+		"ResultCode":          strconv.Itoa(p.ResultCode),
+		"ResultDesc":          p.ResultDesc,
+	})
+}
+
+// handleAsync accepts a B2C or Reversal request and later posts its Result
+func (s *Server) handleAsync(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ResultURL string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ResultURL == "" {
+		writeJSON(w, http.StatusBadRequest, apiError("400.002.02", "Bad Request - Invalid ResultURL"))
+		return
+	}
+
+	s.mu.Lock()
+	s.seq++
+	seq := s.seq
+	delay := s.cfg.Delay
+	s.mu.Unlock()
+
+	originatorID := fmt.Sprintf("%d-%d-1", 10571, 7000000+seq)
+	conversationID := fmt.Sprintf("AG_%s_%012d", time.Now().Format("20060102"), seq)
+
+	s.inflight.Add(1)
+	time.AfterFunc(delay, func() {
+		defer s.inflight.Done()
+
+		body, _ := json.Marshal(map[string]interface{}{
+			"Result": map[string]interface{}{
+				"ResultType":               0,
+				"ResultCode":               0,
+				"ResultDesc":               "The service request is processed successfully.",
+				"OriginatorConversationID": originatorID,
+				"ConversationID":           conversationID,
+				"TransactionID":            fmt.Sprintf("SIR%07d", seq),
+			},
+		})
+		resp, err := s.cfg.Client.Post(req.ResultURL, "application/json", bytes.NewReader(body))
+		if err != nil {
+			log.Printf("darajasim: result for %s failed: %v", conversationID, err)
+			return
+		}
+		resp.Body.Close()
+	})
+
+	writeJSON(w, http.StatusOK, map[string]string{
+		"OriginatorConversationID": originatorID,
+		"ConversationID":           conversationID,
+		"ResponseCode":             "0",
+		"ResponseDescription":      "Accept the service request successfully.",
+	})
+}
+
+// handleTransactionStatus accepts a Transaction Status query and later posts its
+// Result. Only receipts PayBill handed out are known.
+func (s *Server) handleTransactionStatus(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		TransactionID string
+		ResultURL     string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ResultURL == "" {
+		writeJSON(w, http.StatusBadRequest, apiError("400.002.02", "Bad Request - Invalid ResultURL"))
+		return
+	}
+
+	s.mu.Lock()
+	s.seq++
+	seq := s.seq
+	delay := s.cfg.Delay
+	amount, known := s.c2bPaid[req.TransactionID]
+	s.mu.Unlock()
+
+	originatorID := fmt.Sprintf("%d-%d-1", 10571, 7000000+seq)
+	conversationID := fmt.Sprintf("AG_%s_%012d", time.Now().Format("20060102"), seq)
+
+	result := map[string]interface{}{
+		"ResultType":               0,
+		"ResultCode":               2001,
+		"ResultDesc":               "The transaction receipt number does not exist.",
+		"OriginatorConversationID": originatorID,
+		"ConversationID":           conversationID,
+		"TransactionID":            fmt.Sprintf("SIS%07d", seq),
+	}
+	if known {
+		result["ResultCode"] = 0
+		result["ResultDesc"] = "The service request is processed successfully."
+		result["ResultParameters"] = map[string]interface{}{
+			"ResultParameter": []map[string]interface{}{
+				{"Key": "ReceiptNo", "Value": req.TransactionID},
+				{"Key": "TransactionStatus", "Value": "Completed"},
+				{"Key": "Amount", "Value": amount},
+				{"Key": "ReasonType", "Value": "Pay Bill Online"},
+			},
+		}
+	}
+
+	s.inflight.Add(1)
+	time.AfterFunc(delay, func() {
+		defer s.inflight.Done()
+
+		body, _ := json.Marshal(map[string]interface{}{"Result": result})
+		resp, err := s.cfg.Client.Post(req.ResultURL, "application/json", bytes.NewReader(body))
+		if err != nil {
+			log.Printf("darajasim: status result for %s failed: %v", conversationID, err)
+			return
+		}
+		resp.Body.Close()
+	})
+
+	writeJSON(w, http.StatusOK, map[string]string{
+		"OriginatorConversationID": originatorID,
+		"ConversationID":           conversationID,
+		"ResponseCode":             "0",
+		"ResponseDescription":      "Accept the service request successfully.",
+	})
+}
+
+func (s *Server) handleC2BRegister(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ShortCode       string
+		ResponseType    string
+		ConfirmationURL string
+		ValidationURL   string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ConfirmationURL == "" || req.ValidationURL == "" {
+		writeJSON(w, http.StatusBadRequest, apiError("400.002.02", "Bad Request - Invalid URLs"))
+		return
+	}
+
+	s.mu.Lock()
+	s.c2bValidationURL = req.ValidationURL
+	s.c2bConfirmationURL = req.ConfirmationURL
+	s.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, map[string]string{
+		"OriginatorCoversationID": randomHex(8), // (sic) Daraja's spelling
+		"ResponseCode":            "0",
+		"ResponseDescription":     "Success",
+	})
+}
+
+// PayBill plays a customer paying our shortcode from the M-Pesa menu with
+// billRef as the account number. It calls the registered validation URL, and
+// the confirmation URL if validation accepted, returning the receipt number.
+func (s *Server) PayBill(billRef string, amount float64, phone string) (string, error) {
+	s.mu.Lock()
+	s.seq++
+	seq := s.seq
+	validationURL, confirmationURL := s.c2bValidationURL, s.c2bConfirmationURL
+	s.mu.Unlock()
+
+	if confirmationURL == "" {
+		return "", fmt.Errorf("no C2B URLs registered")
+	}
+
+	receipt := fmt.Sprintf("SIC%07d", seq)
+	body, _ := json.Marshal(map[string]string{
+		"TransactionType":   "Pay Bill",
+		"TransID":           receipt,
+		"TransTime":         time.Now().Format("20060102150405"),
+		"TransAmount":       strconv.FormatFloat(amount, 'f', 2, 64),
+		"BusinessShortCode": "174379",
+		"BillRefNumber":     billRef,
+		"InvoiceNumber":     "",
+		"OrgAccountBalance": "",
+		"ThirdPartyTransID": "",
+		"MSISDN":            phone,
+		"FirstName":         "Sim",
+		"MiddleName":        "",
+		"LastName":          "Customer",
+	})
+
+	var ack struct {
+		ResultCode interface{}
+		ResultDesc string
+	}
+	resp, err := s.cfg.Client.Post(validationURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return "", fmt.Errorf("validation: %w", err)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&ack)
+	resp.Body.Close()
+	if err != nil {
+		return "", fmt.Errorf("validation: bad response: %w", err)
+	}
+	if fmt.Sprint(ack.ResultCode) != "0" {
+		return "", fmt.Errorf("validation rejected the payment: %v %s", ack.ResultCode, ack.ResultDesc)
+	}
+
+	s.mu.Lock()
+	s.c2bPaid[receipt] = amount
+	s.mu.Unlock()
+
+	resp, err = s.cfg.Client.Post(confirmationURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return "", fmt.Errorf("confirmation: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("confirmation: HTTP %d", resp.StatusCode)
+	}
+	return receipt, nil
+}
+
+// complete plays the customer's answer and posts the callback
+func (s *Server) complete(checkoutRequestID string) {
+	s.mu.Lock()
+	push := s.pushes[checkoutRequestID]
+	push.ResultCode, push.ResultDesc = resultFor(push.Outcome)
+	if push.ResultCode == 0 {
+		push.Receipt = fmt.Sprintf("SIM%07d", push.seq)
+	}
+	push.Completed = true
+	p := *push
+	s.mu.Unlock()
+
+	if p.Outcome == NoCallback {
+		return
+	}
+
+	status, err := s.postCallback(p)
+	if err != nil {
+		log.Printf("darajasim: callback for %s failed: %v", p.CheckoutRequestID, err)
+	}
+
+	s.mu.Lock()
+	push.CallbackStatus = status
+	s.mu.Unlock()
+}
+
+func (s *Server) postCallback(p Push) (int, error) {
+	stk := map[string]interface{}{
+		"MerchantRequestID": p.MerchantRequestID,
+		"CheckoutRequestID": p.CheckoutRequestID,
+		"ResultCode":        p.ResultCode,
+		"ResultDesc":        p.ResultDesc,
+	}
+	if p.ResultCode == 0 {
+		phone, _ := strconv.ParseInt(p.PhoneNumber, 10, 64)
+		date, _ := strconv.ParseInt(time.Now().Format("20060102150405"), 10, 64)
+		stk["CallbackMetadata"] = map[string]interface{}{
+			"Item": []map[string]interface{}{
+				{"Name": "Amount", "Value": p.Amount},
+				{"Name": "MpesaReceiptNumber", "Value": p.Receipt},
+				{"Name": "TransactionDate", "Value": date},
+				{"Name": "PhoneNumber", "Value": phone},
+			},
+		}
+	}
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"Body": map[string]interface{}{"stkCallback": stk},
+	})
+
+	resp, err := s.cfg.Client.Post(p.CallbackURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+// --- Helpers ---
+
+func apiError(code, message string) map[string]string {
+	return map[string]string{
+		"requestId":    randomHex(8),
+		"errorCode":    code,
+		"errorMessage": message,
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
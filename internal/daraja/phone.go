@@ -0,0 +1,29 @@
+package daraja
+
+import "strings"
+
+// FormatPhone turns the ways customers type Kenyan numbers
+// (0712..., 712..., +254712..., 254712...) into the 2547XXXXXXXX form Daraja expects
+func FormatPhone(phone string) string {
+	phone = strings.NewReplacer(" ", "", "-", "", "+", "").Replace(strings.TrimSpace(phone))
+
+	switch {
+	case strings.HasPrefix(phone, "254"):
+		return phone
+	case strings.HasPrefix(phone, "0"):
+		return "254" + phone[1:]
+	case len(phone) == 9:
+		return "254" + phone
+	}
+	return phone
+}
+
+// ValidPhone reports whether phone is a Kenyan mobile number M-Pesa can prompt
+// (07XX/01XX in any of the forms FormatPhone accepts)
+func ValidPhone(phone string) bool {
+	p := FormatPhone(phone)
+	if len(p) != 12 || (p[3] != '7' && p[3] != '1') {
+		return false
+	}
+	return isDigits(p)
+}
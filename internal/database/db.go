@@ -107,6 +107,56 @@ func InitDB() {
 		"ALTER TABLE orders ADD COLUMN IF NOT EXISTS whatsapp_number VARCHAR(50);",
 		"ALTER TABLE orders ADD COLUMN IF NOT EXISTS mpesa_receipt VARCHAR(50);",
 		"ALTER TABLE orders ADD COLUMN IF NOT EXISTS customer_phone VARCHAR(20);",
+		"ALTER TABLE orders ADD COLUMN IF NOT EXISTS callback_token VARCHAR(64);",
+		// Orders placed before callback tokens existed still need one to be payable
+		"UPDATE orders SET callback_token = md5(random()::text || id::text) || md5(random()::text) WHERE callback_token IS NULL;",
+		"CREATE UNIQUE INDEX IF NOT EXISTS idx_orders_callback_token ON orders(callback_token);",
+		// Attempts are reserved before Safaricom hands out their request IDs
+		"ALTER TABLE payment_attempts ALTER COLUMN merchant_request_id DROP NOT NULL;",
+		"ALTER TABLE payment_attempts ALTER COLUMN checkout_request_id DROP NOT NULL;",
+		// AWAITING_MANUAL_PAYMENT doesn't fit in the original VARCHAR(20)
+		"ALTER TABLE orders ALTER COLUMN status TYPE VARCHAR(30);",
+		"ALTER TABLE orders ADD COLUMN IF NOT EXISTS payment_method VARCHAR(20) DEFAULT 'MPESA';",
+		"ALTER TABLE orders ADD COLUMN IF NOT EXISTS payment_reference VARCHAR(100);",
+		// Deposits: share paid upfront (0 = pay in full; a product's 0 means use its category's)
+		"ALTER TABLE categories ADD COLUMN IF NOT EXISTS deposit_percent INT DEFAULT 0;",
+		"ALTER TABLE products ADD COLUMN IF NOT EXISTS deposit_percent INT DEFAULT 0;",
+		"ALTER TABLE orders ADD COLUMN IF NOT EXISTS deposit_amount DECIMAL(10, 2) DEFAULT 0;",
+		"ALTER TABLE orders ADD COLUMN IF NOT EXISTS amount_paid DECIMAL(10, 2) DEFAULT 0;",
+		// Orders paid before amount_paid existed were paid in full
+		"UPDATE orders SET amount_paid = total_amount WHERE amount_paid = 0 AND status IN ('PAID', 'COMPLETED', 'REFUNDED', 'PARTIALLY_REFUNDED');",
+		// Order lifecycle: PENDING and COMPLETED were renamed
+		"ALTER TABLE orders ALTER COLUMN status SET DEFAULT 'PENDING_PAYMENT';",
+		"UPDATE orders SET status = 'PENDING_PAYMENT' WHERE status = 'PENDING';",
+		"UPDATE orders SET status = 'DELIVERED' WHERE status = 'COMPLETED';",
+		// Pickup or delivery, and when (orders from before this have none)
+		"ALTER TABLE orders ADD COLUMN IF NOT EXISTS fulfilment_type VARCHAR(10);",
+		"ALTER TABLE orders ADD COLUMN IF NOT EXISTS fulfilment_date DATE;",
+		"ALTER TABLE orders ADD COLUMN IF NOT EXISTS time_slot VARCHAR(20);",
+		"CREATE INDEX IF NOT EXISTS idx_orders_fulfilment_date ON orders(fulfilment_date);",
+		"ALTER TABLE products ADD COLUMN IF NOT EXISTS lead_time_hours INT DEFAULT 0;",
+		// Delivery: where to, and the fee charged (already part of total_amount)
+		"ALTER TABLE orders ADD COLUMN IF NOT EXISTS delivery_zone VARCHAR(100);",
+		"ALTER TABLE orders ADD COLUMN IF NOT EXISTS delivery_address TEXT;",
+		"ALTER TABLE orders ADD COLUMN IF NOT EXISTS delivery_fee DECIMAL(10, 2) DEFAULT 0;",
+		// Public references: customers see a code and follow links with a token, never the ID
+		"ALTER TABLE orders ADD COLUMN IF NOT EXISTS public_code VARCHAR(12);",
+		"ALTER TABLE orders ADD COLUMN IF NOT EXISTS public_token VARCHAR(64);",
+		"UPDATE orders SET public_token = replace(gen_random_uuid()::text || gen_random_uuid()::text, '-', '') WHERE public_token IS NULL;",
+		"UPDATE orders SET public_code = 'CG-' || upper(substr(replace(gen_random_uuid()::text, '-', ''), 1, 6)) WHERE public_code IS NULL;",
+		"CREATE UNIQUE INDEX IF NOT EXISTS idx_orders_public_code ON orders(public_code);",
+		"CREATE UNIQUE INDEX IF NOT EXISTS idx_orders_public_token ON orders(public_token);",
+		// Admin order search
+		"CREATE INDEX IF NOT EXISTS idx_orders_status ON orders(status);",
+		"CREATE INDEX IF NOT EXISTS idx_orders_created_at ON orders(created_at);",
+		// Discount codes: taken off the cakes (not delivery), already out of total_amount
+		"ALTER TABLE orders ADD COLUMN IF NOT EXISTS discount_code VARCHAR(30);",
+		"ALTER TABLE orders ADD COLUMN IF NOT EXISTS discount_amount DECIMAL(10, 2) DEFAULT 0;",
+		// Refund results are only accepted on the ResultURL carrying the refund's own token
+		"ALTER TABLE refunds ADD COLUMN IF NOT EXISTS callback_token VARCHAR(64);",
+		// C2B payments are only applied once a Transaction Status query confirms them
+		"ALTER TABLE c2b_payments ADD COLUMN IF NOT EXISTS match_order_id INT REFERENCES orders(id);",
+		"ALTER TABLE c2b_payments ADD COLUMN IF NOT EXISTS verify_token VARCHAR(64);",
 	}
 
 	for _, query := range migrations {
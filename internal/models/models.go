@@ -1,13 +1,25 @@
 package models
 
+import (
+	"crypto/rand"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
 // Product represents the general cake details
 type Product struct {
-	ID            int
-	Name          string
-	Description   string
-	ImageURL      string
-	Category      string  // We might fetch the category name via JOIN
-	StartingPrice float64 // Calculated field (min price of variants)
+	ID             int
+	Name           string
+	Description    string
+	ImageURL       string
+	Category       string  // We might fetch the category name via JOIN
+	StartingPrice  float64 // Calculated field (min price of variants)
+	DepositPercent int     // Share paid upfront; 0 uses the category's
+	LeadTimeHours  int     // Notice needed before pickup or delivery (e.g. 48 for wedding cakes)
 }
 
 // ProductVariant represents the specific size/price options (e.g., 1KG = 4000)
@@ -25,11 +37,474 @@ type Order struct {
 	WhatsappNumber string // New
 	CustomerPhone  string // This remains the MPESA Payment Number
 	TotalAmount    float64
-	Status         string
+	Status         string // One of the Status constants below
 	MpesaReceipt   string
+	CallbackToken  string  // Secret part of our M-Pesa CallbackURL; never shown to customers
+	PublicCode     string  // What customers call the order, e.g. "CG-7K3M9Q"
+	PublicToken    string  // Opaque key for the order in customer links; IDs are for admins only
+	PaymentMethod  string  // MPESA, PICKUP, BANK_TRANSFER
+	PaymentRef     string  // Bank transfer reference the customer gave us
+	DepositAmount  float64 // Paid upfront before the balance; 0 means pay in full
+	DeliveryFee    float64 // Included in TotalAmount
+	DiscountCode   string  // Promotion code used at checkout, if any
+	DiscountAmount float64 // Already taken off TotalAmount
+	AmountPaid     float64
+	FulfilmentType string // PICKUP, DELIVERY
+	FulfilmentDate string // YYYY-MM-DD the customer collects it or we deliver it
+	TimeSlot       string // One of TimeSlots, e.g. "09:00-12:00"
+	DeliveryZone   string // Name of the zone at the time of the order
+	Address        string // Where to deliver; empty for pickup
 	CreatedAt      string
 }
 
+// codeAlphabet leaves out characters that are easy to mix up (0/O, 1/I/L)
+const codeAlphabet = "ABCDEFGHJKMNPQRSTUVWXYZ23456789"
+
+// codePattern finds an order code however it was typed: "CG-7K3M9Q", "cg 7k3m9q", "CG7K3M9Q"
+var codePattern = regexp.MustCompile(`(?i)^\s*CG[\s\-_#]*([A-Z0-9]{6})\s*$`)
+
+// NewPublicCode returns a random order code like "CG-7K3M9Q". It is short
+// enough to read out or type as an M-Pesa account number.
+func NewPublicCode() (string, error) {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	for i := range b {
+		b[i] = codeAlphabet[int(b[i])%len(codeAlphabet)]
+	}
+	return "CG-" + string(b), nil
+}
+
+// ParsePublicCode returns the order code in what a customer typed, written the
+// way we store it, or false if it isn't one
+func ParsePublicCode(s string) (string, bool) {
+	m := codePattern.FindStringSubmatch(s)
+	if m == nil {
+		return "", false
+	}
+	return "CG-" + strings.ToUpper(m[1]), true
+}
+
+// How the customer gets their cake
+const (
+	FulfilmentPickup   = "PICKUP"
+	FulfilmentDelivery = "DELIVERY"
+)
+
+// DateLayout is how fulfilment and closed dates are written (Postgres DATE text)
+const DateLayout = "2006-01-02"
+
+// TimeSlots are the windows a cake can be collected or delivered in
+var TimeSlots = []string{"09:00-12:00", "12:00-15:00", "15:00-18:00"}
+
+// Fulfilment describes when and how the customer gets their cake, e.g.
+// "Pickup on Fri 16 Oct, 09:00-12:00". Older orders without a date return "".
+func (o *Order) Fulfilment() string {
+	day, err := time.Parse(DateLayout, o.FulfilmentDate)
+	if err != nil {
+		return ""
+	}
+	kind := "Pickup"
+	if o.FulfilmentType == FulfilmentDelivery {
+		kind = "Delivery"
+	}
+	return fmt.Sprintf("%s on %s, %s", kind, day.Format("Mon 2 Jan"), o.TimeSlot)
+}
+
+// Subtotal is what the cakes cost, without the delivery fee or any discount
+func (o *Order) Subtotal() float64 {
+	return o.TotalAmount - o.DeliveryFee + o.DiscountAmount
+}
+
+// DeliveryZone is an area we deliver to, with its own fee
+type DeliveryZone struct {
+	ID       int
+	Name     string // e.g. "Westlands"
+	Fee      float64
+	MinOrder float64 // Smallest cake subtotal we deliver there; 0 means any
+	FreeOver float64 // Delivery is free from this subtotal up; 0 means never
+}
+
+// FeeFor is the delivery fee for an order of cakes worth subtotal
+func (z *DeliveryZone) FeeFor(subtotal float64) float64 {
+	if z.FreeOver > 0 && subtotal >= z.FreeOver {
+		return 0
+	}
+	return z.Fee
+}
+
+// Promotion kinds
+const (
+	PromoPercent = "PERCENT" // Value is a percentage off the cakes it applies to
+	PromoFixed   = "FIXED"   // Value is shillings off, up to what those cakes cost
+)
+
+// Promotion is a discount code customers type at checkout
+type Promotion struct {
+	ID             int
+	Code           string // Upper case, e.g. "VALENTINE15"
+	Description    string // Shown to the customer, e.g. "Valentine's Day special"
+	Kind           string // PromoPercent or PromoFixed
+	Value          float64
+	MinSpend       float64 // Smallest cake subtotal it can be used on; 0 means any
+	StartsOn       string  // First day it can be used (YYYY-MM-DD); empty means straight away
+	EndsOn         string  // Last day it can be used; empty means until switched off
+	MaxUses        int     // Orders that can use it in total; 0 means no limit
+	MaxPerCustomer int     // Orders per phone number or email; 0 means no limit
+	Active         bool
+	ProductIDs     []int // Only these cakes, and cakes in CategoryIDs, are discounted.
+	CategoryIDs    []int // With neither, every cake is.
+	CreatedAt      string
+
+	// Usage, for the admin pages: orders that went ahead (not unpaid or cancelled)
+	Uses       int
+	Discounted float64 // Taken off those orders
+	Revenue    float64 // Paid on those orders
+}
+
+// Label describes the discount, e.g. "15% off" or "KES 500 off"
+func (p *Promotion) Label() string {
+	if p.Kind == PromoPercent {
+		return strconv.FormatFloat(p.Value, 'f', -1, 64) + "% off"
+	}
+	return "KES " + strconv.FormatFloat(p.Value, 'f', -1, 64) + " off"
+}
+
+// DiscountOn works out the discount on the cakes it applies to, worth
+// eligible. Percentages are rounded down to whole shillings for M-Pesa.
+func (p *Promotion) DiscountOn(eligible float64) float64 {
+	if p.Kind == PromoPercent {
+		return math.Floor(eligible * p.Value / 100)
+	}
+	return math.Min(p.Value, eligible)
+}
+
+// Restricted reports whether the promotion only applies to some cakes
+func (p *Promotion) Restricted() bool {
+	return len(p.ProductIDs) > 0 || len(p.CategoryIDs) > 0
+}
+
+// HasProduct ticks the cake's box on the admin form
+func (p *Promotion) HasProduct(id int) bool {
+	return containsInt(p.ProductIDs, id)
+}
+
+// HasCategory ticks the category's box on the admin form
+func (p *Promotion) HasCategory(id int) bool {
+	return containsInt(p.CategoryIDs, id)
+}
+
+func containsInt(list []int, id int) bool {
+	for _, v := range list {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Redemption is an order placed with a promotion code
+type Redemption struct {
+	ID          int
+	PromotionID int
+	OrderID     int
+	Phone       string
+	Email       string
+	Amount      float64 // Discount given
+	CreatedAt   string
+	Order       *Order // Code, customer, status, total and paid, for the usage report
+}
+
+// FulfilmentDay is a date offered at checkout
+type FulfilmentDay struct {
+	Date        string // YYYY-MM-DD
+	Label       string // e.g. "Fri 16 Oct"
+	Unavailable string // Why it can't be picked (closed, not enough notice); empty if it can
+}
+
+// Capacity is how much the kitchen can hand over in a day. A zero limit means no limit.
+type Capacity struct {
+	MaxKg    float64
+	MaxCakes int
+}
+
+// DayLoad is how much cake is booked for a day
+type DayLoad struct {
+	Kg    float64
+	Cakes int
+}
+
+// Add returns the two loads combined
+func (l DayLoad) Add(other DayLoad) DayLoad {
+	return DayLoad{Kg: l.Kg + other.Kg, Cakes: l.Cakes + other.Cakes}
+}
+
+// Fits reports whether load stays within the capacity
+func (c Capacity) Fits(load DayLoad) bool {
+	if c.MaxKg > 0 && load.Kg > c.MaxKg {
+		return false
+	}
+	if c.MaxCakes > 0 && load.Cakes > c.MaxCakes {
+		return false
+	}
+	return true
+}
+
+// CapacityDay is a date's capacity and what is already booked, for the admin
+type CapacityDay struct {
+	Date     string // YYYY-MM-DD
+	Label    string // e.g. "Fri 16 Oct"
+	Override bool   // Capacity was set for this date rather than its weekday
+	Capacity
+	Booked DayLoad
+}
+
+// weightPattern finds the weight in a variant label: "1 Kg", "1.5kg", "500g"
+var weightPattern = regexp.MustCompile(`(?i)(\d+(?:[.,]\d+)?)\s*(kgs?|kilos?|g|gms?|grams?)\b`)
+
+// ParseKg reads the weight of a variant from its label, or 0 if it has none
+func ParseKg(label string) float64 {
+	m := weightPattern.FindStringSubmatch(label)
+	if m == nil {
+		return 0
+	}
+	n, err := strconv.ParseFloat(strings.Replace(m[1], ",", ".", 1), 64)
+	if err != nil {
+		return 0
+	}
+	if strings.HasPrefix(strings.ToLower(m[2]), "k") {
+		return n
+	}
+	return n / 1000
+}
+
+// ClosedDate is a day the bakery takes no pickups or deliveries
+type ClosedDate struct {
+	Date   string // YYYY-MM-DD
+	Reason string
+}
+
+// Order statuses. An order waits for money in PENDING_PAYMENT (or FAILED,
+// AWAITING_MANUAL_PAYMENT, PARTIALLY_PAID), then moves through the kitchen to DELIVERED.
+const (
+	StatusPendingPayment = "PENDING_PAYMENT"
+	StatusFailed         = "FAILED"                  // The M-Pesa prompt failed; the customer can retry
+	StatusAwaitingManual = "AWAITING_MANUAL_PAYMENT" // Pay on pickup or bank transfer, confirmed by an admin
+	StatusPartiallyPaid  = "PARTIALLY_PAID"          // Deposit received
+	StatusPaid           = "PAID"
+	StatusConfirmed      = "CONFIRMED"
+	StatusInProduction   = "IN_PRODUCTION"
+	StatusReady          = "READY"
+	StatusOutForDelivery = "OUT_FOR_DELIVERY"
+	StatusDelivered      = "DELIVERED"
+	StatusCancelled      = "CANCELLED"
+	StatusPartRefunded   = "PARTIALLY_REFUNDED" // Some of what was paid was refunded; the order goes ahead
+	StatusRefunded       = "REFUNDED"
+)
+
+// AllStatuses lists every status in lifecycle order, e.g. for filtering orders
+var AllStatuses = []string{
+	StatusPendingPayment, StatusFailed, StatusAwaitingManual, StatusPartiallyPaid, StatusPaid,
+	StatusConfirmed, StatusInProduction, StatusReady, StatusOutForDelivery, StatusDelivered,
+	StatusCancelled, StatusPartRefunded, StatusRefunded,
+}
+
+// OrderTransitions lists the statuses an order may move to from each status.
+// Payment statuses are moved by M-Pesa and the payment pages, the rest by admins.
+var OrderTransitions = map[string][]string{
+	StatusPendingPayment: {StatusFailed, StatusAwaitingManual, StatusPartiallyPaid, StatusPaid, StatusCancelled},
+	StatusFailed:         {StatusPendingPayment, StatusAwaitingManual, StatusPartiallyPaid, StatusPaid, StatusCancelled},
+	StatusAwaitingManual: {StatusPendingPayment, StatusPartiallyPaid, StatusPaid, StatusCancelled},
+	StatusPartiallyPaid:  {StatusPaid, StatusConfirmed, StatusCancelled, StatusPartRefunded, StatusRefunded},
+	StatusPaid:           {StatusConfirmed, StatusCancelled, StatusPartRefunded, StatusRefunded},
+	StatusConfirmed:      {StatusInProduction, StatusCancelled, StatusPartRefunded, StatusRefunded},
+	StatusInProduction:   {StatusReady, StatusCancelled, StatusPartRefunded, StatusRefunded},
+	StatusReady:          {StatusOutForDelivery, StatusDelivered, StatusCancelled, StatusPartRefunded, StatusRefunded},
+	StatusOutForDelivery: {StatusDelivered, StatusReady, StatusPartRefunded, StatusRefunded},
+	StatusDelivered:      {StatusPartRefunded, StatusRefunded},
+	StatusCancelled:      {StatusRefunded}, // A partial refund of a cancelled order leaves it CANCELLED
+	StatusPartRefunded:   {StatusConfirmed, StatusInProduction, StatusReady, StatusOutForDelivery, StatusDelivered, StatusCancelled, StatusRefunded},
+}
+
+// ScheduledStatuses are the statuses of orders the kitchen has to make
+var ScheduledStatuses = []string{
+	StatusAwaitingManual, StatusPartiallyPaid, StatusPaid,
+	StatusConfirmed, StatusInProduction, StatusReady, StatusOutForDelivery, StatusPartRefunded,
+}
+
+// CapacityStatuses are the statuses of orders that use up a day's capacity.
+// A delivered cake was still baked that day; only cancelled and refunded
+// orders give their slot back.
+var CapacityStatuses = append([]string{StatusDelivered}, ScheduledStatuses...)
+
+// adminStatuses are the statuses an admin can pick by hand. Payments and
+// refunds move orders into the others.
+var adminStatuses = map[string]bool{
+	StatusConfirmed:      true,
+	StatusInProduction:   true,
+	StatusReady:          true,
+	StatusOutForDelivery: true,
+	StatusDelivered:      true,
+	StatusCancelled:      true,
+}
+
+// CanTransition reports whether an order may move from one status to another
+func CanTransition(from, to string) bool {
+	for _, next := range OrderTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// CanSetByAdmin reports whether an admin may move an order to status by hand
+func CanSetByAdmin(status string) bool {
+	return adminStatuses[status]
+}
+
+// customerCancellable are the statuses a customer can still cancel from
+// themselves; once the cake is ready they have to call us
+var customerCancellable = map[string]bool{
+	StatusPendingPayment: true,
+	StatusFailed:         true,
+	StatusAwaitingManual: true,
+	StatusPartiallyPaid:  true,
+	StatusPaid:           true,
+	StatusConfirmed:      true,
+	StatusInProduction:   true,
+}
+
+// CustomerCanCancel reports whether the customer can cancel the order online.
+// Orders from before fulfilment dates existed have nothing to measure the
+// cancellation window against, so they can't.
+func (o *Order) CustomerCanCancel() bool {
+	return customerCancellable[o.Status] && o.FulfilmentDate != ""
+}
+
+// CancelPolicy is how much of what was paid comes back when a customer
+// cancels, depending on how close it is to their pickup or delivery slot
+type CancelPolicy struct {
+	FullRefundBefore time.Duration // Cancel at least this long before for a full refund
+	NoRefundWithin   time.Duration // Cancel closer than this and nothing is refunded
+	LateFeePercent   int           // Kept when cancelling in between
+}
+
+// RefundPercent is the share of what was paid that is refunded when an order
+// due at slotStart is cancelled at now
+func (p CancelPolicy) RefundPercent(slotStart, now time.Time) int {
+	left := slotStart.Sub(now)
+	switch {
+	case left >= p.FullRefundBefore:
+		return 100
+	case left >= p.NoRefundWithin:
+		return 100 - p.LateFeePercent
+	}
+	return 0
+}
+
+// FullRefundHours is the full refund cutoff, for telling customers the policy
+func (p CancelPolicy) FullRefundHours() int {
+	return int(p.FullRefundBefore.Hours())
+}
+
+// NoRefundHours is the no refund cutoff, for telling customers the policy
+func (p CancelPolicy) NoRefundHours() int {
+	return int(p.NoRefundWithin.Hours())
+}
+
+// CancelQuote is what a customer would get back if they cancelled now
+type CancelQuote struct {
+	Policy  CancelPolicy
+	Percent int     // Share of what was paid that is refunded
+	Refund  float64 // In whole shillings, as M-Pesa sends it
+}
+
+// NextStatuses lists the statuses an admin can move the order to next
+func (o *Order) NextStatuses() []string {
+	var next []string
+	for _, s := range OrderTransitions[o.Status] {
+		if adminStatuses[s] {
+			next = append(next, s)
+		}
+	}
+	return next
+}
+
+// AcceptsPayment is true while money can still be applied to the order: before
+// it is paid, or while a deposit order has a balance left, whichever stage the
+// kitchen has reached
+func (o *Order) AcceptsPayment() bool {
+	switch o.Status {
+	case StatusPendingPayment, StatusFailed, StatusAwaitingManual:
+		return true
+	case StatusPartiallyPaid, StatusConfirmed, StatusInProduction, StatusReady, StatusOutForDelivery, StatusDelivered:
+		return o.BalanceDue() > 0
+	}
+	return false
+}
+
+// OrderStatusChange is one entry in an order's status history
+type OrderStatusChange struct {
+	FromStatus string // Empty for the order being placed
+	ToStatus   string
+	ChangedBy  string // customer, mpesa, c2b, system, or the admin's username
+	Note       string
+	CreatedAt  string
+}
+
+// statusLabels describe each status the way a customer would put it
+var statusLabels = map[string]string{
+	StatusPendingPayment: "Waiting for payment",
+	StatusFailed:         "Payment failed",
+	StatusAwaitingManual: "Waiting for your payment",
+	StatusPartiallyPaid:  "Deposit received",
+	StatusPaid:           "Payment received",
+	StatusConfirmed:      "Confirmed",
+	StatusInProduction:   "Being baked",
+	StatusReady:          "Ready",
+	StatusOutForDelivery: "Out for delivery",
+	StatusDelivered:      "Delivered",
+	StatusCancelled:      "Cancelled",
+	StatusPartRefunded:   "Partly refunded",
+	StatusRefunded:       "Refunded",
+}
+
+// StatusLabel is the order's status for customers, e.g. "Being baked"
+func (o *Order) StatusLabel() string {
+	return statusLabel(o.Status)
+}
+
+// Label is the status this change moved to, for customers
+func (c OrderStatusChange) Label() string {
+	return statusLabel(c.ToStatus)
+}
+
+func statusLabel(status string) string {
+	if label, ok := statusLabels[status]; ok {
+		return label
+	}
+	return status
+}
+
+// AmountDue is what the next payment should be: the deposit if nothing has
+// been paid on a deposit order yet, otherwise whatever is left
+func (o *Order) AmountDue() float64 {
+	if o.AmountPaid == 0 && o.DepositAmount > 0 {
+		return o.DepositAmount
+	}
+	return o.BalanceDue()
+}
+
+// BalanceDue is what is still owed on the order
+func (o *Order) BalanceDue() float64 {
+	if o.AmountPaid >= o.TotalAmount {
+		return 0
+	}
+	return o.TotalAmount - o.AmountPaid
+}
+
 type OrderItem struct {
 	ID               int
 	OrderID          int
@@ -40,6 +515,101 @@ type OrderItem struct {
 	PriceAtPurchase  float64
 }
 
+// Payment is money received against an order, from an STK Push or a C2B payment
+type Payment struct {
+	Source    string // STK, C2B
+	AttemptID int    // The STK Push it answered; 0 for C2B
+	Receipt   string // Empty for an STK Push settled by STK Query until the receipt is known
+	Amount    float64
+	Phone     string
+	PaidAt    string
+}
+
+// PaymentAttempt is one STK Push sent for an order.
+// Safaricom's callback is matched back to it by CheckoutRequestID.
+type PaymentAttempt struct {
+	ID                int
+	OrderID           int
+	MerchantRequestID string
+	CheckoutRequestID string
+	PhoneNumber       string
+	Amount            float64
+	Status            string // SENDING, PENDING, SUCCESS, FAILED, REJECTED, ERROR
+	ResultCode        int
+	ResultDesc        string
+	MpesaReceipt      string
+	CreatedAt         string
+}
+
+// C2BPayment is money a customer sent to our Paybill/Till themselves, reported
+// by Safaricom's C2B confirmation. It is matched to an order by its account
+// reference, or parked as UNALLOCATED until an admin assigns it.
+type C2BPayment struct {
+	ID          int
+	TransID     string // M-Pesa receipt number
+	TransTime   string
+	Amount      float64
+	BillRef     string // What the customer typed as the account number
+	MSISDN      string
+	PayerName   string
+	OrderID     int    // 0 while unallocated
+	Status      string // ALLOCATED, UNALLOCATED
+	Note        string
+	CreatedAt   string
+	AllocatedAt string
+
+	MatchOrderID int    // Order the account number named, applied once Safaricom confirms the payment
+	VerifyToken  string // Secret in the Transaction Status ResultURL
+}
+
+// CartRecovery is a cart or unpaid order we send reminder emails about. It
+// starts as a cart once a checkout visitor has typed their email, and follows
+// them to the order they place from it.
+type CartRecovery struct {
+	ID            int
+	Token         string // In the restore and unsubscribe links
+	Email         string
+	CartID        string
+	OrderID       int     // 0 until the cart becomes an order
+	CartValue     float64 // Cart total when we last saw it
+	Step          int     // Reminders sent since the customer was last active
+	StepSince     time.Time
+	RemindersSent int    // In total, so a later order still counts as recovered
+	Status        string // OPEN, CLOSED
+	CreatedAt     string
+	Order         *Order // Set for orders: code, token, name, total and paid
+}
+
+// RecoveryReport sums up the reminder emails over a period
+type RecoveryReport struct {
+	Days      int
+	Tracked   int     // Carts and unpaid orders we had an email for
+	Reminded  int     // ...that were sent at least one reminder
+	Recovered int     // ...and then became a paid order
+	Revenue   float64 // Paid on those orders
+	OptedOut  int     // Addresses that asked for no more reminders
+}
+
+// Refund is money sent back to a customer, by Reversal or B2C.
+// Safaricom confirms it asynchronously on our ResultURL, matched by ConversationID
+// and checked against the refund's callback token.
+type Refund struct {
+	ID                       int
+	OrderID                  int
+	Method                   string // REVERSAL, B2C
+	Amount                   float64
+	Reason                   string
+	Status                   string // REQUESTED, PENDING, COMPLETED, FAILED
+	OriginatorConversationID string
+	ConversationID           string
+	TransactionID            string
+	ResultCode               int
+	ResultDesc               string
+	CallbackToken            string // Secret part of the ResultURL; never shown
+	CreatedAt                string
+	CompletedAt              string
+}
+
 // TemplateData holds data sent from Go to HTML
 
 type TemplateData struct {
@@ -51,17 +621,42 @@ type TemplateData struct {
 	Variants    []ProductVariant
 	Items       interface{} // Generic field to hold Cart Items
 	Total       float64     // Total Price
+	Deposit     float64     // Part of Total paid upfront, when a deposit applies
+	Notices     []string    // What changed in the cart since the customer added it
+	Days        []FulfilmentDay
+	TimeSlots   []string
+	ClosedDates []ClosedDate
+	Zones       []DeliveryZone
+	Weekdays    []CapacityDay // Default capacity per weekday, Sunday first
+	Calendar    []CapacityDay
 	Order       *Order
 	OrderItems  interface{}
+	Cancel      *CancelQuote
+	Payments    []Payment
+	History     []OrderStatusChange
+	Refunds     []Refund
+	Promotions  []Promotion
+	Promotion   *Promotion // Applied at checkout, or being edited
+	Discount    float64    // What Promotion takes off the checkout Total
+	PromoError  string     // Why the code typed at checkout can't be used
+	Redemptions []Redemption
+	Recoveries  []CartRecovery
+	Recovery    *RecoveryReport
+	C2BPayments []C2BPayment
+	Refundable  float64 // How much of the order can still be refunded
+	Flash       string  // One-off message shown at the top of the page
+	BankDetails string  // Where to send a bank transfer (BANK_TRANSFER_DETAILS)
+	Prompted    bool    // An STK Push was just sent, so the payment page should wait for it
 	IsAdmin     bool
 	CartCount   int
 }
 
 // Category struct
 type Category struct {
-	ID   int
-	Name string
-	Slug string
+	ID             int
+	Name           string
+	Slug           string
+	DepositPercent int // Share of the price paid upfront; 0 means pay in full
 }
 
 // --- MPESA Callback Structures ---
@@ -88,3 +683,56 @@ type CallbackItem struct {
 	Name  string      `json:"Name"`
 	Value interface{} `json:"Value"` // interface{} because Value can be string or float
 }
+
+// --- MPESA Async Result Structures (B2C, Reversal) ---
+
+type MpesaResultResponse struct {
+	Result MpesaResult `json:"Result"`
+}
+
+type MpesaResult struct {
+	ResultType               int    `json:"ResultType"`
+	ResultCode               int    `json:"ResultCode"`
+	ResultDesc               string `json:"ResultDesc"`
+	OriginatorConversationID string `json:"OriginatorConversationID"`
+	ConversationID           string `json:"ConversationID"`
+	TransactionID            string `json:"TransactionID"`
+	ResultParameters         struct {
+		ResultParameter []ResultParameter `json:"ResultParameter"`
+	} `json:"ResultParameters"`
+}
+
+// ResultParameter is one Key/Value pair of an async result; Value may be a string or a number
+type ResultParameter struct {
+	Key   string      `json:"Key"`
+	Value interface{} `json:"Value"`
+}
+
+// Param returns a result parameter as a string, or "" if it is missing
+func (r MpesaResult) Param(key string) string {
+	for _, p := range r.ResultParameters.ResultParameter {
+		if p.Key == key && p.Value != nil {
+			return fmt.Sprint(p.Value)
+		}
+	}
+	return ""
+}
+
+// --- MPESA C2B Structures (Paybill/Till payments made from the customer's phone) ---
+
+// C2BRequest is the body Safaricom posts to both the validation and confirmation URLs
+type C2BRequest struct {
+	TransactionType   string `json:"TransactionType"`
+	TransID           string `json:"TransID"`
+	TransTime         string `json:"TransTime"`
+	TransAmount       string `json:"TransAmount"`
+	BusinessShortCode string `json:"BusinessShortCode"`
+	BillRefNumber     string `json:"BillRefNumber"`
+	InvoiceNumber     string `json:"InvoiceNumber"`
+	OrgAccountBalance string `json:"OrgAccountBalance"`
+	ThirdPartyTransID string `json:"ThirdPartyTransID"`
+	MSISDN            string `json:"MSISDN"`
+	FirstName         string `json:"FirstName"`
+	MiddleName        string `json:"MiddleName"`
+	LastName          string `json:"LastName"`
+}
@@ -0,0 +1,189 @@
+package repository
+
+import (
+	"context"
+	"crave-and-glaze/internal/models"
+	"database/sql"
+	"errors"
+	"math"
+	"time"
+)
+
+var (
+	// ErrDuplicateC2B means Safaricom already confirmed that TransID to us
+	ErrDuplicateC2B = errors.New("c2b payment already recorded")
+	// ErrUnknownC2B means no C2B payment has that ID
+	ErrUnknownC2B = errors.New("unknown c2b payment")
+	// ErrC2BAllocated means the payment is already assigned to an order
+	ErrC2BAllocated = errors.New("c2b payment already allocated")
+	// ErrC2BTooSmall means the payment doesn't cover what is due on the order
+	ErrC2BTooSmall = errors.New("c2b payment is less than the order total")
+)
+
+type C2BModel struct {
+	DB *sql.DB
+}
+
+// Record stores a confirmed C2B payment as UNALLOCATED.
+// Safaricom retries confirmations, so a repeated TransID returns ErrDuplicateC2B.
+func (m *C2BModel) Record(p *models.C2BPayment) (int, error) {
+	stmt := `
+		INSERT INTO c2b_payments (trans_id, trans_time, amount, bill_ref, msisdn, payer_name, status, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, 'UNALLOCATED', $7)
+		ON CONFLICT (trans_id) DO NOTHING
+		RETURNING id
+	`
+	var newID int
+	err := m.DB.QueryRow(stmt, p.TransID, p.TransTime, p.Amount, p.BillRef, p.MSISDN, p.PayerName, time.Now()).Scan(&newID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrDuplicateC2B
+	}
+	return newID, err
+}
+
+// Allocate assigns an unallocated payment to an order and adds it to what the
+// order has been paid, returning its receipt. The order must still be waiting
+// for payment, and the payment must cover at least the deposit or balance due.
+// A receipt an STK Push already paid with returns ErrDuplicateReceipt.
+func (m *C2BModel) Allocate(id, orderID int, note string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var transID, status string
+	var amount float64
+	err = tx.QueryRowContext(ctx, `SELECT trans_id, amount, status FROM c2b_payments WHERE id = $1 FOR UPDATE`, id).Scan(&transID, &amount, &status)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrUnknownC2B
+	}
+	if err != nil {
+		return "", err
+	}
+	if status != "UNALLOCATED" {
+		return "", ErrC2BAllocated
+	}
+
+	// Paybill payments made by STK Push can be confirmed to the C2B URL too;
+	// the STK callback already counted those
+	if err = lockReceipt(ctx, tx, transID); err != nil {
+		return "", err
+	}
+	var used bool
+	err = tx.QueryRowContext(ctx,
+		`SELECT EXISTS (SELECT 1 FROM payment_attempts WHERE mpesa_receipt = $1)`, transID,
+	).Scan(&used)
+	if err != nil {
+		return "", err
+	}
+	if used {
+		return "", ErrDuplicateReceipt
+	}
+
+	order, err := loadForPayment(ctx, tx, orderID)
+	if err != nil {
+		return "", err
+	}
+	if !order.AcceptsPayment() {
+		return "", ErrOrderNotPayable
+	}
+	// It must cover the deposit or the balance, rounded up to whole shillings like the STK Push
+	if amount < math.Ceil(order.AmountDue()) {
+		return "", ErrC2BTooSmall
+	}
+
+	if _, err = addPayment(ctx, tx, orderID, amount, transID, "c2b"); err != nil {
+		return "", err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE c2b_payments SET status = 'ALLOCATED', order_id = $1, note = NULLIF($2, ''), allocated_at = $3
+		WHERE id = $4`,
+		orderID, note, time.Now(), id,
+	)
+	if err != nil {
+		return "", err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return "", err
+	}
+	return transID, nil
+}
+
+// StartVerify remembers which order an unallocated payment named while
+// Safaricom confirms it, and returns a fresh secret for the Transaction Status
+// ResultURL
+func (m *C2BModel) StartVerify(id, orderID int) (string, error) {
+	token, err := newToken(32)
+	if err != nil {
+		return "", err
+	}
+	res, err := m.DB.Exec(
+		`UPDATE c2b_payments SET match_order_id = $1, verify_token = $2 WHERE id = $3 AND status = 'UNALLOCATED'`,
+		orderID, token, id,
+	)
+	if err != nil {
+		return "", err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		if err == nil {
+			err = ErrC2BAllocated
+		}
+		return "", err
+	}
+	return token, nil
+}
+
+// ByVerifyToken finds the unallocated payment a Transaction Status result is for
+func (m *C2BModel) ByVerifyToken(token string) (*models.C2BPayment, error) {
+	p := &models.C2BPayment{}
+	err := m.DB.QueryRow(`
+		SELECT id, trans_id, amount, status, COALESCE(match_order_id, 0), verify_token
+		FROM c2b_payments WHERE verify_token = $1 AND status = 'UNALLOCATED'`,
+		token,
+	).Scan(&p.ID, &p.TransID, &p.Amount, &p.Status, &p.MatchOrderID, &p.VerifyToken)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrUnknownC2B
+	}
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// SetNote records why a payment couldn't be allocated automatically, and stops
+// any Transaction Status result still to come from applying it
+func (m *C2BModel) SetNote(id int, note string) error {
+	_, err := m.DB.Exec(`UPDATE c2b_payments SET note = $1, verify_token = NULL WHERE id = $2`, note, id)
+	return err
+}
+
+// Unallocated lists the payments waiting for an admin to assign them, oldest first
+func (m *C2BModel) Unallocated() ([]models.C2BPayment, error) {
+	stmt := `
+		SELECT id, trans_id, COALESCE(trans_time, ''), amount, COALESCE(bill_ref, ''), COALESCE(msisdn, ''),
+		       COALESCE(payer_name, ''), COALESCE(note, ''), created_at
+		FROM c2b_payments WHERE status = 'UNALLOCATED' ORDER BY id ASC
+	`
+	rows, err := m.DB.Query(stmt)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var payments []models.C2BPayment
+	for rows.Next() {
+		p := models.C2BPayment{Status: "UNALLOCATED"}
+		err = rows.Scan(&p.ID, &p.TransID, &p.TransTime, &p.Amount, &p.BillRef, &p.MSISDN, &p.PayerName, &p.Note, &p.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		payments = append(payments, p)
+	}
+	return payments, rows.Err()
+}
@@ -0,0 +1,253 @@
+package repository
+
+import (
+	"context"
+	"crave-and-glaze/internal/models"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// ErrFullyBooked means the order's fulfilment date has no room left for it
+var ErrFullyBooked = errors.New("fulfilment date is fully booked")
+
+// Booking asks Create to check the order still fits in its fulfilment date's
+// capacity, with the date locked so two checkouts can't both take the last spot
+type Booking struct {
+	Load      models.DayLoad
+	HoldSince time.Time // Unpaid orders older than this no longer hold their place
+}
+
+// CalendarModel holds the days the bakery can't bake or hand over cakes
+type CalendarModel struct {
+	DB *sql.DB
+}
+
+// ClosedBetween returns the closed dates from one day to another (inclusive),
+// keyed by YYYY-MM-DD with the reason as the value
+func (m *CalendarModel) ClosedBetween(from, to time.Time) (map[string]string, error) {
+	stmt := `SELECT closed_on::text, COALESCE(reason, '') FROM closed_dates WHERE closed_on BETWEEN $1 AND $2`
+	rows, err := m.DB.Query(stmt, from.Format(models.DateLayout), to.Format(models.DateLayout))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	closed := make(map[string]string)
+	for rows.Next() {
+		var date, reason string
+		if err = rows.Scan(&date, &reason); err != nil {
+			return nil, err
+		}
+		closed[date] = reason
+	}
+	return closed, rows.Err()
+}
+
+// UpcomingClosed lists closed dates from today on, soonest first
+func (m *CalendarModel) UpcomingClosed() ([]models.ClosedDate, error) {
+	stmt := `SELECT closed_on::text, COALESCE(reason, '') FROM closed_dates WHERE closed_on >= CURRENT_DATE ORDER BY closed_on ASC`
+	rows, err := m.DB.Query(stmt)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var dates []models.ClosedDate
+	for rows.Next() {
+		var d models.ClosedDate
+		if err = rows.Scan(&d.Date, &d.Reason); err != nil {
+			return nil, err
+		}
+		dates = append(dates, d)
+	}
+	return dates, rows.Err()
+}
+
+// Close marks a date closed, or updates the reason if it already is
+func (m *CalendarModel) Close(date, reason string) error {
+	stmt := `
+		INSERT INTO closed_dates (closed_on, reason) VALUES ($1, NULLIF($2, ''))
+		ON CONFLICT (closed_on) DO UPDATE SET reason = EXCLUDED.reason
+	`
+	_, err := m.DB.Exec(stmt, date, reason)
+	return err
+}
+
+// Reopen removes a closed date
+func (m *CalendarModel) Reopen(date string) error {
+	_, err := m.DB.Exec(`DELETE FROM closed_dates WHERE closed_on = $1`, date)
+	return err
+}
+
+// WeekdayCapacity returns the default capacity for each day of the week,
+// indexed by time.Weekday (Sunday first). Days never set have no limit.
+func (m *CalendarModel) WeekdayCapacity() ([]models.Capacity, error) {
+	rows, err := m.DB.Query(`SELECT weekday, COALESCE(max_kg, 0), COALESCE(max_cakes, 0) FROM capacity_defaults`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	caps := make([]models.Capacity, 7)
+	for rows.Next() {
+		var day int
+		var c models.Capacity
+		if err = rows.Scan(&day, &c.MaxKg, &c.MaxCakes); err != nil {
+			return nil, err
+		}
+		if day >= 0 && day < 7 {
+			caps[day] = c
+		}
+	}
+	return caps, rows.Err()
+}
+
+// SetWeekdayCapacity changes the default capacity for a day of the week
+func (m *CalendarModel) SetWeekdayCapacity(weekday time.Weekday, c models.Capacity) error {
+	stmt := `
+		INSERT INTO capacity_defaults (weekday, max_kg, max_cakes) VALUES ($1, $2, $3)
+		ON CONFLICT (weekday) DO UPDATE SET max_kg = EXCLUDED.max_kg, max_cakes = EXCLUDED.max_cakes
+	`
+	_, err := m.DB.Exec(stmt, int(weekday), c.MaxKg, c.MaxCakes)
+	return err
+}
+
+// CapacityOverrides returns the dates between from and to (inclusive) whose
+// capacity replaces their weekday's, keyed by YYYY-MM-DD
+func (m *CalendarModel) CapacityOverrides(from, to time.Time) (map[string]models.Capacity, error) {
+	stmt := `
+		SELECT on_date::text, COALESCE(max_kg, 0), COALESCE(max_cakes, 0)
+		FROM capacity_overrides WHERE on_date BETWEEN $1 AND $2
+	`
+	rows, err := m.DB.Query(stmt, from.Format(models.DateLayout), to.Format(models.DateLayout))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	overrides := make(map[string]models.Capacity)
+	for rows.Next() {
+		var date string
+		var c models.Capacity
+		if err = rows.Scan(&date, &c.MaxKg, &c.MaxCakes); err != nil {
+			return nil, err
+		}
+		overrides[date] = c
+	}
+	return overrides, rows.Err()
+}
+
+// SetCapacityOverride sets the capacity for one date, e.g. extra staff before a holiday
+func (m *CalendarModel) SetCapacityOverride(date string, c models.Capacity) error {
+	stmt := `
+		INSERT INTO capacity_overrides (on_date, max_kg, max_cakes) VALUES ($1, $2, $3)
+		ON CONFLICT (on_date) DO UPDATE SET max_kg = EXCLUDED.max_kg, max_cakes = EXCLUDED.max_cakes
+	`
+	_, err := m.DB.Exec(stmt, date, c.MaxKg, c.MaxCakes)
+	return err
+}
+
+// DeleteCapacityOverride puts a date back on its weekday's capacity
+func (m *CalendarModel) DeleteCapacityOverride(date string) error {
+	_, err := m.DB.Exec(`DELETE FROM capacity_overrides WHERE on_date = $1`, date)
+	return err
+}
+
+// bookedQuery lists the cakes booked for dates $1 to $2. Orders in $3 count,
+// delivered ones included; unpaid ones only count while they are younger than $4.
+const bookedQuery = `
+	SELECT o.fulfilment_date::text, pv.weight_label, oi.quantity
+	FROM orders o
+	JOIN order_items oi ON oi.order_id = o.id
+	JOIN product_variants pv ON pv.id = oi.product_variant_id
+	WHERE o.fulfilment_date BETWEEN $1 AND $2
+	  AND (o.status = ANY($3) OR (o.status IN ('PENDING_PAYMENT', 'FAILED') AND o.created_at >= $4))
+`
+
+// Booked adds up the cake booked for each date between from and to
+// (inclusive). Unpaid orders only count while they are younger than
+// holdSince, so an abandoned checkout frees its slot.
+func (m *CalendarModel) Booked(from, to, holdSince time.Time) (map[string]models.DayLoad, error) {
+	rows, err := m.DB.Query(bookedQuery,
+		from.Format(models.DateLayout), to.Format(models.DateLayout),
+		pq.Array(models.CapacityStatuses), holdSince,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return sumBooked(rows)
+}
+
+// sumBooked adds up the rows of bookedQuery by date, and closes them
+func sumBooked(rows *sql.Rows) (map[string]models.DayLoad, error) {
+	defer rows.Close()
+
+	booked := make(map[string]models.DayLoad)
+	for rows.Next() {
+		var date, label string
+		var qty int
+		if err := rows.Scan(&date, &label, &qty); err != nil {
+			return nil, err
+		}
+		booked[date] = booked[date].Add(models.DayLoad{Kg: models.ParseKg(label) * float64(qty), Cakes: qty})
+	}
+	return booked, rows.Err()
+}
+
+// dayFits locks a date for the rest of the transaction and reports whether
+// load still fits in its capacity alongside what is already booked. Locking
+// the date, rather than any row, also covers dates with nothing booked yet.
+func dayFits(ctx context.Context, tx *sql.Tx, date string, load models.DayLoad, holdSince time.Time) (bool, error) {
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtext('capacity'), $1::date - DATE '2000-01-01')`, date); err != nil {
+		return false, err
+	}
+
+	// The date's override, or its weekday's default; neither means no limit
+	var c models.Capacity
+	err := tx.QueryRowContext(ctx, `
+		SELECT max_kg, max_cakes FROM capacity_overrides WHERE on_date = $1
+		UNION ALL
+		SELECT max_kg, max_cakes FROM capacity_defaults WHERE weekday = EXTRACT(DOW FROM $1::date)
+		LIMIT 1`,
+		date,
+	).Scan(&c.MaxKg, &c.MaxCakes)
+	if errors.Is(err, sql.ErrNoRows) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	rows, err := tx.QueryContext(ctx, bookedQuery, date, date, pq.Array(models.CapacityStatuses), holdSince)
+	if err != nil {
+		return false, err
+	}
+	booked, err := sumBooked(rows)
+	if err != nil {
+		return false, err
+	}
+	return c.Fits(booked[date].Add(load)), nil
+}
+
+// noteOverbooked adds a warning to an order's history when its fulfilment
+// date is now booked beyond capacity, e.g. because it was paid after its
+// unpaid hold lapsed and the place was given to someone else. The money is
+// already in, so the order goes ahead and the kitchen has to make room.
+func noteOverbooked(ctx context.Context, tx *sql.Tx, orderID int, status string) error {
+	var date string
+	err := tx.QueryRowContext(ctx, `SELECT COALESCE(fulfilment_date::text, '') FROM orders WHERE id = $1`, orderID).Scan(&date)
+	if err != nil || date == "" {
+		return err
+	}
+
+	// Only orders that went ahead count, this one included
+	fits, err := dayFits(ctx, tx, date, models.DayLoad{}, time.Now())
+	if err != nil || fits {
+		return err
+	}
+	return logStatus(ctx, tx, orderID, status, status, "system", fmt.Sprintf("%s is now booked beyond the kitchen's capacity", date))
+}
@@ -0,0 +1,70 @@
+package repository
+
+import (
+	"crave-and-glaze/internal/models"
+	"fmt"
+	"strings"
+)
+
+// ExportLine is one cake on one order, as the accountant sees it
+type ExportLine struct {
+	Order       models.Order
+	ProductName string
+	WeightLabel string
+	Quantity    int
+	Price       float64 // Per cake, at the time of the order
+}
+
+// Export calls each for every line of every order matching the filter, oldest
+// order first. Rows are read from Postgres as they are written out, so a
+// year of orders never sits in memory. Sort, After and Limit are ignored.
+func (m *OrderModel) Export(f OrderFilter, each func(*ExportLine) error) error {
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	where := f.conditions("o.", arg)
+
+	stmt := `
+		SELECT o.id, COALESCE(o.public_code, ''), o.created_at, o.status,
+		       o.first_name, o.last_name, o.customer_phone, o.email,
+		       COALESCE(o.payment_method, 'MPESA'), COALESCE(o.mpesa_receipt, ''),
+		       COALESCE(o.fulfilment_type, ''), COALESCE(o.fulfilment_date::text, ''), COALESCE(o.time_slot, ''),
+		       COALESCE(o.delivery_fee, 0), COALESCE(o.discount_code, ''), COALESCE(o.discount_amount, 0),
+		       o.total_amount, COALESCE(o.amount_paid, 0),
+		       p.name, pv.weight_label, oi.quantity, oi.price_at_purchase
+		FROM orders o
+		JOIN order_items oi ON oi.order_id = o.id
+		JOIN product_variants pv ON pv.id = oi.product_variant_id
+		JOIN products p ON p.id = pv.product_id`
+	if len(where) > 0 {
+		stmt += "\n\t\tWHERE " + strings.Join(where, "\n\t\t  AND ")
+	}
+	stmt += "\n\t\tORDER BY o.id ASC, oi.id ASC"
+
+	rows, err := m.DB.Query(stmt, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var line ExportLine
+	for rows.Next() {
+		o := &line.Order
+		err = rows.Scan(&o.ID, &o.PublicCode, &o.CreatedAt, &o.Status,
+			&o.FirstName, &o.LastName, &o.CustomerPhone, &o.Email,
+			&o.PaymentMethod, &o.MpesaReceipt,
+			&o.FulfilmentType, &o.FulfilmentDate, &o.TimeSlot,
+			&o.DeliveryFee, &o.DiscountCode, &o.DiscountAmount,
+			&o.TotalAmount, &o.AmountPaid,
+			&line.ProductName, &line.WeightLabel, &line.Quantity, &line.Price)
+		if err != nil {
+			return err
+		}
+		if err = each(&line); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
@@ -0,0 +1,213 @@
+package repository
+
+import (
+	"crave-and-glaze/internal/models"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ErrBadCursor means the page cursor wasn't one Search handed out (or was for another sort)
+var ErrBadCursor = errors.New("invalid page cursor")
+
+// OrderFilter narrows the admin order list. Empty fields don't filter.
+type OrderFilter struct {
+	Status     string
+	From       string // Placed on or after, YYYY-MM-DD
+	To         string // Placed on or before, YYYY-MM-DD
+	Fulfilment string // Due on, YYYY-MM-DD
+	Phone      string // Any part of the M-Pesa or WhatsApp number, however it's typed
+	Name       string
+	Email      string
+	Receipt    string // M-Pesa receipt from an STK Push or a Paybill payment
+	Sort       string // One of OrderSorts; newest first by default
+	After      string // Cursor from the previous page
+	Limit      int
+}
+
+// orderSort is a way of ordering the list. The ID breaks ties, so every row
+// has a unique position a page can start after.
+type orderSort struct {
+	key  string // Column sorted on before the ID; empty sorts on the ID alone
+	cast string // Type of key, for comparing against the cursor
+	desc bool
+}
+
+var orderSorts = map[string]orderSort{
+	"newest":     {desc: true},
+	"oldest":     {},
+	"fulfilment": {key: "COALESCE(fulfilment_date, DATE '9999-12-31')", cast: "date"},
+	"amount":     {key: "total_amount", cast: "numeric", desc: true},
+}
+
+// OrderSorts lists the sort options the admin order list accepts
+var OrderSorts = []string{"newest", "oldest", "fulfilment", "amount"}
+
+// defaultPageSize is how many orders a page shows when the filter doesn't say
+const defaultPageSize = 50
+
+// Search lists the orders matching the filter, one page at a time. It returns
+// the cursor for the next page, or "" on the last page.
+func (m *OrderModel) Search(f OrderFilter) ([]models.Order, string, error) {
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	where := f.conditions("", arg)
+
+	sort, ok := orderSorts[f.Sort]
+	if !ok {
+		sort = orderSorts["newest"]
+	}
+	cmp, dir := ">", "ASC"
+	if sort.desc {
+		cmp, dir = "<", "DESC"
+	}
+	key := "''"
+	order := "id " + dir
+	if sort.key != "" {
+		key = sort.key + "::text"
+		order = sort.key + " " + dir + ", " + order
+	}
+
+	// Keyset pagination: carry on after the last row of the previous page, so
+	// deep pages cost the same as the first and new orders don't shift them
+	if f.After != "" {
+		afterKey, afterID, ok := parseCursor(f.After, sort.key != "")
+		if !ok {
+			return nil, "", ErrBadCursor
+		}
+		if sort.key == "" {
+			where = append(where, "id "+cmp+" "+arg(afterID))
+		} else {
+			where = append(where, fmt.Sprintf("(%s, id) %s (%s::%s, %s)", sort.key, cmp, arg(afterKey), sort.cast, arg(afterID)))
+		}
+	}
+
+	limit := f.Limit
+	if limit <= 0 {
+		limit = defaultPageSize
+	}
+
+	stmt := `
+		SELECT id, COALESCE(public_code, ''), first_name, last_name, email, whatsapp_number, customer_phone,
+		       total_amount, COALESCE(amount_paid, 0), status, COALESCE(mpesa_receipt, ''),
+		       COALESCE(fulfilment_type, ''), COALESCE(fulfilment_date::text, ''), COALESCE(time_slot, ''),
+		       created_at, ` + key + `
+		FROM orders`
+	if len(where) > 0 {
+		stmt += "\n\t\tWHERE " + strings.Join(where, "\n\t\t  AND ")
+	}
+	// One extra row tells us whether there is a next page
+	stmt += "\n\t\tORDER BY " + order + "\n\t\tLIMIT " + arg(limit+1)
+
+	rows, err := m.DB.Query(stmt, args...)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	var orders []models.Order
+	var keys []string
+	for rows.Next() {
+		var o models.Order
+		var k string
+		err = rows.Scan(&o.ID, &o.PublicCode, &o.FirstName, &o.LastName, &o.Email, &o.WhatsappNumber, &o.CustomerPhone,
+			&o.TotalAmount, &o.AmountPaid, &o.Status, &o.MpesaReceipt,
+			&o.FulfilmentType, &o.FulfilmentDate, &o.TimeSlot, &o.CreatedAt, &k)
+		if err != nil {
+			return nil, "", err
+		}
+		orders = append(orders, o)
+		keys = append(keys, k)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, "", err
+	}
+
+	if len(orders) <= limit {
+		return orders, "", nil
+	}
+	orders = orders[:limit]
+	last := orders[limit-1]
+	next := strconv.Itoa(last.ID)
+	if sort.key != "" {
+		next = keys[limit-1] + "," + next
+	}
+	return orders, next, nil
+}
+
+// conditions turns the filter into WHERE clauses on the orders table, whose
+// columns are prefixed with col (e.g. "o.") when it is joined to others.
+// arg adds a query argument and returns its placeholder.
+func (f OrderFilter) conditions(col string, arg func(interface{}) string) []string {
+	var where []string
+	if f.Status != "" {
+		where = append(where, col+"status = "+arg(f.Status))
+	}
+	if f.From != "" {
+		where = append(where, col+"created_at >= "+arg(f.From)+"::date")
+	}
+	if f.To != "" {
+		where = append(where, col+"created_at < "+arg(f.To)+"::date + 1")
+	}
+	if f.Fulfilment != "" {
+		where = append(where, col+"fulfilment_date = "+arg(f.Fulfilment)+"::date")
+	}
+	if digits := phoneDigits(f.Phone); digits != "" {
+		n := arg("%" + digits + "%")
+		where = append(where, fmt.Sprintf(
+			`(regexp_replace(%scustomer_phone, '\D', '', 'g') LIKE %s OR regexp_replace(COALESCE(%swhatsapp_number, ''), '\D', '', 'g') LIKE %s)`, col, n, col, n))
+	}
+	if name := strings.TrimSpace(f.Name); name != "" {
+		where = append(where, "("+col+"first_name || ' ' || "+col+"last_name) ILIKE "+arg("%"+escapeLike(name)+"%"))
+	}
+	if email := strings.TrimSpace(f.Email); email != "" {
+		where = append(where, col+"email ILIKE "+arg("%"+escapeLike(email)+"%"))
+	}
+	if receipt := strings.ToUpper(strings.TrimSpace(f.Receipt)); receipt != "" {
+		n := arg(receipt)
+		where = append(where, fmt.Sprintf(`(%smpesa_receipt = %s
+			OR %sid IN (SELECT order_id FROM payment_attempts WHERE mpesa_receipt = %s)
+			OR %sid IN (SELECT order_id FROM c2b_payments WHERE trans_id = %s))`, col, n, col, n, col, n))
+	}
+	return where
+}
+
+// parseCursor splits a page cursor into the sort key (if the sort has one) and the ID
+func parseCursor(cursor string, keyed bool) (string, int, bool) {
+	var key string
+	if keyed {
+		i := strings.LastIndex(cursor, ",")
+		if i < 0 {
+			return "", 0, false
+		}
+		key, cursor = cursor[:i], cursor[i+1:]
+	}
+	id, err := strconv.Atoi(cursor)
+	if err != nil {
+		return "", 0, false
+	}
+	return key, id, true
+}
+
+// phoneDigits reduces a phone number to its digits after the country code or
+// leading 0, so "0712 345 678" and "+254712345678" find the same orders
+func phoneDigits(phone string) string {
+	var b strings.Builder
+	for _, r := range phone {
+		if r >= '0' && r <= '9' {
+			b.WriteRune(r)
+		}
+	}
+	digits := b.String()
+	digits = strings.TrimPrefix(digits, "254")
+	return strings.TrimPrefix(digits, "0")
+}
+
+// escapeLike stops % and _ typed into a search box acting as wildcards
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
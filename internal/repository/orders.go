@@ -3,16 +3,33 @@ package repository
 import (
 	"context"
 	"crave-and-glaze/internal/models"
+	"crypto/rand"
 	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
 	"time"
+
+	"github.com/lib/pq"
+)
+
+var (
+	// ErrUnknownOrder means there is no order with that ID
+	ErrUnknownOrder = errors.New("order not found")
+	// ErrBadTransition means the order's lifecycle doesn't allow the status change
+	ErrBadTransition = errors.New("order cannot move to that status")
 )
 
 type OrderModel struct {
 	DB *sql.DB
 }
 
-// Create places a new order and its items into the database transactionally
-func (m *OrderModel) Create(order *models.Order, items []models.OrderItem) (int, error) {
+// Create places a new order and its items into the database transactionally.
+// With a claim, the order's discount code is redeemed too, or the order is not
+// placed (ErrPromotionUsedUp, ErrPromotionLimit). With a booking, the order
+// must still fit in its fulfilment date's capacity (ErrFullyBooked).
+func (m *OrderModel) Create(order *models.Order, items []models.OrderItem, claim *PromotionClaim, booking *Booking) (int, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
@@ -22,10 +39,37 @@ func (m *OrderModel) Create(order *models.Order, items []models.OrderItem) (int,
 	}
 	defer tx.Rollback()
 
+	if booking != nil && order.FulfilmentDate != "" {
+		fits, err := dayFits(ctx, tx, order.FulfilmentDate, booking.Load, booking.HoldSince)
+		if err != nil {
+			return 0, err
+		}
+		if !fits {
+			return 0, ErrFullyBooked
+		}
+	}
+
+	// Each order gets its own unguessable callback URL for M-Pesa
+	callbackToken, err := newToken(32)
+	if err != nil {
+		return 0, err
+	}
+
+	// ...and its own references for customers, so links can't be guessed from the ID
+	if order.PublicToken, err = newToken(24); err != nil {
+		return 0, err
+	}
+	if order.PublicCode, err = newPublicCode(ctx, tx); err != nil {
+		return 0, err
+	}
+
 	// Updated SQL Insert
 	stmt := `
-		INSERT INTO orders (first_name, last_name, email, whatsapp_number, customer_phone, total_amount, status, created_at)
-		VALUES ($1, $2, $3, $4, $5, $6, 'PENDING', $7)
+		INSERT INTO orders (first_name, last_name, email, whatsapp_number, customer_phone, total_amount, deposit_amount, status, callback_token,
+		                    fulfilment_type, fulfilment_date, time_slot, delivery_zone, delivery_address, delivery_fee,
+		                    public_code, public_token, discount_code, discount_amount, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, NULLIF($10, ''), NULLIF($11, '')::date, NULLIF($12, ''),
+		        NULLIF($13, ''), NULLIF($14, ''), $15, $16, $17, NULLIF($18, ''), $19, $20)
 		RETURNING id
 	`
 
@@ -37,6 +81,19 @@ func (m *OrderModel) Create(order *models.Order, items []models.OrderItem) (int,
 		order.WhatsappNumber,
 		order.CustomerPhone, // MPESA Number
 		order.TotalAmount,
+		order.DepositAmount,
+		models.StatusPendingPayment,
+		callbackToken,
+		order.FulfilmentType,
+		order.FulfilmentDate,
+		order.TimeSlot,
+		order.DeliveryZone,
+		order.Address,
+		order.DeliveryFee,
+		order.PublicCode,
+		order.PublicToken,
+		order.DiscountCode,
+		order.DiscountAmount,
 		time.Now(),
 	).Scan(&newID)
 
@@ -44,6 +101,16 @@ func (m *OrderModel) Create(order *models.Order, items []models.OrderItem) (int,
 		return 0, err
 	}
 
+	if err = logStatus(ctx, tx, newID, "", models.StatusPendingPayment, "customer", "order placed"); err != nil {
+		return 0, err
+	}
+
+	if claim != nil {
+		if err = redeem(ctx, tx, newID, order.DiscountAmount, claim); err != nil {
+			return 0, err
+		}
+	}
+
 	// ... (The rest of the item insertion logic stays the same) ...
 
 	stmtItem := `INSERT INTO order_items (order_id, product_variant_id, quantity, icing_flavor, custom_message, price_at_purchase) VALUES ($1, $2, $3, $4, $5, $6)`
@@ -60,10 +127,22 @@ func (m *OrderModel) Create(order *models.Order, items []models.OrderItem) (int,
 	return newID, nil
 }
 
-// GetAll fetches all orders descending
-func (m *OrderModel) GetAll() ([]models.Order, error) {
-	stmt := `SELECT id, first_name, last_name, email, whatsapp_number, customer_phone, total_amount, status, created_at FROM orders ORDER BY id DESC`
-	rows, err := m.DB.Query(stmt)
+// Schedule lists the orders due to be collected or delivered over the next
+// few days, by date and time slot. Unpaid and cancelled orders are left out;
+// manual payment orders are in, as the customer pays on pickup.
+func (m *OrderModel) Schedule(from time.Time, days int) ([]models.Order, error) {
+	stmt := `
+		SELECT id, first_name, last_name, customer_phone, total_amount, COALESCE(amount_paid, 0), status,
+		       fulfilment_type, fulfilment_date::text, time_slot
+		FROM orders
+		WHERE fulfilment_date >= $1 AND fulfilment_date < $2
+		  AND status = ANY($3)
+		ORDER BY fulfilment_date ASC, time_slot ASC, id ASC
+	`
+	rows, err := m.DB.Query(stmt,
+		from.Format(models.DateLayout), from.AddDate(0, 0, days).Format(models.DateLayout),
+		pq.Array(models.ScheduledStatuses),
+	)
 	if err != nil {
 		return nil, err
 	}
@@ -72,34 +151,243 @@ func (m *OrderModel) GetAll() ([]models.Order, error) {
 	var orders []models.Order
 	for rows.Next() {
 		var o models.Order
-		err = rows.Scan(&o.ID, &o.FirstName, &o.LastName, &o.Email, &o.WhatsappNumber, &o.CustomerPhone, &o.TotalAmount, &o.Status, &o.CreatedAt)
+		err = rows.Scan(&o.ID, &o.FirstName, &o.LastName, &o.CustomerPhone, &o.TotalAmount, &o.AmountPaid, &o.Status,
+			&o.FulfilmentType, &o.FulfilmentDate, &o.TimeSlot)
 		if err != nil {
 			return nil, err
 		}
 		orders = append(orders, o)
 	}
-	return orders, nil
+	return orders, rows.Err()
+}
+
+// Transition moves an order to a new status if its lifecycle allows it, and
+// records who did it in the order's history
+func (m *OrderModel) Transition(id int, to, changedBy, note string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	from, err := lockStatus(ctx, tx, id)
+	if err != nil {
+		return err
+	}
+	if from == to {
+		return nil
+	}
+	if err = setStatus(ctx, tx, id, from, to, changedBy, note); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// CancelByCustomer cancels an order at the customer's request. refundPercent
+// of what they paid (less anything already refunded) is recorded as a
+// REQUESTED refund for an admin to send; it returns that amount. While an
+// M-Pesa prompt is still open it returns ErrAttemptInFlight, as the customer
+// may yet pay it.
+func (m *OrderModel) CancelByCustomer(id, refundPercent int) (float64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	order, err := loadForPayment(ctx, tx, id)
+	if errors.Is(err, ErrOrderNotPayable) {
+		return 0, ErrUnknownOrder
+	}
+	if err != nil {
+		return 0, err
+	}
+	var receipt string
+	err = tx.QueryRowContext(ctx,
+		`SELECT COALESCE(mpesa_receipt, ''), COALESCE(fulfilment_date::text, '') FROM orders WHERE id = $1`, id,
+	).Scan(&receipt, &order.FulfilmentDate)
+	if err != nil {
+		return 0, err
+	}
+	if !order.CustomerCanCancel() {
+		return 0, fmt.Errorf("%w: customer cannot cancel a %s order", ErrBadTransition, order.Status)
+	}
+
+	var open bool
+	err = tx.QueryRowContext(ctx,
+		`SELECT EXISTS (SELECT 1 FROM payment_attempts WHERE order_id = $1 AND status IN ('SENDING', 'PENDING'))`, id,
+	).Scan(&open)
+	if err != nil {
+		return 0, err
+	}
+	if open {
+		return 0, ErrAttemptInFlight
+	}
+
+	var committed float64
+	err = tx.QueryRowContext(ctx,
+		`SELECT COALESCE(SUM(amount), 0) FROM refunds WHERE order_id = $1 AND status IN ('REQUESTED', 'PENDING', 'COMPLETED')`, id,
+	).Scan(&committed)
+	if err != nil {
+		return 0, err
+	}
+
+	// M-Pesa sends whole shillings; round down so we never send more than was paid
+	refund := math.Floor(order.AmountPaid * float64(refundPercent) / 100)
+	if refund > order.AmountPaid-committed {
+		refund = math.Floor(order.AmountPaid - committed)
+	}
+
+	note := "cancelled online, nothing to refund"
+	if refund > 0 {
+		note = fmt.Sprintf("cancelled online, KES %.2f (%d%%) to refund", refund, refundPercent)
+
+		// A reversal needs the original receipt; otherwise send it to their number
+		method := "B2C"
+		if receipt != "" {
+			method = "REVERSAL"
+		}
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO refunds (order_id, method, amount, reason, status, created_at)
+			VALUES ($1, $2, $3, $4, 'REQUESTED', $5)`,
+			id, method, refund, fmt.Sprintf("Cancelled by customer (%d%% refund)", refundPercent), time.Now(),
+		)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if err = setStatus(ctx, tx, id, order.Status, models.StatusCancelled, "customer", note); err != nil {
+		return 0, err
+	}
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+	return refund, nil
 }
 
-// UpdateStatus changes the order status
-func (m *OrderModel) UpdateStatus(id int, status string) error {
-	stmt := `UPDATE orders SET status = $1 WHERE id = $2`
-	_, err := m.DB.Exec(stmt, status, id)
+// History lists an order's status changes, oldest first
+func (m *OrderModel) History(orderID int) ([]models.OrderStatusChange, error) {
+	stmt := `
+		SELECT COALESCE(from_status, ''), to_status, changed_by, COALESCE(note, ''), created_at::text
+		FROM order_status_history WHERE order_id = $1 ORDER BY id ASC
+	`
+	rows, err := m.DB.Query(stmt, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var history []models.OrderStatusChange
+	for rows.Next() {
+		var c models.OrderStatusChange
+		if err = rows.Scan(&c.FromStatus, &c.ToStatus, &c.ChangedBy, &c.Note, &c.CreatedAt); err != nil {
+			return nil, err
+		}
+		history = append(history, c)
+	}
+	return history, rows.Err()
+}
+
+// lockStatus locks an order row for the rest of the transaction and returns its status
+func lockStatus(ctx context.Context, tx *sql.Tx, orderID int) (string, error) {
+	var status string
+	err := tx.QueryRowContext(ctx, `SELECT status FROM orders WHERE id = $1 FOR UPDATE`, orderID).Scan(&status)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrUnknownOrder
+	}
+	return status, err
+}
+
+// setStatus moves a locked order from one status to another and records it.
+// Every status change goes through here so the history is complete.
+func setStatus(ctx context.Context, tx *sql.Tx, orderID int, from, to, changedBy, note string) error {
+	if !models.CanTransition(from, to) {
+		return fmt.Errorf("%w: %s to %s", ErrBadTransition, from, to)
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE orders SET status = $1 WHERE id = $2`, to, orderID); err != nil {
+		return err
+	}
+	return logStatus(ctx, tx, orderID, from, to, changedBy, note)
+}
+
+func logStatus(ctx context.Context, tx *sql.Tx, orderID int, from, to, changedBy, note string) error {
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO order_status_history (order_id, from_status, to_status, changed_by, note, created_at)
+		VALUES ($1, NULLIF($2, ''), $3, $4, NULLIF($5, ''), $6)`,
+		orderID, from, to, changedBy, note, time.Now(),
+	)
 	return err
 }
 
+// loadForPayment locks an order and reads what is needed to apply money to it
+func loadForPayment(ctx context.Context, tx *sql.Tx, orderID int) (*models.Order, error) {
+	o := &models.Order{ID: orderID}
+	err := tx.QueryRowContext(ctx, `
+		SELECT total_amount, status, COALESCE(deposit_amount, 0), COALESCE(amount_paid, 0)
+		FROM orders WHERE id = $1 FOR UPDATE`,
+		orderID,
+	).Scan(&o.TotalAmount, &o.Status, &o.DepositAmount, &o.AmountPaid)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrOrderNotPayable
+	}
+	if err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
 // Get Fetch a single order by ID
 func (m *OrderModel) Get(id int) (*models.Order, error) {
+	return m.getBy("id", id)
+}
+
+// GetByToken fetches the order a customer link points to
+func (m *OrderModel) GetByToken(token string) (*models.Order, error) {
+	if token == "" {
+		return nil, sql.ErrNoRows
+	}
+	return m.getBy("public_token", token)
+}
+
+// GetByCode fetches an order by the reference customers quote, e.g. "CG-7K3M9Q"
+func (m *OrderModel) GetByCode(code string) (*models.Order, error) {
+	code, ok := models.ParsePublicCode(code)
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return m.getBy("public_code", code)
+}
+
+// getBy fetches a single order by one of its unique columns
+func (m *OrderModel) getBy(column string, value interface{}) (*models.Order, error) {
 	// Added mpesa_receipt to the SELECT list
 	stmt := `
 		SELECT id, first_name, last_name, email, customer_phone, whatsapp_number, 
-		       total_amount, status, COALESCE(mpesa_receipt, ''), created_at 
-		FROM orders WHERE id = $1
+		       total_amount, status, COALESCE(mpesa_receipt, ''), COALESCE(callback_token, ''),
+		       COALESCE(public_code, ''), COALESCE(public_token, ''),
+		       COALESCE(payment_method, 'MPESA'), COALESCE(payment_reference, ''),
+		       COALESCE(deposit_amount, 0), COALESCE(amount_paid, 0),
+		       COALESCE(fulfilment_type, ''), COALESCE(fulfilment_date::text, ''), COALESCE(time_slot, ''),
+		       COALESCE(delivery_zone, ''), COALESCE(delivery_address, ''), COALESCE(delivery_fee, 0),
+		       COALESCE(discount_code, ''), COALESCE(discount_amount, 0), created_at
+		FROM orders WHERE ` + column + ` = $1
 	`
 	o := &models.Order{}
-	err := m.DB.QueryRow(stmt, id).Scan(
+	err := m.DB.QueryRow(stmt, value).Scan(
 		&o.ID, &o.FirstName, &o.LastName, &o.Email, &o.CustomerPhone, &o.WhatsappNumber,
-		&o.TotalAmount, &o.Status, &o.MpesaReceipt, &o.CreatedAt,
+		&o.TotalAmount, &o.Status, &o.MpesaReceipt, &o.CallbackToken,
+		&o.PublicCode, &o.PublicToken,
+		&o.PaymentMethod, &o.PaymentRef, &o.DepositAmount, &o.AmountPaid,
+		&o.FulfilmentType, &o.FulfilmentDate, &o.TimeSlot,
+		&o.DeliveryZone, &o.Address, &o.DeliveryFee,
+		&o.DiscountCode, &o.DiscountAmount, &o.CreatedAt,
 	)
 	if err != nil {
 		return nil, err
@@ -107,6 +395,77 @@ func (m *OrderModel) Get(id int) (*models.Order, error) {
 	return o, nil
 }
 
+// RequestManualPayment switches an unpaid order to a non M-Pesa method (pay on
+// pickup, bank transfer) and parks it as AWAITING_MANUAL_PAYMENT for an admin
+func (m *OrderModel) RequestManualPayment(id int, method, reference string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	from, err := lockStatus(ctx, tx, id)
+	if errors.Is(err, ErrUnknownOrder) {
+		return ErrOrderNotPayable
+	}
+	if err != nil {
+		return err
+	}
+	if from != models.StatusPendingPayment && from != models.StatusFailed {
+		return ErrOrderNotPayable
+	}
+
+	_, err = tx.ExecContext(ctx,
+		`UPDATE orders SET payment_method = $1, payment_reference = NULLIF($2, '') WHERE id = $3`,
+		method, reference, id,
+	)
+	if err != nil {
+		return err
+	}
+	if err = setStatus(ctx, tx, id, from, models.StatusAwaitingManual, "customer", "chose "+method); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ConfirmManualPayment records the rest of an order as paid once the admin has
+// the cash or sees the bank transfer. It covers AWAITING_MANUAL_PAYMENT orders
+// and the balance of deposit orders collected on delivery.
+func (m *OrderModel) ConfirmManualPayment(id int, changedBy string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	order, err := loadForPayment(ctx, tx, id)
+	if err != nil {
+		return err
+	}
+	// A deposit order's balance is taken however far the kitchen has got
+	if !order.AcceptsPayment() || order.Status == models.StatusPendingPayment || order.Status == models.StatusFailed {
+		return ErrOrderNotPayable
+	}
+
+	if _, err = tx.ExecContext(ctx, `UPDATE orders SET amount_paid = total_amount WHERE id = $1`, id); err != nil {
+		return err
+	}
+	if order.Status == models.StatusAwaitingManual || order.Status == models.StatusPartiallyPaid {
+		if err = setStatus(ctx, tx, id, order.Status, models.StatusPaid, changedBy, "payment received"); err != nil {
+			return err
+		}
+	} else if err = logStatus(ctx, tx, id, order.Status, order.Status, changedBy, "balance received"); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
 // OrderDetailItem helps us display the cake info nicely
 type OrderDetailItem struct {
 	ProductName string
@@ -151,3 +510,31 @@ func (m *OrderModel) GetOrderItems(orderID int) ([]OrderDetailItem, error) {
 	}
 	return items, nil
 }
+
+// newPublicCode picks an order code no other order has
+func newPublicCode(ctx context.Context, tx *sql.Tx) (string, error) {
+	for i := 0; i < 5; i++ {
+		code, err := models.NewPublicCode()
+		if err != nil {
+			return "", err
+		}
+		var taken bool
+		err = tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM orders WHERE public_code = $1)`, code).Scan(&taken)
+		if err != nil {
+			return "", err
+		}
+		if !taken {
+			return code, nil
+		}
+	}
+	return "", errors.New("could not find a free order code")
+}
+
+// newToken returns n random bytes as hex, for secrets that end up in URLs
+func newToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
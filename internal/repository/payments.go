@@ -0,0 +1,578 @@
+package repository
+
+import (
+	"context"
+	"crave-and-glaze/internal/models"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+var (
+	// ErrUnknownCheckout means no STK Push was ever recorded with that CheckoutRequestID
+	ErrUnknownCheckout = errors.New("unknown checkout request")
+	// ErrAttemptSettled means the callback for that STK Push was already processed
+	ErrAttemptSettled = errors.New("payment attempt already settled")
+	// ErrDuplicateReceipt means the M-Pesa receipt already paid for another attempt
+	ErrDuplicateReceipt = errors.New("m-pesa receipt already used")
+	// ErrOrderNotPayable means the order is no longer waiting for payment
+	ErrOrderNotPayable = errors.New("order is not awaiting payment")
+	// ErrAttemptInFlight means the customer still has an unanswered payment prompt
+	ErrAttemptInFlight = errors.New("a payment prompt is already in progress")
+	// ErrResendCooldown means the last prompt was sent too recently to send another
+	ErrResendCooldown = errors.New("payment prompt sent too recently")
+	// ErrTooManyAttempts means the order has used up its payment prompts
+	ErrTooManyAttempts = errors.New("too many payment attempts for this order")
+	// ErrReceiptNotPending means the payment isn't one still waiting for its receipt
+	ErrReceiptNotPending = errors.New("payment is not waiting for a receipt")
+	// ErrPaymentRefunded means the money arrived after the order stopped taking
+	// payments (e.g. it was cancelled), so a refund was requested instead
+	ErrPaymentRefunded = errors.New("payment arrived for an order not awaiting it; refund requested")
+)
+
+type PaymentModel struct {
+	DB *sql.DB
+}
+
+// AttemptPolicy limits how often a customer can be sent an STK Push for one order
+type AttemptPolicy struct {
+	InFlight    time.Duration // An unanswered push younger than this blocks another one
+	Cooldown    time.Duration // Minimum gap between two pushes
+	MaxAttempts int           // Pushes allowed per order (pushes Safaricom refused don't count)
+}
+
+// ReserveAttempt claims the right to send an STK Push for an order awaiting
+// payment, or for the balance of a deposit order. It locks
+// the order so two page loads can't both push, and records a SENDING attempt.
+// Call MarkSent once Safaricom accepts the push, or MarkSendFailed if it doesn't.
+// M-Pesa only takes whole shillings, so amount is rounded up.
+func (m *PaymentModel) ReserveAttempt(orderID int, phone string, amount float64, policy AttemptPolicy) (int, error) {
+	return m.reserveAttempt(orderID, phone, amount, policy, false)
+}
+
+// ReserveRetry is ReserveAttempt for a customer retrying from the failed page. It
+// also re-opens a FAILED (or manual payment) order as PENDING_PAYMENT and switches it to
+// the M-Pesa number they entered, but only if the policy allows another push.
+func (m *PaymentModel) ReserveRetry(orderID int, phone string, amount float64, policy AttemptPolicy) (int, error) {
+	return m.reserveAttempt(orderID, phone, amount, policy, true)
+}
+
+func (m *PaymentModel) reserveAttempt(orderID int, phone string, amount float64, policy AttemptPolicy, reopen bool) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	order, err := loadForPayment(ctx, tx, orderID)
+	if err != nil {
+		return 0, err
+	}
+	// Only a retry from the failed page brings a FAILED or manual order back to M-Pesa
+	parked := order.Status == models.StatusFailed || order.Status == models.StatusAwaitingManual
+	if !order.AcceptsPayment() || (parked && !reopen) {
+		return 0, ErrOrderNotPayable
+	}
+
+	// Look at the newest push and how many pushes reached the customer since
+	// the last payment (a deposit doesn't use up the balance's attempts)
+	var sent int
+	var lastStatus sql.NullString
+	var lastAt sql.NullTime
+	err = tx.QueryRowContext(ctx, `
+		SELECT
+			(SELECT COUNT(*) FROM payment_attempts WHERE order_id = $1 AND status <> 'ERROR'
+			 AND id > COALESCE((SELECT MAX(id) FROM payment_attempts WHERE order_id = $1 AND status = 'SUCCESS'), 0)),
+			(SELECT status FROM payment_attempts WHERE order_id = $1 ORDER BY id DESC LIMIT 1),
+			(SELECT created_at FROM payment_attempts WHERE order_id = $1 ORDER BY id DESC LIMIT 1)`,
+		orderID,
+	).Scan(&sent, &lastStatus, &lastAt)
+	if err != nil {
+		return 0, err
+	}
+
+	if lastAt.Valid {
+		age := time.Since(lastAt.Time)
+		if (lastStatus.String == "SENDING" || lastStatus.String == "PENDING") && age < policy.InFlight {
+			return 0, ErrAttemptInFlight
+		}
+		// A prompt the customer already answered can't still be on their phone
+		if age < policy.Cooldown && lastStatus.String != "FAILED" {
+			return 0, ErrResendCooldown
+		}
+	}
+	if sent >= policy.MaxAttempts {
+		return 0, ErrTooManyAttempts
+	}
+
+	if reopen {
+		_, err = tx.ExecContext(ctx, `
+			UPDATE orders SET customer_phone = $1, payment_method = 'MPESA', payment_reference = NULL
+			WHERE id = $2`,
+			phone, orderID,
+		)
+		if err == nil && parked {
+			err = setStatus(ctx, tx, orderID, order.Status, models.StatusPendingPayment, "customer", "retried M-Pesa")
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	var newID int
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO payment_attempts (order_id, phone_number, amount, status, created_at)
+		VALUES ($1, $2, $3, 'SENDING', $4)
+		RETURNING id`,
+		orderID, phone, math.Ceil(amount), time.Now(),
+	).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+	return newID, nil
+}
+
+// MarkSent stores the IDs Safaricom gave a reserved attempt; it now waits for a callback
+func (m *PaymentModel) MarkSent(id int, merchantRequestID, checkoutRequestID string) error {
+	stmt := `
+		UPDATE payment_attempts SET merchant_request_id = $1, checkout_request_id = $2, status = 'PENDING'
+		WHERE id = $3 AND status = 'SENDING'
+	`
+	_, err := m.DB.Exec(stmt, merchantRequestID, checkoutRequestID, id)
+	return err
+}
+
+// MarkSendFailed closes a reserved attempt that Safaricom refused, so it doesn't block a retry
+func (m *PaymentModel) MarkSendFailed(id int, reason string) error {
+	stmt := `
+		UPDATE payment_attempts SET status = 'ERROR', result_desc = $1, settled_at = $2
+		WHERE id = $3 AND status = 'SENDING'
+	`
+	_, err := m.DB.Exec(stmt, reason, time.Now(), id)
+	return err
+}
+
+// LatestAttempt returns the newest attempt for an order, or nil if none was made
+func (m *PaymentModel) LatestAttempt(orderID int) (*models.PaymentAttempt, error) {
+	stmt := `
+		SELECT id, order_id, COALESCE(merchant_request_id, ''), COALESCE(checkout_request_id, ''), phone_number, amount, status,
+		       COALESCE(result_code, 0), COALESCE(result_desc, ''), COALESCE(mpesa_receipt, ''), created_at
+		FROM payment_attempts WHERE order_id = $1 ORDER BY id DESC LIMIT 1
+	`
+	a := &models.PaymentAttempt{}
+	err := m.DB.QueryRow(stmt, orderID).Scan(
+		&a.ID, &a.OrderID, &a.MerchantRequestID, &a.CheckoutRequestID, &a.PhoneNumber, &a.Amount, &a.Status,
+		&a.ResultCode, &a.ResultDesc, &a.MpesaReceipt, &a.CreatedAt,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// GetAttempt fetches a payment attempt by its CheckoutRequestID
+func (m *PaymentModel) GetAttempt(checkoutRequestID string) (*models.PaymentAttempt, error) {
+	stmt := `
+		SELECT id, order_id, COALESCE(merchant_request_id, ''), COALESCE(checkout_request_id, ''), phone_number, amount, status,
+		       COALESCE(result_code, 0), COALESCE(result_desc, ''), COALESCE(mpesa_receipt, ''), created_at
+		FROM payment_attempts WHERE checkout_request_id = $1
+	`
+	a := &models.PaymentAttempt{}
+	err := m.DB.QueryRow(stmt, checkoutRequestID).Scan(
+		&a.ID, &a.OrderID, &a.MerchantRequestID, &a.CheckoutRequestID, &a.PhoneNumber, &a.Amount, &a.Status,
+		&a.ResultCode, &a.ResultDesc, &a.MpesaReceipt, &a.CreatedAt,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrUnknownCheckout
+	}
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Settle applies an STK result to the attempt and its order in one transaction.
+// A ResultCode of 0 adds the payment to the order (see addPayment), anything else marks it FAILED
+// unless another prompt for the same order is still waiting on its callback.
+// Only the order that owns the CheckoutRequestID is touched. Money the order
+// no longer accepts is refunded instead, returning ErrPaymentRefunded.
+// paid is the amount M-Pesa reports; 0 (STK Query carries none) credits what
+// the attempt asked for.
+func (m *PaymentModel) Settle(checkoutRequestID string, resultCode int, resultDesc, receipt string, paid float64) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// Lock the attempt so two deliveries of the same callback can't both settle it
+	var attemptID, orderID int
+	var status string
+	var amount float64
+	err = tx.QueryRowContext(ctx,
+		`SELECT id, order_id, status, amount FROM payment_attempts WHERE checkout_request_id = $1 FOR UPDATE`,
+		checkoutRequestID,
+	).Scan(&attemptID, &orderID, &status, &amount)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrUnknownCheckout
+	}
+	if err != nil {
+		return 0, err
+	}
+	if status != "PENDING" {
+		// The reconciler settles via STK Query, which carries no receipt.
+		// If the real callback turns up later, keep its receipt for the records.
+		if status == "SUCCESS" && resultCode == 0 && receipt != "" {
+			_, err = tx.ExecContext(ctx,
+				`UPDATE payment_attempts SET mpesa_receipt = $1 WHERE id = $2 AND mpesa_receipt IS NULL`,
+				receipt, attemptID,
+			)
+			if err == nil {
+				_, err = tx.ExecContext(ctx,
+					`UPDATE orders SET mpesa_receipt = $1 WHERE id = $2 AND COALESCE(mpesa_receipt, '') = ''`,
+					receipt, orderID,
+				)
+			}
+			if err == nil {
+				err = tx.Commit()
+			}
+			if err != nil {
+				return 0, err
+			}
+		}
+		return orderID, ErrAttemptSettled
+	}
+
+	attemptStatus := "FAILED"
+	if resultCode == 0 {
+		attemptStatus = "SUCCESS"
+	}
+
+	// One real payment can't be replayed to settle a second order, nor counted
+	// again after it came in as a C2B payment on the same shortcode
+	if receipt != "" {
+		if err = lockReceipt(ctx, tx, receipt); err != nil {
+			return 0, err
+		}
+		var used bool
+		err = tx.QueryRowContext(ctx, `
+			SELECT EXISTS (SELECT 1 FROM payment_attempts WHERE mpesa_receipt = $1)
+			    OR EXISTS (SELECT 1 FROM c2b_payments WHERE trans_id = $1 AND status = 'ALLOCATED')`,
+			receipt,
+		).Scan(&used)
+		if err != nil {
+			return 0, err
+		}
+		if used {
+			return orderID, ErrDuplicateReceipt
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE payment_attempts
+		SET status = $1, result_code = $2, result_desc = $3, mpesa_receipt = NULLIF($4, ''), settled_at = $5
+		WHERE id = $6`,
+		attemptStatus, resultCode, resultDesc, receipt, time.Now(), attemptID,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	// With resends an order can have several prompts out. A payment on any of
+	// them counts (even after the customer switched to a manual method), while a
+	// failure only fails the order once no other prompt is open.
+	applied := true
+	if resultCode == 0 {
+		if paid > 0 {
+			amount = paid
+		}
+		applied, err = addPayment(ctx, tx, orderID, amount, receipt, "mpesa")
+	} else {
+		err = failOrder(ctx, tx, orderID, attemptID, resultDesc)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+	if !applied {
+		return orderID, ErrPaymentRefunded
+	}
+	return orderID, nil
+}
+
+// addPayment adds money received to an order that still accepts it. Before
+// the kitchen starts it becomes PAID once the whole total is in (in whole
+// shillings, like the STK Push), or PARTIALLY_PAID after a deposit; a balance
+// paid later leaves the status alone. The first receipt is kept for reversals.
+// An unpaid order taking its place in the kitchen is checked against capacity.
+//
+// Money for an order that no longer accepts it (cancelled, or already paid) is
+// still counted as paid, with a REQUESTED refund of it for an admin to send;
+// applied is false then.
+func addPayment(ctx context.Context, tx *sql.Tx, orderID int, amount float64, receipt, changedBy string) (applied bool, err error) {
+	order, err := loadForPayment(ctx, tx, orderID)
+	if err != nil {
+		return false, err
+	}
+	if !order.AcceptsPayment() {
+		return false, refundPayment(ctx, tx, order, amount, receipt, changedBy)
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE orders SET
+			amount_paid = COALESCE(amount_paid, 0) + $1,
+			mpesa_receipt = COALESCE(NULLIF(mpesa_receipt, ''), NULLIF($2, ''))
+		WHERE id = $3`,
+		amount, receipt, orderID,
+	)
+	if err != nil {
+		return false, err
+	}
+
+	note := fmt.Sprintf("KES %.2f received %s", amount, receipt)
+	if receipt == "" {
+		note = fmt.Sprintf("KES %.2f received, M-Pesa receipt pending", amount)
+	}
+	switch order.Status {
+	case models.StatusPendingPayment, models.StatusFailed, models.StatusAwaitingManual, models.StatusPartiallyPaid:
+		to := models.StatusPartiallyPaid
+		if order.AmountPaid+amount >= order.TotalAmount {
+			to = models.StatusPaid
+		}
+		if to != order.Status {
+			if err = setStatus(ctx, tx, orderID, order.Status, to, changedBy, note); err != nil {
+				return false, err
+			}
+			if order.Status == models.StatusPendingPayment || order.Status == models.StatusFailed {
+				return true, noteOverbooked(ctx, tx, orderID, to)
+			}
+			return true, nil
+		}
+	}
+	return true, logStatus(ctx, tx, orderID, order.Status, order.Status, changedBy, note)
+}
+
+// lockReceipt holds an M-Pesa receipt for the rest of the transaction, so an
+// STK callback and a C2B confirmation for the same payment are checked for
+// duplicates one at a time
+func lockReceipt(ctx context.Context, tx *sql.Tx, receipt string) error {
+	_, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtext('receipt'), hashtext($1))`, receipt)
+	return err
+}
+
+// refundPayment records money that arrived for an order no longer taking it
+// as paid, and requests a refund of all of it. It is reversed when it is the
+// order's receipt; otherwise it goes back to the customer's number by B2C.
+func refundPayment(ctx context.Context, tx *sql.Tx, order *models.Order, amount float64, receipt, changedBy string) error {
+	var orderReceipt string
+	err := tx.QueryRowContext(ctx, `
+		UPDATE orders SET
+			amount_paid = COALESCE(amount_paid, 0) + $1,
+			mpesa_receipt = COALESCE(NULLIF(mpesa_receipt, ''), NULLIF($2, ''))
+		WHERE id = $3
+		RETURNING COALESCE(mpesa_receipt, '')`,
+		amount, receipt, order.ID,
+	).Scan(&orderReceipt)
+	if err != nil {
+		return err
+	}
+
+	method := "B2C"
+	if receipt != "" && receipt == orderReceipt {
+		method = "REVERSAL"
+	}
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO refunds (order_id, method, amount, reason, status, created_at)
+		VALUES ($1, $2, $3, $4, 'REQUESTED', $5)`,
+		order.ID, method, amount, fmt.Sprintf("Paid while the order was %s", order.Status), time.Now(),
+	)
+	if err != nil {
+		return err
+	}
+
+	note := fmt.Sprintf("KES %.2f received %s after the order stopped taking payments, refund requested", amount, receipt)
+	if receipt == "" {
+		note = fmt.Sprintf("KES %.2f received after the order stopped taking payments, refund requested", amount)
+	}
+	return logStatus(ctx, tx, order.ID, order.Status, order.Status, changedBy, note)
+}
+
+// failOrder marks an order FAILED after a failed prompt, unless it isn't
+// waiting on a first payment or another prompt for it is still open
+func failOrder(ctx context.Context, tx *sql.Tx, orderID, attemptID int, reason string) error {
+	from, err := lockStatus(ctx, tx, orderID)
+	if err != nil || from != models.StatusPendingPayment {
+		return err
+	}
+
+	var open bool
+	err = tx.QueryRowContext(ctx,
+		`SELECT EXISTS (SELECT 1 FROM payment_attempts WHERE order_id = $1 AND id <> $2 AND status = 'PENDING')`,
+		orderID, attemptID,
+	).Scan(&open)
+	if err != nil || open {
+		return err
+	}
+	return setStatus(ctx, tx, orderID, from, models.StatusFailed, "mpesa", reason)
+}
+
+// SetReceipt fills in the M-Pesa receipt of a payment the reconciler settled
+// by STK Query, which carries none, e.g. from the M-Pesa statement. The order
+// gets it too if it has no receipt yet, so it can be reversed.
+func (m *PaymentModel) SetReceipt(orderID, attemptID int, receipt, changedBy string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	status, err := lockStatus(ctx, tx, orderID)
+	if err != nil {
+		return err
+	}
+	if err = lockReceipt(ctx, tx, receipt); err != nil {
+		return err
+	}
+
+	var used bool
+	err = tx.QueryRowContext(ctx, `
+		SELECT EXISTS (SELECT 1 FROM payment_attempts WHERE mpesa_receipt = $1)
+		    OR EXISTS (SELECT 1 FROM c2b_payments WHERE trans_id = $1)`,
+		receipt,
+	).Scan(&used)
+	if err != nil {
+		return err
+	}
+	if used {
+		return ErrDuplicateReceipt
+	}
+
+	res, err := tx.ExecContext(ctx, `
+		UPDATE payment_attempts SET mpesa_receipt = $1
+		WHERE id = $2 AND order_id = $3 AND status = 'SUCCESS' AND mpesa_receipt IS NULL`,
+		receipt, attemptID, orderID,
+	)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		if err == nil {
+			err = ErrReceiptNotPending
+		}
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx,
+		`UPDATE orders SET mpesa_receipt = $1 WHERE id = $2 AND COALESCE(mpesa_receipt, '') = ''`,
+		receipt, orderID,
+	)
+	if err != nil {
+		return err
+	}
+	if err = logStatus(ctx, tx, orderID, status, status, changedBy, "M-Pesa receipt "+receipt+" added"); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ForOrder lists the money received for an order, STK and C2B, oldest first
+func (m *PaymentModel) ForOrder(orderID int) ([]models.Payment, error) {
+	stmt := `
+		SELECT 'STK', id, COALESCE(mpesa_receipt, ''), amount, phone_number, COALESCE(settled_at, created_at)::text AS paid_at
+		FROM payment_attempts WHERE order_id = $1 AND status = 'SUCCESS'
+		UNION ALL
+		SELECT 'C2B', 0, trans_id, amount, COALESCE(msisdn, ''), COALESCE(allocated_at, created_at)::text
+		FROM c2b_payments WHERE order_id = $1 AND status = 'ALLOCATED'
+		ORDER BY paid_at ASC
+	`
+	rows, err := m.DB.Query(stmt, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var payments []models.Payment
+	for rows.Next() {
+		var p models.Payment
+		if err = rows.Scan(&p.Source, &p.AttemptID, &p.Receipt, &p.Amount, &p.Phone, &p.PaidAt); err != nil {
+			return nil, err
+		}
+		payments = append(payments, p)
+	}
+	return payments, rows.Err()
+}
+
+// StalePending returns attempts still waiting on a callback after olderThan,
+// unless their order was cancelled. The reconciler queries these directly.
+func (m *PaymentModel) StalePending(olderThan time.Duration) ([]models.PaymentAttempt, error) {
+	stmt := `
+		SELECT pa.id, pa.order_id, COALESCE(pa.merchant_request_id, ''), COALESCE(pa.checkout_request_id, ''), pa.phone_number, pa.amount, pa.status, pa.created_at
+		FROM payment_attempts pa
+		JOIN orders o ON o.id = pa.order_id
+		WHERE pa.status = 'PENDING' AND o.status NOT IN ('CANCELLED', 'REFUNDED') AND pa.created_at < $1
+		ORDER BY pa.id ASC
+	`
+	rows, err := m.DB.Query(stmt, time.Now().Add(-olderThan))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var attempts []models.PaymentAttempt
+	for rows.Next() {
+		var a models.PaymentAttempt
+		err = rows.Scan(&a.ID, &a.OrderID, &a.MerchantRequestID, &a.CheckoutRequestID, &a.PhoneNumber, &a.Amount, &a.Status, &a.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		attempts = append(attempts, a)
+	}
+	return attempts, rows.Err()
+}
+
+// Reject closes an attempt without touching its order, for callbacks we don't
+// trust (e.g. the amount paid doesn't match what we asked for)
+func (m *PaymentModel) Reject(checkoutRequestID, reason string) error {
+	stmt := `
+		UPDATE payment_attempts SET status = 'REJECTED', result_desc = $1, settled_at = $2
+		WHERE checkout_request_id = $3 AND status = 'PENDING'
+	`
+	_, err := m.DB.Exec(stmt, reason, time.Now(), checkoutRequestID)
+	return err
+}
+
+// LogCallback stores the raw body of an incoming M-Pesa callback before we act on it
+func (m *PaymentModel) LogCallback(kind, remoteIP, payload string) (int, error) {
+	stmt := `INSERT INTO mpesa_callbacks (kind, remote_ip, payload, received_at) VALUES ($1, $2, $3, $4) RETURNING id`
+	var id int
+	err := m.DB.QueryRow(stmt, kind, remoteIP, payload, time.Now()).Scan(&id)
+	return id, err
+}
+
+// SetCallbackOutcome records what we decided to do with a logged callback
+func (m *PaymentModel) SetCallbackOutcome(id int, reference, outcome, note string) error {
+	stmt := `UPDATE mpesa_callbacks SET reference = NULLIF($1, ''), outcome = $2, note = NULLIF($3, '') WHERE id = $4`
+	_, err := m.DB.Exec(stmt, reference, outcome, note, id)
+	return err
+}
@@ -4,6 +4,9 @@ import (
 	"crave-and-glaze/internal/models"
 	"database/sql"
 	"log"
+	"time"
+
+	"github.com/lib/pq"
 )
 
 type ProductModel struct {
@@ -50,14 +53,14 @@ func (m *ProductModel) All() ([]models.Product, error) {
 // Get fetches a single product by ID
 func (m *ProductModel) Get(id int) (*models.Product, error) {
 	stmt := `
-		SELECT id, name, description, image_url, category_id 
+		SELECT id, name, description, image_url, category_id, COALESCE(deposit_percent, 0), COALESCE(lead_time_hours, 0)
 		FROM products 
 		WHERE id = $1 AND is_active = true
 	`
 	row := m.DB.QueryRow(stmt, id)
 
 	p := &models.Product{}
-	err := row.Scan(&p.ID, &p.Name, &p.Description, &p.ImageURL, &p.Category) // Category here is just the ID int for now or we ignore it
+	err := row.Scan(&p.ID, &p.Name, &p.Description, &p.ImageURL, &p.Category, &p.DepositPercent, &p.LeadTimeHours) // Category here is just the ID int for now or we ignore it
 	if err != nil {
 		return nil, err
 	}
@@ -88,7 +91,7 @@ func (m *ProductModel) GetVariants(productID int) ([]models.ProductVariant, erro
 
 // GetAllCategories fetches all categories for the navbar
 func (m *ProductModel) GetAllCategories() ([]models.Category, error) {
-	stmt := `SELECT id, name, slug FROM categories ORDER BY name ASC`
+	stmt := `SELECT id, name, slug, COALESCE(deposit_percent, 0) FROM categories ORDER BY name ASC`
 	rows, err := m.DB.Query(stmt)
 	if err != nil {
 		return nil, err
@@ -98,7 +101,7 @@ func (m *ProductModel) GetAllCategories() ([]models.Category, error) {
 	var categories []models.Category
 	for rows.Next() {
 		var c models.Category
-		err = rows.Scan(&c.ID, &c.Name, &c.Slug)
+		err = rows.Scan(&c.ID, &c.Name, &c.Slug, &c.DepositPercent)
 		if err != nil {
 			return nil, err
 		}
@@ -140,13 +143,13 @@ func (m *ProductModel) GetByCategory(categoryID int) ([]models.Product, error) {
 func (m *ProductModel) InsertProduct(p models.Product) (int, error) {
 	// Note: We use the 'category_id' column, so we pass the ID, not the name
 	stmt := `
-		INSERT INTO products (name, description, category_id, image_url, is_active) 
-		VALUES ($1, $2, $3, $4, true) 
+		INSERT INTO products (name, description, category_id, image_url, deposit_percent, lead_time_hours, is_active) 
+		VALUES ($1, $2, $3, $4, $5, $6, true) 
 		RETURNING id
 	`
 	var newID int
 	// p.Category here holds the Category ID as a string from the form
-	err := m.DB.QueryRow(stmt, p.Name, p.Description, p.Category, p.ImageURL).Scan(&newID)
+	err := m.DB.QueryRow(stmt, p.Name, p.Description, p.Category, p.ImageURL, p.DepositPercent, p.LeadTimeHours).Scan(&newID)
 	return newID, err
 }
 
@@ -158,12 +161,114 @@ func (m *ProductModel) InsertVariant(productID int, label string, price float64)
 }
 
 // InsertCategory adds a new category
-func (m *ProductModel) InsertCategory(name, slug string) error {
-	stmt := `INSERT INTO categories (name, slug) VALUES ($1, $2)`
-	_, err := m.DB.Exec(stmt, name, slug)
+func (m *ProductModel) InsertCategory(name, slug string, depositPercent int) error {
+	stmt := `INSERT INTO categories (name, slug, deposit_percent) VALUES ($1, $2, $3)`
+	_, err := m.DB.Exec(stmt, name, slug, depositPercent)
+	return err
+}
+
+// UpdateCategoryDeposit changes the share of the price paid upfront for a category
+func (m *ProductModel) UpdateCategoryDeposit(id, depositPercent int) error {
+	stmt := `UPDATE categories SET deposit_percent = $1 WHERE id = $2`
+	_, err := m.DB.Exec(stmt, depositPercent, id)
 	return err
 }
 
+// DepositPercents returns the deposit share for each variant ID: the product's
+// own setting, else its category's, else 0 (pay in full)
+func (m *ProductModel) DepositPercents(variantIDs []int) (map[int]int, error) {
+	stmt := `
+		SELECT v.id, COALESCE(NULLIF(p.deposit_percent, 0), c.deposit_percent, 0)
+		FROM product_variants v
+		JOIN products p ON v.product_id = p.id
+		LEFT JOIN categories c ON p.category_id = c.id
+		WHERE v.id = ANY($1)
+	`
+	rows, err := m.DB.Query(stmt, pq.Array(variantIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	percents := make(map[int]int, len(variantIDs))
+	for rows.Next() {
+		var id, pct int
+		if err = rows.Scan(&id, &pct); err != nil {
+			return nil, err
+		}
+		percents[id] = pct
+	}
+	return percents, rows.Err()
+}
+
+// LeadTime returns the longest notice any of the variants' products needs
+func (m *ProductModel) LeadTime(variantIDs []int) (time.Duration, error) {
+	stmt := `
+		SELECT COALESCE(MAX(p.lead_time_hours), 0)
+		FROM product_variants v
+		JOIN products p ON v.product_id = p.id
+		WHERE v.id = ANY($1)
+	`
+	var hours int
+	err := m.DB.QueryRow(stmt, pq.Array(variantIDs)).Scan(&hours)
+	return time.Duration(hours) * time.Hour, err
+}
+
+// WeightLabels returns the weight label of each variant, keyed by variant ID
+func (m *ProductModel) WeightLabels(variantIDs []int) (map[int]string, error) {
+	rows, err := m.DB.Query(`SELECT id, weight_label FROM product_variants WHERE id = ANY($1)`, pq.Array(variantIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	labels := make(map[int]string)
+	for rows.Next() {
+		var id int
+		var label string
+		if err = rows.Scan(&id, &label); err != nil {
+			return nil, err
+		}
+		labels[id] = label
+	}
+	return labels, rows.Err()
+}
+
+// SellableVariant is a variant as it can be bought right now
+type SellableVariant struct {
+	ProductName string
+	ImageURL    string
+	WeightLabel string
+	Price       float64
+}
+
+// Sellable returns the current price of each variant, keyed by variant ID.
+// Variants that have been deleted, or whose product is no longer active, are left out.
+func (m *ProductModel) Sellable(variantIDs []int) (map[int]SellableVariant, error) {
+	stmt := `
+		SELECT v.id, p.name, COALESCE(p.image_url, ''), v.weight_label, v.price
+		FROM product_variants v
+		JOIN products p ON v.product_id = p.id
+		WHERE v.id = ANY($1) AND p.is_active = true
+	`
+	rows, err := m.DB.Query(stmt, pq.Array(variantIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	variants := make(map[int]SellableVariant)
+	for rows.Next() {
+		var id int
+		var v SellableVariant
+		if err = rows.Scan(&id, &v.ProductName, &v.ImageURL, &v.WeightLabel, &v.Price); err != nil {
+			return nil, err
+		}
+		variants[id] = v
+	}
+	return variants, rows.Err()
+}
+
 // DeleteCategory removes a category
 func (m *ProductModel) DeleteCategory(id int) error {
 	stmt := `DELETE FROM categories WHERE id = $1`
@@ -175,12 +280,12 @@ func (m *ProductModel) DeleteCategory(id int) error {
 func (m *ProductModel) UpdateProduct(p models.Product) error {
 	stmt := `
 		UPDATE products 
-		SET name = $1, description = $2, category_id = $3, image_url = $4 
-		WHERE id = $5
+		SET name = $1, description = $2, category_id = $3, image_url = $4, deposit_percent = $5, lead_time_hours = $6 
+		WHERE id = $7
 	`
 	// Note: We need to convert p.Category (string) back to Int for the DB
 	// If p.Category is just the ID string "1", this works.
-	_, err := m.DB.Exec(stmt, p.Name, p.Description, p.Category, p.ImageURL, p.ID)
+	_, err := m.DB.Exec(stmt, p.Name, p.Description, p.Category, p.ImageURL, p.DepositPercent, p.LeadTimeHours, p.ID)
 	return err
 }
 
@@ -0,0 +1,321 @@
+package repository
+
+import (
+	"context"
+	"crave-and-glaze/internal/models"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+var (
+	// ErrDuplicateCode means another promotion already has that code
+	ErrDuplicateCode = errors.New("promotion code already exists")
+	// ErrPromotionUsedUp means the code has reached its total limit (or was switched off)
+	ErrPromotionUsedUp = errors.New("promotion has been used up")
+	// ErrPromotionLimit means this customer has used the code as often as allowed
+	ErrPromotionLimit = errors.New("customer has already used this promotion")
+)
+
+// PromotionModel holds the discount codes and the orders that used them
+type PromotionModel struct {
+	DB *sql.DB
+}
+
+// PromotionClaim is a discount code to redeem as an order is placed, checked
+// against the code's limits in the same transaction
+type PromotionClaim struct {
+	PromotionID int
+	Phone       string    // 2547XXXXXXXX
+	Email       string    // Lower case; may be empty
+	HoldSince   time.Time // Unpaid orders older than this no longer hold a use
+}
+
+// heldUse matches the redemptions that count against a promotion's limits:
+// orders that went ahead, and unpaid ones still young enough to be paid
+const heldUse = `
+	(o.status NOT IN ('PENDING_PAYMENT', 'FAILED', 'CANCELLED')
+	 OR (o.status IN ('PENDING_PAYMENT', 'FAILED') AND o.created_at >= $2))`
+
+// promotionSelect reads a promotion with its restrictions and usage, for list
+const promotionSelect = `
+	SELECT p.id, p.code, p.description, p.kind, p.value, p.min_spend,
+	       COALESCE(p.starts_on::text, ''), COALESCE(p.ends_on::text, ''),
+	       p.max_uses, p.max_per_customer, p.active, p.created_at,
+	       ARRAY(SELECT product_id FROM promotion_products WHERE promotion_id = p.id),
+	       ARRAY(SELECT category_id FROM promotion_categories WHERE promotion_id = p.id),
+	       COUNT(o.id), COALESCE(SUM(r.amount) FILTER (WHERE o.id IS NOT NULL), 0), COALESCE(SUM(o.amount_paid), 0)
+	FROM promotions p
+	LEFT JOIN promotion_redemptions r ON r.promotion_id = p.id
+	LEFT JOIN orders o ON o.id = r.order_id AND o.status NOT IN ('PENDING_PAYMENT', 'FAILED', 'CANCELLED')`
+
+// All lists every promotion with its usage, newest first
+func (m *PromotionModel) All() ([]models.Promotion, error) {
+	return m.list(promotionSelect + ` GROUP BY p.id ORDER BY p.id DESC`)
+}
+
+// Get fetches a single promotion
+func (m *PromotionModel) Get(id int) (*models.Promotion, error) {
+	return m.one(promotionSelect+` WHERE p.id = $1 GROUP BY p.id`, id)
+}
+
+// GetByCode fetches the promotion a customer typed the code of, in any case
+func (m *PromotionModel) GetByCode(code string) (*models.Promotion, error) {
+	return m.one(promotionSelect+` WHERE p.code = $1 GROUP BY p.id`, strings.ToUpper(strings.TrimSpace(code)))
+}
+
+func (m *PromotionModel) one(stmt string, args ...interface{}) (*models.Promotion, error) {
+	list, err := m.list(stmt, args...)
+	if err != nil {
+		return nil, err
+	}
+	if len(list) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return &list[0], nil
+}
+
+func (m *PromotionModel) list(stmt string, args ...interface{}) ([]models.Promotion, error) {
+	rows, err := m.DB.Query(stmt, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var promotions []models.Promotion
+	for rows.Next() {
+		var p models.Promotion
+		var productIDs, categoryIDs []int64
+		err = rows.Scan(&p.ID, &p.Code, &p.Description, &p.Kind, &p.Value, &p.MinSpend,
+			&p.StartsOn, &p.EndsOn,
+			&p.MaxUses, &p.MaxPerCustomer, &p.Active, &p.CreatedAt,
+			pq.Array(&productIDs), pq.Array(&categoryIDs),
+			&p.Uses, &p.Discounted, &p.Revenue)
+		if err != nil {
+			return nil, err
+		}
+		p.ProductIDs = intSlice(productIDs)
+		p.CategoryIDs = intSlice(categoryIDs)
+		promotions = append(promotions, p)
+	}
+	return promotions, rows.Err()
+}
+
+// intSlice converts the int64s Postgres arrays scan into
+func intSlice(ids []int64) []int {
+	out := make([]int, 0, len(ids))
+	for _, id := range ids {
+		out = append(out, int(id))
+	}
+	return out
+}
+
+// Insert adds a promotion and the cakes it is limited to
+func (m *PromotionModel) Insert(p *models.Promotion) (int, error) {
+	err := m.save(p, `
+		INSERT INTO promotions (code, description, kind, value, min_spend, starts_on, ends_on, max_uses, max_per_customer, active, created_at)
+		VALUES ($1, $2, $3, $4, $5, NULLIF($6, '')::date, NULLIF($7, '')::date, $8, $9, $10, $11)
+		RETURNING id`,
+		time.Now(),
+	)
+	return p.ID, err
+}
+
+// Update changes a promotion. Orders that already used it keep their discount.
+func (m *PromotionModel) Update(p *models.Promotion) error {
+	return m.save(p, `
+		UPDATE promotions
+		SET code = $1, description = $2, kind = $3, value = $4, min_spend = $5,
+		    starts_on = NULLIF($6, '')::date, ends_on = NULLIF($7, '')::date,
+		    max_uses = $8, max_per_customer = $9, active = $10
+		WHERE id = $11
+		RETURNING id`,
+		p.ID,
+	)
+}
+
+// save writes a promotion with stmt, which takes its fields in order and then
+// last ($11), and replaces its restrictions, all in one transaction
+func (m *PromotionModel) save(p *models.Promotion, stmt string, last interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	p.Code = strings.ToUpper(strings.TrimSpace(p.Code))
+	err = tx.QueryRowContext(ctx, stmt,
+		p.Code, p.Description, p.Kind, p.Value, p.MinSpend, p.StartsOn, p.EndsOn,
+		p.MaxUses, p.MaxPerCustomer, p.Active, last,
+	).Scan(&p.ID)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		return ErrDuplicateCode
+	}
+	if err != nil {
+		return err
+	}
+
+	// The lists are short, so it is simplest to rewrite them
+	if _, err = tx.ExecContext(ctx, `DELETE FROM promotion_products WHERE promotion_id = $1`, p.ID); err != nil {
+		return err
+	}
+	if _, err = tx.ExecContext(ctx, `DELETE FROM promotion_categories WHERE promotion_id = $1`, p.ID); err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO promotion_products (promotion_id, product_id) SELECT $1, id FROM products WHERE id = ANY($2)`,
+		p.ID, pq.Array(p.ProductIDs),
+	)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO promotion_categories (promotion_id, category_id) SELECT $1, id FROM categories WHERE id = ANY($2)`,
+		p.ID, pq.Array(p.CategoryIDs),
+	)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// SetActive switches a promotion on or off without losing its history
+func (m *PromotionModel) SetActive(id int, active bool) error {
+	_, err := m.DB.Exec(`UPDATE promotions SET active = $1 WHERE id = $2`, active, id)
+	return err
+}
+
+// Delete removes a promotion and its usage history. Orders keep their discount.
+func (m *PromotionModel) Delete(id int) error {
+	_, err := m.DB.Exec(`DELETE FROM promotions WHERE id = $1`, id)
+	return err
+}
+
+// Eligible returns which of the variants the promotion discounts
+func (m *PromotionModel) Eligible(p *models.Promotion, variantIDs []int) (map[int]bool, error) {
+	stmt := `
+		SELECT pv.id
+		FROM product_variants pv
+		JOIN products p ON p.id = pv.product_id
+		WHERE pv.id = ANY($1) AND (NOT $2 OR p.id = ANY($3) OR p.category_id = ANY($4))
+	`
+	rows, err := m.DB.Query(stmt, pq.Array(variantIDs), p.Restricted(), pq.Array(p.ProductIDs), pq.Array(p.CategoryIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	eligible := make(map[int]bool)
+	for rows.Next() {
+		var id int
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		eligible[id] = true
+	}
+	return eligible, rows.Err()
+}
+
+// Uses counts the orders holding a use of the promotion: every order that
+// went ahead, and unpaid ones placed since holdSince
+func (m *PromotionModel) Uses(id int, holdSince time.Time) (int, error) {
+	stmt := `
+		SELECT COUNT(*) FROM promotion_redemptions r JOIN orders o ON o.id = r.order_id
+		WHERE r.promotion_id = $1 AND ` + heldUse
+	var uses int
+	err := m.DB.QueryRow(stmt, id, holdSince).Scan(&uses)
+	return uses, err
+}
+
+// Redemptions lists the latest orders placed with a promotion, for its usage report
+func (m *PromotionModel) Redemptions(id, limit int) ([]models.Redemption, error) {
+	stmt := `
+		SELECT r.id, r.promotion_id, r.order_id, r.phone, r.email, r.amount, r.created_at,
+		       COALESCE(o.public_code, ''), o.first_name, COALESCE(o.last_name, ''), o.status,
+		       o.total_amount, COALESCE(o.amount_paid, 0)
+		FROM promotion_redemptions r
+		JOIN orders o ON o.id = r.order_id
+		WHERE r.promotion_id = $1
+		ORDER BY r.id DESC
+		LIMIT $2
+	`
+	rows, err := m.DB.Query(stmt, id, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []models.Redemption
+	for rows.Next() {
+		r := models.Redemption{Order: &models.Order{}}
+		o := r.Order
+		err = rows.Scan(&r.ID, &r.PromotionID, &r.OrderID, &r.Phone, &r.Email, &r.Amount, &r.CreatedAt,
+			&o.PublicCode, &o.FirstName, &o.LastName, &o.Status,
+			&o.TotalAmount, &o.AmountPaid)
+		if err != nil {
+			return nil, err
+		}
+		o.ID = r.OrderID
+		list = append(list, r)
+	}
+	return list, rows.Err()
+}
+
+// redeem records a new order's use of a promotion, checking its limits with
+// the promotion locked so two orders can't both take the last use
+func redeem(ctx context.Context, tx *sql.Tx, orderID int, amount float64, claim *PromotionClaim) error {
+	var maxUses, maxPerCustomer int
+	err := tx.QueryRowContext(ctx,
+		`SELECT max_uses, max_per_customer FROM promotions WHERE id = $1 AND active FOR UPDATE`,
+		claim.PromotionID,
+	).Scan(&maxUses, &maxPerCustomer)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrPromotionUsedUp
+	}
+	if err != nil {
+		return err
+	}
+
+	count := func(extra string, args ...interface{}) (int, error) {
+		stmt := `
+			SELECT COUNT(*) FROM promotion_redemptions r JOIN orders o ON o.id = r.order_id
+			WHERE r.promotion_id = $1 AND ` + heldUse + extra
+		var n int
+		err := tx.QueryRowContext(ctx, stmt, append([]interface{}{claim.PromotionID, claim.HoldSince}, args...)...).Scan(&n)
+		return n, err
+	}
+
+	if maxUses > 0 {
+		uses, err := count("")
+		if err != nil {
+			return err
+		}
+		if uses >= maxUses {
+			return ErrPromotionUsedUp
+		}
+	}
+	if maxPerCustomer > 0 {
+		uses, err := count(` AND (r.phone = $3 OR (r.email <> '' AND r.email = $4))`, claim.Phone, claim.Email)
+		if err != nil {
+			return err
+		}
+		if uses >= maxPerCustomer {
+			return ErrPromotionLimit
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO promotion_redemptions (promotion_id, order_id, phone, email, amount, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6)`,
+		claim.PromotionID, orderID, claim.Phone, claim.Email, amount, time.Now(),
+	)
+	return err
+}
@@ -0,0 +1,203 @@
+package repository
+
+import (
+	"crave-and-glaze/internal/models"
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// RecoveryModel tracks abandoned carts and unpaid orders for reminder emails
+type RecoveryModel struct {
+	DB *sql.DB
+}
+
+// TrackCart remembers the email a checkout visitor asked to be reminded at,
+// in case they leave. Asking again restarts the reminders.
+func (m *RecoveryModel) TrackCart(cartID, email string, value float64) error {
+	token, err := newToken(24)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	stmt := `
+		INSERT INTO cart_recoveries (token, email, cart_id, cart_value, step_since, created_at)
+		VALUES ($1, $2, $3, $4, $5, $5)
+		ON CONFLICT (cart_id) DO UPDATE
+		SET email = EXCLUDED.email, cart_value = EXCLUDED.cart_value, step = 0, step_since = EXCLUDED.step_since, status = 'OPEN'
+		WHERE cart_recoveries.order_id IS NULL
+	`
+	_, err = m.DB.Exec(stmt, token, strings.ToLower(email), cartID, value, now)
+	return err
+}
+
+// ForgetCart stops the reminders about a cart whose visitor no longer wants
+// them. Once an order is placed from the cart, its reminders are about paying.
+func (m *RecoveryModel) ForgetCart(cartID string) error {
+	_, err := m.DB.Exec(`DELETE FROM cart_recoveries WHERE cart_id = $1 AND order_id IS NULL`, cartID)
+	return err
+}
+
+// TrackOrder moves a tracked cart on to the order placed from it. Reminders
+// start again from the first, now about paying for the order.
+func (m *RecoveryModel) TrackOrder(cartID string, orderID int, email string) error {
+	stmt := `
+		UPDATE cart_recoveries
+		SET order_id = $1, email = COALESCE(NULLIF($2, ''), email), step = 0, step_since = $3, status = 'OPEN'
+		WHERE cart_id = $4 AND order_id IS NULL
+	`
+	_, err := m.DB.Exec(stmt, orderID, strings.ToLower(email), time.Now(), cartID)
+	return err
+}
+
+// Refresh picks up unpaid orders placed within window that have an email, and
+// closes the reminders that should stop: the customer opted out, paid, ordered
+// another way, emptied their cart, went quiet for longer than window, or has
+// had all steps of the sequence.
+func (m *RecoveryModel) Refresh(window time.Duration, steps int) error {
+	since := time.Now().Add(-window)
+
+	_, err := m.DB.Exec(`
+		INSERT INTO cart_recoveries (token, email, order_id, cart_value, step_since, created_at)
+		SELECT replace(gen_random_uuid()::text || gen_random_uuid()::text, '-', ''), lower(o.email), o.id, o.total_amount, o.created_at, o.created_at
+		FROM orders o
+		WHERE o.status IN ('PENDING_PAYMENT', 'FAILED') AND o.email LIKE '%@%' AND o.created_at >= $1
+		  AND NOT EXISTS (SELECT 1 FROM cart_recoveries r WHERE r.order_id = o.id)
+		ON CONFLICT DO NOTHING`,
+		since,
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = m.DB.Exec(`
+		UPDATE cart_recoveries r SET status = 'CLOSED'
+		WHERE r.status = 'OPEN' AND (
+			r.step >= $1
+			OR r.step_since < $2
+			OR EXISTS (SELECT 1 FROM email_optouts e WHERE e.email = r.email)
+			OR (r.order_id IS NULL AND NOT EXISTS (SELECT 1 FROM cart_items c WHERE c.cart_id = r.cart_id))
+			OR (r.order_id IS NOT NULL AND NOT EXISTS (
+				SELECT 1 FROM orders o WHERE o.id = r.order_id AND o.status IN ('PENDING_PAYMENT', 'FAILED')
+			))
+			OR EXISTS (
+				SELECT 1 FROM orders o
+				WHERE lower(o.email) = r.email AND o.created_at >= r.created_at AND o.id IS DISTINCT FROM r.order_id
+				  AND o.status NOT IN ('PENDING_PAYMENT', 'FAILED', 'CANCELLED')
+			)
+		)`,
+		steps, since,
+	)
+	return err
+}
+
+// Open lists the reminders still running, with the order for unpaid orders
+func (m *RecoveryModel) Open() ([]models.CartRecovery, error) {
+	return m.list(recoverySelect + ` WHERE r.status = 'OPEN' ORDER BY r.id ASC`)
+}
+
+// Recent lists the latest carts and orders tracked, newest first, for the report
+func (m *RecoveryModel) Recent(limit int) ([]models.CartRecovery, error) {
+	return m.list(recoverySelect+` ORDER BY r.id DESC LIMIT $1`, limit)
+}
+
+// ByToken fetches the reminder a restore or unsubscribe link points to
+func (m *RecoveryModel) ByToken(token string) (*models.CartRecovery, error) {
+	if token == "" {
+		return nil, sql.ErrNoRows
+	}
+	list, err := m.list(recoverySelect+` WHERE r.token = $1`, token)
+	if err != nil {
+		return nil, err
+	}
+	if len(list) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return &list[0], nil
+}
+
+// recoverySelect reads a reminder with its order, for list to scan
+const recoverySelect = `
+	SELECT r.id, r.token, r.email, COALESCE(r.cart_id, ''), COALESCE(r.order_id, 0), r.cart_value,
+	       r.step, r.step_since, r.reminders_sent, r.status, r.created_at,
+	       COALESCE(o.public_code, ''), COALESCE(o.public_token, ''), COALESCE(o.first_name, ''), COALESCE(o.total_amount, 0),
+	       COALESCE(o.amount_paid, 0)
+	FROM cart_recoveries r
+	LEFT JOIN orders o ON o.id = r.order_id`
+
+func (m *RecoveryModel) list(stmt string, args ...interface{}) ([]models.CartRecovery, error) {
+	rows, err := m.DB.Query(stmt, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []models.CartRecovery
+	for rows.Next() {
+		var r models.CartRecovery
+		o := &models.Order{}
+		err = rows.Scan(&r.ID, &r.Token, &r.Email, &r.CartID, &r.OrderID, &r.CartValue,
+			&r.Step, &r.StepSince, &r.RemindersSent, &r.Status, &r.CreatedAt,
+			&o.PublicCode, &o.PublicToken, &o.FirstName, &o.TotalAmount, &o.AmountPaid)
+		if err != nil {
+			return nil, err
+		}
+		if r.OrderID != 0 {
+			o.ID = r.OrderID
+			r.Order = o
+		}
+		list = append(list, r)
+	}
+	return list, rows.Err()
+}
+
+// MarkSent records that reminder number step (counting from 0) went out. A
+// row that was at an earlier step skips the reminders it missed, e.g. while
+// the server was down, rather than getting them all at once.
+func (m *RecoveryModel) MarkSent(id, from, step int) error {
+	stmt := `
+		UPDATE cart_recoveries
+		SET step = $1 + 1, reminders_sent = reminders_sent + 1, last_sent_at = $2
+		WHERE id = $3 AND step = $4
+	`
+	_, err := m.DB.Exec(stmt, step, time.Now(), id, from)
+	return err
+}
+
+// OptOut stops all reminders to the address a link was sent to, now and later
+func (m *RecoveryModel) OptOut(email string) error {
+	email = strings.ToLower(email)
+	_, err := m.DB.Exec(`INSERT INTO email_optouts (email, created_at) VALUES ($1, $2) ON CONFLICT (email) DO NOTHING`, email, time.Now())
+	if err != nil {
+		return err
+	}
+	_, err = m.DB.Exec(`UPDATE cart_recoveries SET status = 'CLOSED' WHERE email = $1 AND status = 'OPEN'`, email)
+	return err
+}
+
+// Report sums up the carts and orders tracked over the last few days. An
+// order counts as recovered if it was reminded at least once and money came in.
+func (m *RecoveryModel) Report(days int) (*models.RecoveryReport, error) {
+	since := time.Now().AddDate(0, 0, -days)
+	report := &models.RecoveryReport{Days: days}
+
+	stmt := `
+		SELECT COUNT(*),
+		       COUNT(*) FILTER (WHERE r.reminders_sent > 0),
+		       COUNT(*) FILTER (WHERE r.reminders_sent > 0 AND COALESCE(o.amount_paid, 0) > 0),
+		       COALESCE(SUM(o.amount_paid) FILTER (WHERE r.reminders_sent > 0), 0)
+		FROM cart_recoveries r
+		LEFT JOIN orders o ON o.id = r.order_id AND o.status NOT IN ('CANCELLED', 'REFUNDED')
+		WHERE r.created_at >= $1
+	`
+	err := m.DB.QueryRow(stmt, since).Scan(&report.Tracked, &report.Reminded, &report.Recovered, &report.Revenue)
+	if err != nil {
+		return nil, err
+	}
+
+	err = m.DB.QueryRow(`SELECT COUNT(*) FROM email_optouts WHERE created_at >= $1`, since).Scan(&report.OptedOut)
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
@@ -0,0 +1,373 @@
+package repository
+
+import (
+	"context"
+	"crave-and-glaze/internal/models"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	// ErrNotRefundable means the order was never paid (or is already fully refunded)
+	ErrNotRefundable = errors.New("order cannot be refunded")
+	// ErrRefundTooLarge means the amount is more than what is left to refund
+	ErrRefundTooLarge = errors.New("refund is larger than the amount left to refund")
+	// ErrUnknownRefund means a result arrived for a ConversationID we never sent
+	ErrUnknownRefund = errors.New("unknown refund conversation")
+	// ErrRefundSettled means the result for that refund was already processed
+	ErrRefundSettled = errors.New("refund already settled")
+	// ErrRefundNotRequested means there is no REQUESTED refund with that ID to send
+	ErrRefundNotRequested = errors.New("refund is not waiting to be sent")
+	// ErrReversalTooLarge means a reversal is for more than is left of the payment it reverses
+	ErrReversalTooLarge = errors.New("reversal is larger than the payment it reverses")
+)
+
+type RefundModel struct {
+	DB *sql.DB
+}
+
+// Refundable returns how much of what was paid on an order can still be refunded.
+// Requested and pending refunds count as spent so two admins can't refund the same money.
+func (m *RefundModel) Refundable(orderID int) (float64, error) {
+	stmt := `
+		SELECT COALESCE(o.amount_paid, 0) - COALESCE((
+			SELECT SUM(amount) FROM refunds WHERE order_id = o.id AND status IN ('REQUESTED', 'PENDING', 'COMPLETED')
+		), 0)
+		FROM orders o
+		WHERE o.id = $1 AND o.status <> 'REFUNDED'
+	`
+	var left float64
+	err := m.DB.QueryRow(stmt, orderID).Scan(&left)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return left, err
+}
+
+// reversibleQuery is what is left to reverse of an order's M-Pesa receipt: the
+// payment made under it, less the reversals already sent. A Reversal returns
+// that one transaction, so the rest of an order paid in several goes by B2C.
+const reversibleQuery = `
+	SELECT COALESCE((
+		SELECT amount FROM payment_attempts WHERE order_id = o.id AND status = 'SUCCESS' AND mpesa_receipt = o.mpesa_receipt
+		UNION ALL
+		SELECT amount FROM c2b_payments WHERE order_id = o.id AND status = 'ALLOCATED' AND trans_id = o.mpesa_receipt
+		LIMIT 1
+	), 0) - COALESCE((
+		SELECT SUM(amount) FROM refunds WHERE order_id = o.id AND method = 'REVERSAL' AND status IN ('PENDING', 'COMPLETED')
+	), 0)
+	FROM orders o WHERE o.id = $1`
+
+// Reversible returns how much can still be refunded by reversing the order's
+// M-Pesa receipt, or 0 if it has none
+func (m *RefundModel) Reversible(orderID int) (float64, error) {
+	var left float64
+	err := m.DB.QueryRow(reversibleQuery, orderID).Scan(&left)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return left, err
+}
+
+// Create reserves a PENDING refund, checking it fits in what is left to refund.
+// Call SetConversation once Safaricom accepts the request, or Fail if it doesn't.
+func (m *RefundModel) Create(r *models.Refund) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// Lock the order so concurrent refunds are checked one at a time
+	var paid float64
+	var status string
+	err = tx.QueryRowContext(ctx, `SELECT COALESCE(amount_paid, 0), status FROM orders WHERE id = $1 FOR UPDATE`, r.OrderID).Scan(&paid, &status)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrNotRefundable
+	}
+	if err != nil {
+		return 0, err
+	}
+	if paid <= 0 || !models.CanTransition(status, models.StatusRefunded) {
+		return 0, ErrNotRefundable
+	}
+
+	var committed float64
+	err = tx.QueryRowContext(ctx,
+		`SELECT COALESCE(SUM(amount), 0) FROM refunds WHERE order_id = $1 AND status IN ('REQUESTED', 'PENDING', 'COMPLETED')`,
+		r.OrderID,
+	).Scan(&committed)
+	if err != nil {
+		return 0, err
+	}
+	if r.Amount <= 0 || r.Amount > paid-committed {
+		return 0, ErrRefundTooLarge
+	}
+	if r.Method == "REVERSAL" {
+		var reversible float64
+		if err = tx.QueryRowContext(ctx, reversibleQuery, r.OrderID).Scan(&reversible); err != nil {
+			return 0, err
+		}
+		if r.Amount > reversible {
+			return 0, ErrReversalTooLarge
+		}
+	}
+
+	var newID int
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO refunds (order_id, method, amount, reason, status, created_at)
+		VALUES ($1, $2, $3, $4, 'PENDING', $5)
+		RETURNING id`,
+		r.OrderID, r.Method, r.Amount, r.Reason, time.Now(),
+	).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+	return newID, nil
+}
+
+// Start claims a REQUESTED refund (from a customer cancelling) so an admin can
+// send it with the given method. It becomes PENDING like any other refund.
+func (m *RefundModel) Start(id int, method string) (*models.Refund, error) {
+	r := &models.Refund{ID: id, Method: method, Status: "PENDING"}
+	err := m.DB.QueryRow(`
+		UPDATE refunds SET method = $1, status = 'PENDING', created_at = $2
+		WHERE id = $3 AND status = 'REQUESTED'
+		RETURNING order_id, amount, reason`,
+		method, time.Now(), id,
+	).Scan(&r.OrderID, &r.Amount, &r.Reason)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrRefundNotRequested
+	}
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Split cuts a PENDING reversal down to what the receipt can return, and moves
+// the rest to a new PENDING B2C refund for the same reason, whose ID it returns
+func (m *RefundModel) Split(id int, reversal float64) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var orderID int
+	var amount float64
+	var reason string
+	err = tx.QueryRowContext(ctx, `
+		SELECT order_id, amount, reason FROM refunds
+		WHERE id = $1 AND method = 'REVERSAL' AND status = 'PENDING' AND conversation_id IS NULL
+		FOR UPDATE`,
+		id,
+	).Scan(&orderID, &amount, &reason)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrRefundNotRequested
+	}
+	if err != nil {
+		return 0, err
+	}
+	if reversal <= 0 || reversal >= amount {
+		return 0, fmt.Errorf("cannot split a KES %.2f refund at KES %.2f", amount, reversal)
+	}
+
+	if _, err = tx.ExecContext(ctx, `UPDATE refunds SET amount = $1 WHERE id = $2`, reversal, id); err != nil {
+		return 0, err
+	}
+	var newID int
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO refunds (order_id, method, amount, reason, status, created_at)
+		VALUES ($1, 'B2C', $2, $3, 'PENDING', $4)
+		RETURNING id`,
+		orderID, amount-reversal, reason, time.Now(),
+	).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+	return newID, nil
+}
+
+// IssueToken gives a PENDING refund that hasn't been sent yet a fresh secret
+// for its ResultURL, and returns it
+func (m *RefundModel) IssueToken(id int) (string, error) {
+	token, err := newToken(32)
+	if err != nil {
+		return "", err
+	}
+	res, err := m.DB.Exec(
+		`UPDATE refunds SET callback_token = $1 WHERE id = $2 AND status = 'PENDING' AND conversation_id IS NULL`,
+		token, id,
+	)
+	if err != nil {
+		return "", err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		if err == nil {
+			err = ErrRefundSettled
+		}
+		return "", err
+	}
+	return token, nil
+}
+
+// ByConversation finds the refund a result is for, so its token can be checked
+func (m *RefundModel) ByConversation(conversationID, originatorConversationID string) (*models.Refund, error) {
+	r := &models.Refund{}
+	err := m.DB.QueryRow(`
+		SELECT id, order_id, status, COALESCE(callback_token, '') FROM refunds
+		WHERE conversation_id = $1 OR (conversation_id IS NULL AND originator_conversation_id = $2)`,
+		conversationID, originatorConversationID,
+	).Scan(&r.ID, &r.OrderID, &r.Status, &r.CallbackToken)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrUnknownRefund
+	}
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// SetConversation stores the IDs Safaricom gave us for a refund request
+func (m *RefundModel) SetConversation(id int, originatorConversationID, conversationID string) error {
+	stmt := `UPDATE refunds SET originator_conversation_id = $1, conversation_id = $2 WHERE id = $3`
+	_, err := m.DB.Exec(stmt, originatorConversationID, conversationID, id)
+	return err
+}
+
+// Fail marks a refund FAILED (e.g. Safaricom rejected the request outright)
+func (m *RefundModel) Fail(id int, reason string) error {
+	stmt := `UPDATE refunds SET status = 'FAILED', result_desc = $1, completed_at = $2 WHERE id = $3 AND status = 'PENDING'`
+	_, err := m.DB.Exec(stmt, reason, time.Now(), id)
+	return err
+}
+
+// ApplyResult records Safaricom's async result for refund id, found with
+// ByConversation. The order becomes REFUNDED once everything paid has been
+// refunded, or PARTIALLY_REFUNDED while some of it is left.
+func (m *RefundModel) ApplyResult(id int, result models.MpesaResult, raw string) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var refundID, orderID int
+	var status string
+	var amount float64
+	err = tx.QueryRowContext(ctx,
+		`SELECT id, order_id, status, amount FROM refunds WHERE id = $1 FOR UPDATE`, id,
+	).Scan(&refundID, &orderID, &status, &amount)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrUnknownRefund
+	}
+	if err != nil {
+		return 0, err
+	}
+	if status != "PENDING" {
+		return orderID, ErrRefundSettled
+	}
+
+	refundStatus := "FAILED"
+	if result.ResultCode == 0 {
+		refundStatus = "COMPLETED"
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE refunds
+		SET status = $1, result_code = $2, result_desc = $3, transaction_id = NULLIF($4, ''), raw_result = $5, completed_at = $6
+		WHERE id = $7`,
+		refundStatus, result.ResultCode, result.ResultDesc, result.TransactionID, raw, time.Now(), refundID,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	if refundStatus == "COMPLETED" {
+		if err = refundOrder(ctx, tx, orderID, amount); err != nil {
+			return 0, err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+	return orderID, nil
+}
+
+// refundOrder moves an order to REFUNDED once its completed refunds cover what
+// was paid, or to PARTIALLY_REFUNDED before then. Where the lifecycle doesn't
+// allow that (a cancelled order, or one already partly refunded) the refund is
+// only noted in the order's history.
+func refundOrder(ctx context.Context, tx *sql.Tx, orderID int, amount float64) error {
+	order, err := loadForPayment(ctx, tx, orderID)
+	if err != nil {
+		return err
+	}
+
+	var refunded float64
+	err = tx.QueryRowContext(ctx,
+		`SELECT COALESCE(SUM(amount), 0) FROM refunds WHERE order_id = $1 AND status = 'COMPLETED'`,
+		orderID,
+	).Scan(&refunded)
+	if err != nil {
+		return err
+	}
+
+	note := fmt.Sprintf("KES %.2f refunded", amount)
+	if refunded >= order.AmountPaid && models.CanTransition(order.Status, models.StatusRefunded) {
+		return setStatus(ctx, tx, orderID, order.Status, models.StatusRefunded, "mpesa", note)
+	}
+	if refunded > 0 && refunded < order.AmountPaid && models.CanTransition(order.Status, models.StatusPartRefunded) {
+		return setStatus(ctx, tx, orderID, order.Status, models.StatusPartRefunded, "mpesa", note)
+	}
+	return logStatus(ctx, tx, orderID, order.Status, order.Status, "mpesa", note)
+}
+
+// ForOrder lists the refunds made against an order, newest first
+func (m *RefundModel) ForOrder(orderID int) ([]models.Refund, error) {
+	stmt := `
+		SELECT id, order_id, method, amount, reason, status,
+		       COALESCE(originator_conversation_id, ''), COALESCE(conversation_id, ''), COALESCE(transaction_id, ''),
+		       COALESCE(result_code, 0), COALESCE(result_desc, ''), created_at, COALESCE(completed_at::text, '')
+		FROM refunds WHERE order_id = $1 ORDER BY id DESC
+	`
+	rows, err := m.DB.Query(stmt, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var refunds []models.Refund
+	for rows.Next() {
+		var r models.Refund
+		err = rows.Scan(&r.ID, &r.OrderID, &r.Method, &r.Amount, &r.Reason, &r.Status,
+			&r.OriginatorConversationID, &r.ConversationID, &r.TransactionID,
+			&r.ResultCode, &r.ResultDesc, &r.CreatedAt, &r.CompletedAt)
+		if err != nil {
+			return nil, err
+		}
+		refunds = append(refunds, r)
+	}
+	return refunds, rows.Err()
+}
@@ -0,0 +1,62 @@
+package repository
+
+import (
+	"crave-and-glaze/internal/models"
+	"database/sql"
+)
+
+// ZoneModel holds the areas we deliver to and what each costs
+type ZoneModel struct {
+	DB *sql.DB
+}
+
+// All lists the delivery zones by name
+func (m *ZoneModel) All() ([]models.DeliveryZone, error) {
+	stmt := `SELECT id, name, fee, min_order, free_over FROM delivery_zones ORDER BY name ASC`
+	rows, err := m.DB.Query(stmt)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var zones []models.DeliveryZone
+	for rows.Next() {
+		var z models.DeliveryZone
+		if err = rows.Scan(&z.ID, &z.Name, &z.Fee, &z.MinOrder, &z.FreeOver); err != nil {
+			return nil, err
+		}
+		zones = append(zones, z)
+	}
+	return zones, rows.Err()
+}
+
+// Get fetches a single delivery zone
+func (m *ZoneModel) Get(id int) (*models.DeliveryZone, error) {
+	stmt := `SELECT id, name, fee, min_order, free_over FROM delivery_zones WHERE id = $1`
+	z := &models.DeliveryZone{}
+	err := m.DB.QueryRow(stmt, id).Scan(&z.ID, &z.Name, &z.Fee, &z.MinOrder, &z.FreeOver)
+	if err != nil {
+		return nil, err
+	}
+	return z, nil
+}
+
+// Insert adds a delivery zone
+func (m *ZoneModel) Insert(z models.DeliveryZone) error {
+	stmt := `INSERT INTO delivery_zones (name, fee, min_order, free_over) VALUES ($1, $2, $3, $4)`
+	_, err := m.DB.Exec(stmt, z.Name, z.Fee, z.MinOrder, z.FreeOver)
+	return err
+}
+
+// Update changes a zone's name and prices. Orders already placed keep the fee they were charged.
+func (m *ZoneModel) Update(z models.DeliveryZone) error {
+	stmt := `UPDATE delivery_zones SET name = $1, fee = $2, min_order = $3, free_over = $4 WHERE id = $5`
+	_, err := m.DB.Exec(stmt, z.Name, z.Fee, z.MinOrder, z.FreeOver, z.ID)
+	return err
+}
+
+// Delete removes a delivery zone
+func (m *ZoneModel) Delete(id int) error {
+	_, err := m.DB.Exec(`DELETE FROM delivery_zones WHERE id = $1`, id)
+	return err
+}
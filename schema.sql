@@ -39,7 +39,7 @@ CREATE TABLE IF NOT EXISTS orders (
     customer_name VARCHAR(100) NOT NULL,
     customer_phone VARCHAR(20) NOT NULL, -- Crucial for MPESA
     total_amount DECIMAL(10, 2) NOT NULL,
-    status VARCHAR(20) DEFAULT 'PENDING', -- PENDING, PAID, FAILED
+    status VARCHAR(30) DEFAULT 'PENDING_PAYMENT', -- see models.OrderTransitions
     mpesa_receipt VARCHAR(50),
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 );
@@ -55,5 +55,220 @@ CREATE TABLE IF NOT EXISTS order_items (
     price_at_purchase DECIMAL(10, 2) NOT NULL
 );
 
+-- Order Status History (every status change, who made it and why)
+CREATE TABLE IF NOT EXISTS order_status_history (
+    id SERIAL PRIMARY KEY,
+    order_id INT REFERENCES orders(id) ON DELETE CASCADE,
+    from_status VARCHAR(30), -- NULL when the order was placed
+    to_status VARCHAR(30) NOT NULL,
+    changed_by VARCHAR(100) NOT NULL, -- customer, mpesa, c2b, system, or the admin's username
+    note TEXT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_order_status_history_order ON order_status_history(order_id);
+
+-- Payment Attempts (One row per STK Push, matched to callbacks by CheckoutRequestID)
+CREATE TABLE IF NOT EXISTS payment_attempts (
+    id SERIAL PRIMARY KEY,
+    order_id INT REFERENCES orders(id) ON DELETE CASCADE,
+    merchant_request_id VARCHAR(100), -- NULL until Safaricom accepts the push
+    checkout_request_id VARCHAR(100) UNIQUE,
+    phone_number VARCHAR(20) NOT NULL,
+    amount DECIMAL(10, 2) NOT NULL,
+    status VARCHAR(20) DEFAULT 'PENDING', -- SENDING, PENDING, SUCCESS, FAILED, REJECTED, ERROR
+    result_code INT,
+    result_desc TEXT,
+    mpesa_receipt VARCHAR(50),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    settled_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_payment_attempts_order ON payment_attempts(order_id);
+
+-- A receipt can only ever pay for one attempt
+CREATE UNIQUE INDEX IF NOT EXISTS idx_payment_attempts_receipt ON payment_attempts(mpesa_receipt);
+
+-- C2B payments (customers paying the Paybill/Till from the M-Pesa menu)
+CREATE TABLE IF NOT EXISTS c2b_payments (
+    id SERIAL PRIMARY KEY,
+    trans_id VARCHAR(50) UNIQUE NOT NULL, -- M-Pesa receipt
+    trans_time VARCHAR(20),
+    amount DECIMAL(10, 2) NOT NULL,
+    bill_ref VARCHAR(100), -- Account number the customer typed
+    msisdn VARCHAR(100),
+    payer_name VARCHAR(150),
+    order_id INT REFERENCES orders(id),
+    status VARCHAR(20) DEFAULT 'UNALLOCATED', -- UNALLOCATED, ALLOCATED
+    note TEXT,
+    match_order_id INT REFERENCES orders(id), -- Order the account number named, while Safaricom confirms the payment
+    verify_token VARCHAR(64), -- Secret in the Transaction Status ResultURL
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    allocated_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_c2b_payments_status ON c2b_payments(status);
+
+-- Every callback Safaricom (or anyone else) sends us, kept for audit
+CREATE TABLE IF NOT EXISTS mpesa_callbacks (
+    id SERIAL PRIMARY KEY,
+    kind VARCHAR(30) NOT NULL, -- STK, REFUND_RESULT, REFUND_TIMEOUT, C2B_VALIDATION, C2B_CONFIRMATION, C2B_STATUS_RESULT, C2B_STATUS_TIMEOUT
+    remote_ip VARCHAR(64),
+    reference VARCHAR(100), -- CheckoutRequestID / ConversationID once parsed
+    payload TEXT,
+    outcome VARCHAR(20), -- ACCEPTED, REJECTED, ERROR
+    note TEXT,
+    received_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Refunds (Reversals and B2C payments back to customers)
+CREATE TABLE IF NOT EXISTS refunds (
+    id SERIAL PRIMARY KEY,
+    order_id INT REFERENCES orders(id) ON DELETE CASCADE,
+    method VARCHAR(20) NOT NULL, -- REVERSAL, B2C
+    amount DECIMAL(10, 2) NOT NULL,
+    reason TEXT NOT NULL,
+    status VARCHAR(20) DEFAULT 'PENDING', -- REQUESTED, PENDING, COMPLETED, FAILED
+    originator_conversation_id VARCHAR(100),
+    conversation_id VARCHAR(100) UNIQUE,
+    transaction_id VARCHAR(50),
+    result_code INT,
+    result_desc TEXT,
+    raw_result TEXT,
+    callback_token VARCHAR(64), -- Secret part of the ResultURL, set when the refund is sent
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    completed_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_refunds_order ON refunds(order_id);
+
+-- Closed Dates (no pickups or deliveries that day)
+CREATE TABLE IF NOT EXISTS closed_dates (
+    closed_on DATE PRIMARY KEY,
+    reason TEXT
+);
+
+-- How much the kitchen can bake per day. 0 means no limit.
+CREATE TABLE IF NOT EXISTS capacity_defaults (
+    weekday INT PRIMARY KEY, -- 0 = Sunday
+    max_kg DECIMAL(6, 2) NOT NULL DEFAULT 0,
+    max_cakes INT NOT NULL DEFAULT 0
+);
+
+-- Capacity for a single date, replacing its weekday's
+CREATE TABLE IF NOT EXISTS capacity_overrides (
+    on_date DATE PRIMARY KEY,
+    max_kg DECIMAL(6, 2) NOT NULL DEFAULT 0,
+    max_cakes INT NOT NULL DEFAULT 0
+);
+
+-- Areas we deliver to. Orders copy the name and fee, so editing a zone
+-- doesn't change orders already placed.
+CREATE TABLE IF NOT EXISTS delivery_zones (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(100) NOT NULL,
+    fee DECIMAL(10, 2) NOT NULL DEFAULT 0,
+    min_order DECIMAL(10, 2) NOT NULL DEFAULT 0, -- 0 = any order
+    free_over DECIMAL(10, 2) NOT NULL DEFAULT 0 -- 0 = never free
+);
+
+-- Shopping carts, keyed by the opaque ID in the visitor's cookie
+CREATE TABLE IF NOT EXISTS carts (
+    id VARCHAR(64) PRIMARY KEY,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Carts untouched for longer than the cookie lives are deleted
+CREATE INDEX IF NOT EXISTS idx_carts_updated_at ON carts(updated_at);
+
+-- Cart lines. The name and price are what the customer saw when adding the
+-- cake; checkout prices them again. No foreign key on the variant, so a cake
+-- deleted since can still be shown as no longer available.
+CREATE TABLE IF NOT EXISTS cart_items (
+    id SERIAL PRIMARY KEY,
+    cart_id VARCHAR(64) REFERENCES carts(id) ON DELETE CASCADE,
+    position INT NOT NULL DEFAULT 0,
+    product_variant_id INT NOT NULL,
+    product_name VARCHAR(255) NOT NULL,
+    image_url VARCHAR(255) NOT NULL DEFAULT '',
+    price DECIMAL(10, 2) NOT NULL,
+    quantity INT NOT NULL DEFAULT 1,
+    custom_message TEXT NOT NULL DEFAULT '',
+    icing_flavor VARCHAR(100) NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS idx_cart_items_cart ON cart_items(cart_id);
+
+-- Reminder emails about carts left at checkout and orders never paid for.
+-- A row starts with the cart once the visitor types their email, and moves
+-- on to the order placed from it. step counts the reminders sent since
+-- step_since (when the customer was last active).
+CREATE TABLE IF NOT EXISTS cart_recoveries (
+    id SERIAL PRIMARY KEY,
+    token VARCHAR(64) UNIQUE NOT NULL, -- In the restore and unsubscribe links
+    email VARCHAR(255) NOT NULL,
+    cart_id VARCHAR(64) UNIQUE,
+    order_id INT UNIQUE REFERENCES orders(id) ON DELETE CASCADE,
+    cart_value DECIMAL(10, 2) NOT NULL DEFAULT 0,
+    step INT NOT NULL DEFAULT 0,
+    step_since TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    reminders_sent INT NOT NULL DEFAULT 0,
+    last_sent_at TIMESTAMP,
+    status VARCHAR(20) NOT NULL DEFAULT 'OPEN', -- OPEN, CLOSED
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Addresses that asked for no more reminder emails
+CREATE TABLE IF NOT EXISTS email_optouts (
+    email VARCHAR(255) PRIMARY KEY,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Discount codes customers type at checkout. value is a percentage for
+-- PERCENT and shillings for FIXED; 0 in a limit means no limit.
+CREATE TABLE IF NOT EXISTS promotions (
+    id SERIAL PRIMARY KEY,
+    code VARCHAR(30) UNIQUE NOT NULL, -- Stored upper case
+    description VARCHAR(255) NOT NULL DEFAULT '',
+    kind VARCHAR(10) NOT NULL, -- PERCENT, FIXED
+    value DECIMAL(10, 2) NOT NULL,
+    min_spend DECIMAL(10, 2) NOT NULL DEFAULT 0,
+    starts_on DATE,
+    ends_on DATE,
+    max_uses INT NOT NULL DEFAULT 0,
+    max_per_customer INT NOT NULL DEFAULT 0,
+    active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Cakes a promotion is limited to, directly or by category. A promotion with
+-- neither applies to every cake.
+CREATE TABLE IF NOT EXISTS promotion_products (
+    promotion_id INT REFERENCES promotions(id) ON DELETE CASCADE,
+    product_id INT REFERENCES products(id) ON DELETE CASCADE,
+    PRIMARY KEY (promotion_id, product_id)
+);
+
+CREATE TABLE IF NOT EXISTS promotion_categories (
+    promotion_id INT REFERENCES promotions(id) ON DELETE CASCADE,
+    category_id INT REFERENCES categories(id) ON DELETE CASCADE,
+    PRIMARY KEY (promotion_id, category_id)
+);
+
+-- Orders placed with a discount code, for the usage limits and reports. The
+-- order keeps its own copy of the code and amount (orders.discount_*).
+CREATE TABLE IF NOT EXISTS promotion_redemptions (
+    id SERIAL PRIMARY KEY,
+    promotion_id INT REFERENCES promotions(id) ON DELETE CASCADE,
+    order_id INT UNIQUE REFERENCES orders(id) ON DELETE CASCADE,
+    phone VARCHAR(20) NOT NULL, -- 2547XXXXXXXX, for the per-customer limit
+    email VARCHAR(255) NOT NULL DEFAULT '',
+    amount DECIMAL(10, 2) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_promotion_redemptions_promotion ON promotion_redemptions(promotion_id);
+
 -- Seed some initial data for testing
 INSERT INTO categories (name, slug) VALUES ('Birthday Cakes', 'birthday-cakes') ON CONFLICT DO NOTHING;
\ No newline at end of file